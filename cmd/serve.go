@@ -15,6 +15,7 @@ import (
 	"github.com/cozy/cozy-stack/model/stack"
 	build "github.com/cozy/cozy-stack/pkg/config"
 	"github.com/cozy/cozy-stack/pkg/config/config"
+	"github.com/cozy/cozy-stack/pkg/couchdb"
 	"github.com/cozy/cozy-stack/pkg/utils"
 	"github.com/cozy/cozy-stack/web"
 	"github.com/spf13/cobra"
@@ -122,6 +123,9 @@ example), you can use the --appdir flag like this:
 			if err := group.Shutdown(ctx); err != nil {
 				return err
 			}
+			if err := couchdb.Drain(ctx); err != nil {
+				return err
+			}
 			fmt.Println("All settled, bye bye !")
 			return nil
 		}
@@ -180,10 +180,11 @@ func CreateMyself(db couchdb.Database, settings *couchdb.JSONDoc) (*Contact, err
 // GetMyself returns the myself contact document, or an ErrNotFound error.
 func GetMyself(db couchdb.Database) (*Contact, error) {
 	var docs []*Contact
+	limit := 1
 	req := &couchdb.FindRequest{
 		UseIndex: "by-me",
 		Selector: mango.Equal("me", true),
-		Limit:    1,
+		Limit:    &limit,
 	}
 	err := couchdb.FindDocs(db, consts.Contacts, req, &docs)
 	if err != nil {
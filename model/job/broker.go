@@ -332,6 +332,7 @@ func Get(db prefixer.Prefixer, jobID string) (*Job, error) {
 // GetQueuedJobs returns the list of jobs which states is "queued" or "running"
 func GetQueuedJobs(db prefixer.Prefixer, workerType string) ([]*Job, error) {
 	var results []*Job
+	limit := 200
 	req := &couchdb.FindRequest{
 		UseIndex: "by-worker-and-state",
 		Selector: mango.And(
@@ -342,7 +343,7 @@ func GetQueuedJobs(db prefixer.Prefixer, workerType string) ([]*Job, error) {
 				mango.Equal("state", Running),
 			),
 		),
-		Limit: 200,
+		Limit: &limit,
 	}
 	err := couchdb.FindDocs(db, consts.Jobs, req, &results)
 	if err != nil {
@@ -218,7 +218,7 @@ func GetJobs(db prefixer.Prefixer, triggerID string, limit int) ([]*Job, error)
 			{Field: "trigger_id", Direction: mango.Desc},
 			{Field: "queued_at", Direction: mango.Desc},
 		},
-		Limit: limit,
+		Limit: &limit,
 	}
 	err := couchdb.FindDocs(db, consts.Jobs, req, &jobs)
 	if err != nil {
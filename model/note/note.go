@@ -414,6 +414,7 @@ func List(inst *instance.Instance, bookmark string) ([]*vfs.FileDoc, string, err
 	defer lock.Unlock()
 
 	var docs []*vfs.FileDoc
+	limit := 100
 	req := &couchdb.FindRequest{
 		UseIndex: "by-mime-updated-at",
 		Selector: mango.And(
@@ -426,7 +427,7 @@ func List(inst *instance.Instance, bookmark string) ([]*vfs.FileDoc, string, err
 			{Field: "trashed", Direction: mango.Desc},
 			{Field: "updated_at", Direction: mango.Desc},
 		},
-		Limit:    100,
+		Limit:    &limit,
 		Bookmark: bookmark,
 	}
 	res, err := couchdb.FindDocsRaw(inst, consts.Files, req, &docs)
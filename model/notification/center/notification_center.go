@@ -223,6 +223,7 @@ func makePush(inst *instance.Instance, p *notification.Properties, n *notificati
 
 func findLastNotification(inst *instance.Instance, source string) (*notification.Notification, error) {
 	var notifs []*notification.Notification
+	limit := 1
 	req := &couchdb.FindRequest{
 		UseIndex: "by-source-id",
 		Selector: mango.Equal("source_id", source),
@@ -230,7 +231,7 @@ func findLastNotification(inst *instance.Instance, source string) (*notification
 			{Field: "source_id", Direction: mango.Desc},
 			{Field: "created_at", Direction: mango.Desc},
 		},
-		Limit: 1,
+		Limit: &limit,
 	}
 	err := couchdb.FindDocs(inst, consts.Notifications, req, &notifs)
 	if err != nil {
@@ -182,9 +182,10 @@ func FindClient(i *instance.Instance, id string) (*Client, error) {
 func FindClientBySoftwareID(i *instance.Instance, softwareID string) (*Client, error) {
 	var results []*Client
 
+	limit := 1
 	req := couchdb.FindRequest{
 		Selector: mango.Equal("software_id", softwareID),
-		Limit:    1,
+		Limit:    &limit,
 	}
 	// We should have very few requests. Only on instance creation.
 	err := couchdb.FindDocsUnoptimized(i, consts.OAuthClients, &req, &results)
@@ -201,9 +202,10 @@ func FindClientBySoftwareID(i *instance.Instance, softwareID string) (*Client, e
 func FindClientByOnBoardingSecret(i *instance.Instance, onboardingSecret string) (*Client, error) {
 	var results []*Client
 
+	limit := 1
 	req := couchdb.FindRequest{
 		Selector: mango.Equal("onboarding_secret", onboardingSecret),
-		Limit:    1,
+		Limit:    &limit,
 	}
 	// We should have very few requests. Only on instance creation.
 	err := couchdb.FindDocsUnoptimized(i, consts.OAuthClients, &req, &results)
@@ -220,9 +222,10 @@ func FindClientByOnBoardingSecret(i *instance.Instance, onboardingSecret string)
 func FindOnboardingClient(i *instance.Instance) (*Client, error) {
 	var results []*Client
 
+	limit := 1
 	req := couchdb.FindRequest{
 		Selector: mango.Exists("onboarding_secret"),
-		Limit:    1,
+		Limit:    &limit,
 	}
 	// We should have very few requests. Only on instance creation.
 	err := couchdb.FindDocsUnoptimized(i, consts.OAuthClients, &req, &results)
@@ -222,13 +222,14 @@ func GetForShareInteract(db prefixer.Prefixer, sharingID string) (*Permission, e
 
 func getFromSource(db prefixer.Prefixer, permType, docType, slug string) (*Permission, error) {
 	var res []Permission
+	limit := 1
 	req := couchdb.FindRequest{
 		UseIndex: "by-source-and-type",
 		Selector: mango.And(
 			mango.Equal("type", permType),
 			mango.Equal("source_id", docType+"/"+slug),
 		),
-		Limit: 1,
+		Limit: &limit,
 	}
 	err := couchdb.FindDocs(db, consts.Permissions, &req, &res)
 	if err != nil {
@@ -144,6 +144,7 @@ func StoreNewLoginEntry(i *instance.Instance, sessionID, clientID string, req *h
 
 func sendLoginNotification(i *instance.Instance, l *LoginEntry) error {
 	var results []*LoginEntry
+	limit := 1
 	r := &couchdb.FindRequest{
 		UseIndex: "by-os-browser-ip",
 		Selector: mango.And(
@@ -152,7 +153,7 @@ func sendLoginNotification(i *instance.Instance, l *LoginEntry) error {
 			mango.Equal("ip", l.IP),
 			mango.NotEqual("_id", l.ID()),
 		),
-		Limit: 1,
+		Limit: &limit,
 	}
 	err := couchdb.FindDocs(i, consts.SessionsLogins, r, &results)
 	sendNotification := err != nil || len(results) == 0
@@ -293,8 +293,7 @@ func (c *couchdbIndexer) MoveDir(oldpath, newpath string) error {
 		req := &couchdb.FindRequest{
 			UseIndex: "dir-by-path",
 			Selector: sel,
-			Skip:     0,
-			Limit:    limit,
+			Limit:    &limit,
 		}
 		err := couchdb.FindDocs(c.db, consts.Files, req, &children)
 		if err != nil {
@@ -362,10 +361,11 @@ func (c *couchdbIndexer) DirByPath(name string) (*DirDoc, error) {
 	}
 	var docs []*DirDoc
 	sel := mango.Equal("path", path.Clean(name))
+	limit := 1
 	req := &couchdb.FindRequest{
 		UseIndex: "dir-by-path",
 		Selector: sel,
-		Limit:    1,
+		Limit:    &limit,
 	}
 	err := couchdb.FindDocs(c.db, consts.Files, req, &docs)
 	if err != nil {
@@ -913,10 +913,11 @@ func cleanDirsMap(
 
 func (c *couchdbIndexer) checkNoConflicts(accumulate func(*FsckLog), failFast bool) error {
 	var docs []DirOrFileDoc
+	limit := 1000
 	req := &couchdb.FindRequest{
 		UseIndex:  "with-conflicts",
 		Selector:  mango.Exists("_conflicts"),
-		Limit:     1000,
+		Limit:     &limit,
 		Conflicts: true,
 	}
 	_, err := couchdb.FindDocsRaw(c.db, consts.Files, req, &docs)
@@ -76,10 +76,11 @@ func (i *iter) fetch() error {
 	i.index = 0
 	i.list = i.list[:0]
 
+	limit := i.opt.ByFetch
 	req := &couchdb.FindRequest{
 		UseIndex: "dir-children",
 		Selector: i.sel,
-		Limit:    i.opt.ByFetch,
+		Limit:    &limit,
 		Bookmark: i.bookmark,
 	}
 	resp, err := couchdb.FindDocsRaw(i.db, consts.Files, req, &i.list)
@@ -178,6 +178,44 @@ type CouchDB struct {
 	Auth   *url.Userinfo
 	URL    *url.URL
 	Client *http.Client
+	// ReadURLs are the URLs of some read replicas of CouchDB. If some are
+	// configured, the GET requests are sent to them instead of URL.
+	ReadURLs []*url.URL
+	// WarnDocumentSize is the size, in bytes, above which a warning is logged
+	// when a document is written (0 to disable it).
+	WarnDocumentSize int
+	// MaxDocumentSize is the size, in bytes, above which a document is
+	// rejected before being sent to CouchDB (0 to disable it).
+	MaxDocumentSize int
+	// ExecutionStats enables the execution_stats on all the _find requests.
+	ExecutionStats bool
+	// SlowQueryThreshold is the execution time above which the stats of a
+	// _find request are logged.
+	SlowQueryThreshold time.Duration
+	// FullScanRatio is the ratio between the documents examined and the
+	// documents returned by a _find request above which a warning is logged,
+	// as the request is probably not using a good index (0 to disable it).
+	// The execution stats are enabled for all the _find requests when set.
+	FullScanRatio float64
+	// LogIndexSelection logs the index chosen by CouchDB for the _find
+	// requests without use_index, with an _explain request made in the
+	// background.
+	LogIndexSelection bool
+	// MaxConcurrency is the maximal number of concurrent requests made by each
+	// call of the bulk helpers (like DefineViews).
+	MaxConcurrency int
+	// SessionAuth enables the authentication with a session cookie, obtained
+	// from the _session endpoint, instead of the basic auth.
+	SessionAuth bool
+	// ProxyAuthUser, ProxyAuthRoles and ProxyAuthSecret are used for the proxy
+	// authentication of CouchDB, when ProxyAuthUser is not empty.
+	ProxyAuthUser   string
+	ProxyAuthRoles  []string
+	ProxyAuthSecret string
+	// DevQ and DevN are the number of shards and replicas forced on the
+	// creation of the databases by the dev releases (1 by default).
+	DevQ int
+	DevN int
 }
 
 // Jobs contains the configuration values for the jobs and triggers
@@ -404,6 +442,8 @@ func applyDefaults(v *viper.Viper) {
 	v.SetDefault("assets_polling_interval", 2*time.Minute)
 	v.SetDefault("fs.versioning.max_number_of_versions_to_keep", 20)
 	v.SetDefault("fs.versioning.min_delay_between_two_versions", 15*time.Minute)
+	v.SetDefault("couchdb.slow_query_threshold", 1*time.Second)
+	v.SetDefault("couchdb.max_concurrency", runtime.NumCPU())
 }
 
 func envMap() map[string]string {
@@ -446,9 +486,25 @@ func UseViper(v *viper.Viper) error {
 	if couchURL.Path == "" {
 		couchURL.Path = "/"
 	}
+	var couchReadURLs []*url.URL
+	for _, readURL := range v.GetStringSlice("couchdb.read_urls") {
+		u, _, err := parseURL(readURL)
+		if err != nil {
+			return err
+		}
+		if u.Path == "" {
+			u.Path = "/"
+		}
+		couchReadURLs = append(couchReadURLs, u)
+	}
+	couchTimeout := 10 * time.Second
+	if t := v.GetDuration("couchdb.request_timeout"); t > 0 {
+		couchTimeout = t
+	}
 	couchClient, _, err := tlsclient.NewHTTPClient(tlsclient.HTTPEndpoint{
-		Timeout:    10 * time.Second,
-		RootCAFile: v.GetString("couchdb.root_ca"),
+		Timeout:     couchTimeout,
+		DialTimeout: v.GetDuration("couchdb.dial_timeout"),
+		RootCAFile:  v.GetString("couchdb.root_ca"),
 		ClientCertificateFiles: tlsclient.ClientCertificateFilePair{
 			CertificateFile: v.GetString("couchdb.client_cert"),
 			KeyFile:         v.GetString("couchdb.client_key"),
@@ -678,9 +734,23 @@ func UseViper(v *viper.Viper) error {
 			},
 		},
 		CouchDB: CouchDB{
-			Auth:   couchAuth,
-			URL:    couchURL,
-			Client: couchClient,
+			Auth:               couchAuth,
+			URL:                couchURL,
+			ReadURLs:           couchReadURLs,
+			Client:             couchClient,
+			WarnDocumentSize:   v.GetInt("couchdb.warn_document_size"),
+			MaxDocumentSize:    v.GetInt("couchdb.max_document_size"),
+			ExecutionStats:     v.GetBool("couchdb.execution_stats"),
+			SlowQueryThreshold: v.GetDuration("couchdb.slow_query_threshold"),
+			FullScanRatio:      v.GetFloat64("couchdb.full_scan_ratio"),
+			LogIndexSelection:  v.GetBool("couchdb.log_index_selection"),
+			MaxConcurrency:     v.GetInt("couchdb.max_concurrency"),
+			SessionAuth:        v.GetBool("couchdb.session_auth"),
+			ProxyAuthUser:      v.GetString("couchdb.proxy_auth.username"),
+			ProxyAuthRoles:     v.GetStringSlice("couchdb.proxy_auth.roles"),
+			ProxyAuthSecret:    v.GetString("couchdb.proxy_auth.secret"),
+			DevQ:               v.GetInt("couchdb.dev_q"),
+			DevN:               v.GetInt("couchdb.dev_n"),
 		},
 		Jobs: jobs,
 		Konnectors: Konnectors{
@@ -99,4 +99,7 @@ const (
 	NotesEvents = "io.cozy.notes.events"
 	// NotesURL doc type is used to return the URL where a note can be edited.
 	NotesURL = "io.cozy.notes.url"
+	// Diagnostics doc type is used for the throwaway documents written to check
+	// that CouchDB is working.
+	Diagnostics = "io.cozy.diagnostics"
 )
@@ -0,0 +1,270 @@
+package couchdb
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/cozy/cozy-stack/pkg/logger"
+)
+
+// GetAttachmentRange returns a reader on a part of an attachment of a
+// document, from the start byte to the end byte (inclusive), and the total
+// size of the attachment. An end of -1 means until the end of the attachment.
+// The reader must be closed by the caller.
+func GetAttachmentRange(db Database, doctype, id, name string, start, end int64) (io.ReadCloser, int64, error) {
+	if id == "" || name == "" {
+		return nil, 0, fmt.Errorf("Missing ID or name for GetAttachmentRange")
+	}
+	if start < 0 || (end >= 0 && end < start) {
+		return nil, 0, newRangeNotSatisfiableError(-1)
+	}
+	rng := fmt.Sprintf("bytes=%d-", start)
+	if end >= 0 {
+		rng += strconv.FormatInt(end, 10)
+	}
+	header := http.Header{"Range": {rng}}
+	path := url.PathEscape(id) + "/" + url.PathEscape(name)
+	resp, err := makeRawRequest(db, doctype, http.MethodGet, path, header)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	if resp.StatusCode == http.StatusPartialContent {
+		size := parseContentRangeSize(resp.Header.Get("Content-Range"))
+		return resp.Body, size, nil
+	}
+
+	// CouchDB ignores the range for the compressed attachments, and sends
+	// the whole content.
+	size := resp.ContentLength
+	if _, err := io.CopyN(ioutil.Discard, resp.Body, start); err != nil {
+		resp.Body.Close()
+		if err == io.EOF {
+			return nil, 0, newRangeNotSatisfiableError(size)
+		}
+		return nil, 0, newIOReadError(err)
+	}
+	if end < 0 {
+		return resp.Body, size, nil
+	}
+	return &limitedReadCloser{io.LimitReader(resp.Body, end-start+1), resp.Body}, size, nil
+}
+
+// DeleteAttachment removes an attachment from a document, and returns the new
+// revision of the document. The rev must be the current revision of the
+// document, or a conflict error is returned.
+func DeleteAttachment(db Database, doctype, id, rev, name string) (string, error) {
+	if id == "" || rev == "" || name == "" {
+		return "", fmt.Errorf("Missing ID, rev or name for DeleteAttachment")
+	}
+	path := url.PathEscape(id) + "/" + url.PathEscape(name) + "?rev=" + url.QueryEscape(rev)
+	var res UpdateResponse
+	if err := makeRequest(db, doctype, http.MethodDelete, path, nil, &res); err != nil {
+		return "", err
+	}
+	return res.Rev, nil
+}
+
+// AttachmentInfo is the metadata of an attachment, without its content
+type AttachmentInfo struct {
+	ContentType string `json:"content_type"`
+	Length      int64  `json:"length"`
+	Digest      string `json:"digest"`
+	Revpos      int    `json:"revpos,omitempty"`
+	Stub        bool   `json:"stub,omitempty"`
+	// Encoding and EncodedLength are only filled for the attachments compressed
+	// by CouchDB
+	Encoding      string `json:"encoding,omitempty"`
+	EncodedLength int64  `json:"encoded_length,omitempty"`
+}
+
+// GetAttachmentsInfo returns the metadata of the attachments of a document,
+// by name, without downloading their content. The map is empty for a document
+// without attachments.
+func GetAttachmentsInfo(db Database, doctype, id string) (map[string]AttachmentInfo, error) {
+	var err error
+	id, err = validateDocID(id)
+	if err != nil {
+		return nil, err
+	}
+	if id == "" {
+		return nil, fmt.Errorf("Missing ID for GetAttachmentsInfo")
+	}
+	var doc struct {
+		Attachments map[string]AttachmentInfo `json:"_attachments"`
+	}
+	path := url.PathEscape(id) + "?att_encoding_info=true"
+	if err = makeRequest(db, doctype, http.MethodGet, path, nil, &doc); err != nil {
+		return nil, err
+	}
+	if doc.Attachments == nil {
+		doc.Attachments = make(map[string]AttachmentInfo)
+	}
+	return doc.Attachments, nil
+}
+
+// GetDocWithAttachments fetches a document with the content of its
+// attachments. The document is decoded in out, and then fn is called for each
+// attachment with its name and content. CouchDB is asked to send them in a
+// multipart response, to avoid the overhead of the base64 encoding in JSON:
+// the content is streamed from the response, and must be read before fn
+// returns. The JSON response is also supported, but the attachments are then
+// in memory.
+func GetDocWithAttachments(db Database, doctype, id string, out Doc, fn func(name string, content io.Reader) error) error {
+	var err error
+	id, err = validateDocID(id)
+	if err != nil {
+		return err
+	}
+	if id == "" {
+		return fmt.Errorf("Missing ID for GetDocWithAttachments")
+	}
+	header := http.Header{"Accept": {"multipart/related, application/json"}}
+	path := url.PathEscape(id) + "?attachments=true"
+	resp, err := makeRawRequest(db, doctype, http.MethodGet, path, header)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return decodeDocWithAttachments(resp.Header.Get("Content-Type"), resp.Body, out, fn)
+}
+
+// decodeDocWithAttachments decodes a document with its attachments, from a
+// multipart or a JSON body.
+func decodeDocWithAttachments(contentType string, body io.Reader, out Doc, fn func(name string, content io.Reader) error) error {
+	mediaType, params, err := mime.ParseMediaType(contentType)
+	if err != nil || !strings.HasPrefix(mediaType, "multipart/") {
+		var doc struct {
+			Attachments map[string]struct {
+				Data string `json:"data"`
+			} `json:"_attachments"`
+		}
+		data, err := ioutil.ReadAll(body)
+		if err != nil {
+			return newIOReadError(err)
+		}
+		if err = json.Unmarshal(data, &doc); err != nil {
+			return err
+		}
+		if err = json.Unmarshal(data, out); err != nil {
+			return err
+		}
+		for name, att := range doc.Attachments {
+			content := base64.NewDecoder(base64.StdEncoding, strings.NewReader(att.Data))
+			if err = fn(name, content); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	reader := multipart.NewReader(body, params["boundary"])
+	for first := true; ; first = false {
+		part, err := reader.NextPart()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return newIOReadError(err)
+		}
+		if first {
+			// The first part is the JSON document
+			if err = json.NewDecoder(part).Decode(out); err != nil {
+				return err
+			}
+			continue
+		}
+		if err = fn(part.FileName(), part); err != nil {
+			return err
+		}
+	}
+}
+
+type limitedReadCloser struct {
+	io.Reader
+	io.Closer
+}
+
+// parseContentRangeSize returns the total size from a Content-Range header,
+// like "bytes 0-99/1234", or -1 if it is unknown.
+func parseContentRangeSize(header string) int64 {
+	i := strings.LastIndexByte(header, '/')
+	if i < 0 {
+		return -1
+	}
+	size, err := strconv.ParseInt(header[i+1:], 10, 64)
+	if err != nil {
+		return -1
+	}
+	return size
+}
+
+// makeRawRequest sends a request to CouchDB and returns the response, for the
+// requests where the body is not JSON. The body of the response must be
+// closed by the caller.
+func makeRawRequest(db Database, doctype, method, path string, header http.Header) (*http.Response, error) {
+	return makeRawRequestCtx(context.Background(), db, doctype, method, path, header, nil)
+}
+
+// makeRawRequestCtx is like makeRawRequest, with a context and a body for the
+// request. The request is counted as in progress for Drain until the body of
+// the response is closed.
+func makeRawRequestCtx(ctx context.Context, db Database, doctype, method, path string, header http.Header, body []byte) (*http.Response, error) {
+	return sendRawRequest(ctx, db, &couchRequest{
+		Method: method,
+		Path:   makeDBName(db, doctype) + "/" + path,
+		Header: header,
+		Body:   body,
+	})
+}
+
+// makeFeedRequestCtx is like makeRawRequestCtx, but for the long-lived feeds,
+// like the continuous changes feed: they are not counted as in progress, as
+// Drain would wait for them until its timeout. They must be stopped with
+// their context on shutdown.
+func makeFeedRequestCtx(ctx context.Context, db Database, doctype, method, path string, header http.Header, body []byte) (*http.Response, error) {
+	return sendRawRequest(ctx, db, &couchRequest{
+		Method: method,
+		Path:   makeDBName(db, doctype) + "/" + path,
+		Header: header,
+		Body:   body,
+		Feed:   true,
+	})
+}
+
+// sendRawRequest sends the request, and returns the response if it is
+// successful, or an error from its body.
+func sendRawRequest(ctx context.Context, db Database, r *couchRequest) (*http.Response, error) {
+	log := logger.WithDomain(db.DomainName()).WithField("nspace", "couchdb")
+	if logger.IsDebug(log) {
+		log.Debugf("request: %s %s", r.Method, r.Path)
+	}
+	resp, err := sendRequest(ctx, db, r)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return resp, nil
+	}
+
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusRequestedRangeNotSatisfiable {
+		size := parseContentRangeSize(resp.Header.Get("Content-Range"))
+		return nil, newRangeNotSatisfiableError(size)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, newIOReadError(err)
+	}
+	return nil, newCouchdbError(resp.StatusCode, body)
+}
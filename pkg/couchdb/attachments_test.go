@@ -0,0 +1,158 @@
+package couchdb
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetAttachmentRange(t *testing.T) {
+	content := "0123456789"
+	defer withFakeCouch(t, func(w http.ResponseWriter, r *http.Request) {
+		switch r.Header.Get("Range") {
+		case "bytes=2-5":
+			w.Header().Set("Content-Range", "bytes 2-5/10")
+			w.WriteHeader(http.StatusPartialContent)
+			_, _ = w.Write([]byte(content[2:6]))
+		case "bytes=20-":
+			w.Header().Set("Content-Range", "bytes */10")
+			w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+		default:
+			// Like CouchDB for a compressed attachment
+			_, _ = w.Write([]byte(content))
+		}
+	})()
+
+	body, size, err := GetAttachmentRange(TestPrefix, TestDoctype, "doc", "file", 2, 5)
+	if assert.NoError(t, err) {
+		data, _ := ioutil.ReadAll(body)
+		body.Close()
+		assert.Equal(t, "2345", string(data))
+		assert.Equal(t, int64(10), size)
+	}
+
+	body, size, err = GetAttachmentRange(TestPrefix, TestDoctype, "doc", "file", 3, 4)
+	if assert.NoError(t, err) {
+		data, _ := ioutil.ReadAll(body)
+		body.Close()
+		assert.Equal(t, "34", string(data))
+		assert.Equal(t, int64(10), size)
+	}
+
+	_, _, err = GetAttachmentRange(TestPrefix, TestDoctype, "doc", "file", 20, -1)
+	assert.True(t, IsRangeNotSatisfiableError(err))
+	_, _, err = GetAttachmentRange(TestPrefix, TestDoctype, "doc", "file", 5, 2)
+	assert.True(t, IsRangeNotSatisfiableError(err))
+}
+
+func TestGetAttachmentRangeTooManyRequests(t *testing.T) {
+	calls := 0
+	defer withFakeCouch(t, func(w http.ResponseWriter, r *http.Request) {
+		calls++
+		if calls == 1 {
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusTooManyRequests)
+			return
+		}
+		_, _ = w.Write([]byte("0123456789"))
+	})()
+
+	// The raw requests are retried like the JSON ones
+	body, _, err := GetAttachmentRange(TestPrefix, TestDoctype, "doc", "file", 0, 3)
+	if assert.NoError(t, err) {
+		data, _ := ioutil.ReadAll(body)
+		body.Close()
+		assert.Equal(t, "0123", string(data))
+	}
+	assert.Equal(t, 2, calls)
+}
+
+func TestDeleteAttachment(t *testing.T) {
+	doc := &JSONDoc{Type: TestDoctype, M: map[string]interface{}{
+		"_attachments": map[string]interface{}{
+			"hello.txt": map[string]interface{}{
+				"content_type": "text/plain",
+				"data":         "aGVsbG8=",
+			},
+		},
+	}}
+	assert.NoError(t, CreateDoc(TestPrefix, doc))
+
+	_, err := DeleteAttachment(TestPrefix, TestDoctype, doc.ID(), "1-123", "hello.txt")
+	assert.True(t, IsConflictError(err))
+
+	rev, err := DeleteAttachment(TestPrefix, TestDoctype, doc.ID(), doc.Rev(), "hello.txt")
+	assert.NoError(t, err)
+	assert.NotEqual(t, doc.Rev(), rev)
+
+	_, err = DeleteAttachment(TestPrefix, TestDoctype, doc.ID(), rev, "hello.txt")
+	assert.True(t, IsNotFoundError(err))
+}
+
+func TestDecodeDocWithAttachments(t *testing.T) {
+	body := "--abc\r\n" +
+		"Content-Type: application/json\r\n\r\n" +
+		`{"_id":"foo","_rev":"2-xyz","_attachments":{"hello.txt":{"follows":true,"length":5}}}` + "\r\n" +
+		"--abc\r\n" +
+		"Content-Disposition: attachment; filename=\"hello.txt\"\r\n" +
+		"Content-Type: text/plain\r\n\r\n" +
+		"hello\r\n" +
+		"--abc--"
+	doc := &JSONDoc{}
+	atts := make(map[string]string)
+	err := decodeDocWithAttachments(`multipart/related; boundary="abc"`, strings.NewReader(body), doc, collectAttachments(atts))
+	assert.NoError(t, err)
+	assert.Equal(t, "2-xyz", doc.Rev())
+	assert.Equal(t, map[string]string{"hello.txt": "hello"}, atts)
+
+	body = `{"_id":"foo","_rev":"2-xyz","_attachments":{"hello.txt":{"data":"aGVsbG8="}}}`
+	doc = &JSONDoc{}
+	atts = make(map[string]string)
+	err = decodeDocWithAttachments("application/json", strings.NewReader(body), doc, collectAttachments(atts))
+	assert.NoError(t, err)
+	assert.Equal(t, "foo", doc.ID())
+	assert.Equal(t, map[string]string{"hello.txt": "hello"}, atts)
+}
+
+// collectAttachments returns a callback for GetDocWithAttachments that puts
+// the content of the attachments in the map.
+func collectAttachments(atts map[string]string) func(string, io.Reader) error {
+	return func(name string, content io.Reader) error {
+		data, err := ioutil.ReadAll(content)
+		atts[name] = string(data)
+		return err
+	}
+}
+
+func TestGetAttachmentsInfo(t *testing.T) {
+	defer withFakeCouch(t, func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "true", r.URL.Query().Get("att_encoding_info"))
+		if strings.HasSuffix(r.URL.Path, "/bare") {
+			_, _ = w.Write([]byte(`{"_id":"bare","_rev":"1-abc"}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"_id":"doc","_rev":"2-abc","_attachments":{
+			"notes.txt":{"content_type":"text/plain","revpos":2,"digest":"md5-abc","length":1200,"stub":true,
+			             "encoding":"gzip","encoded_length":300}}}`))
+	})()
+
+	infos, err := GetAttachmentsInfo(TestPrefix, TestDoctype, "doc")
+	assert.NoError(t, err)
+	if assert.Contains(t, infos, "notes.txt") {
+		info := infos["notes.txt"]
+		assert.Equal(t, "text/plain", info.ContentType)
+		assert.Equal(t, int64(1200), info.Length)
+		assert.Equal(t, "md5-abc", info.Digest)
+		assert.True(t, info.Stub)
+		assert.Equal(t, "gzip", info.Encoding)
+	}
+
+	infos, err = GetAttachmentsInfo(TestPrefix, TestDoctype, "bare")
+	assert.NoError(t, err)
+	assert.NotNil(t, infos)
+	assert.Empty(t, infos)
+}
@@ -7,7 +7,11 @@ import (
 	"net/http"
 	"net/url"
 	"strings"
+	"time"
 
+	"github.com/cozy/cozy-stack/pkg/config/config"
+	"github.com/cozy/cozy-stack/pkg/couchdb/mango"
+	"github.com/cozy/cozy-stack/pkg/logger"
 	"github.com/cozy/cozy-stack/pkg/realtime"
 	"github.com/google/go-querystring/query"
 )
@@ -157,6 +161,72 @@ func ForeachDocsWithCustomPagination(db Database, doctype string, limit int, fn
 	return nil
 }
 
+// StreamAllDocs traverses all the documents of the given doctype, with their
+// revision, and calls a function for each of them. The design docs are
+// included only if includeDesign is true. It can be used to seed a replica.
+//
+// If the stream is interrupted, for example by a restart of CouchDB, a
+// StreamInterruptedError is returned with the ID of the last document that
+// has been processed, and StreamAllDocsFrom can be used to resume.
+func StreamAllDocs(db Database, doctype string, includeDesign bool, fn func(id, rev string, doc json.RawMessage) error) error {
+	return StreamAllDocsFrom(db, doctype, "", includeDesign, fn)
+}
+
+// StreamAllDocsFrom is like StreamAllDocs, but it starts after the document
+// with the given ID.
+func StreamAllDocsFrom(db Database, doctype, startKey string, includeDesign bool, fn func(id, rev string, doc json.RawMessage) error) error {
+	limit := 100
+	for {
+		skip := 0
+		if startKey != "" {
+			skip = 1
+		}
+		req := &AllDocsRequest{
+			StartKeyDocID: startKey,
+			Skip:          skip,
+			Limit:         limit,
+		}
+		v, err := query.Values(req)
+		if err != nil {
+			return err
+		}
+		v.Add("include_docs", "true")
+
+		var res struct {
+			Rows []struct {
+				ID    string `json:"id"`
+				Value struct {
+					Rev string `json:"rev"`
+				} `json:"value"`
+				Doc json.RawMessage `json:"doc"`
+			} `json:"rows"`
+		}
+		url := "_all_docs?" + v.Encode()
+		err = makeRequest(db, doctype, http.MethodGet, url, nil, &res)
+		if isTruncatedResponseError(err) {
+			return newStreamInterruptedError(startKey, err)
+		}
+		if err != nil {
+			return err
+		}
+
+		for _, row := range res.Rows {
+			startKey = row.ID
+			if !includeDesign && strings.HasPrefix(row.ID, "_design") {
+				continue
+			}
+			if err = fn(row.ID, row.Value.Rev, row.Doc); err != nil {
+				return err
+			}
+		}
+		if len(res.Rows) < limit {
+			break
+		}
+	}
+
+	return nil
+}
+
 // BulkGetDocs returns the documents with the given id at the given revision
 func BulkGetDocs(db Database, doctype string, payload []IDRev) ([]map[string]interface{}, error) {
 	path := "_bulk_get?revs=true"
@@ -181,84 +251,325 @@ func BulkGetDocs(db Database, doctype string, payload []IDRev) ([]map[string]int
 	return results, nil
 }
 
+// BulkBatchSize is the maximal number of documents sent to CouchDB in a single
+// _bulk_docs request by the bulk helpers. The larger operations are split in
+// several requests.
+var BulkBatchSize = 1000
+
+// BulkBatchMaxBytes is the maximal size, in bytes, of the documents sent in a
+// single _bulk_docs request. A batch that would be larger is split, to stay
+// below the max_http_request_size of CouchDB. A document larger than this
+// limit is still sent alone.
+var BulkBatchMaxBytes = 32 << 20
+
+// batchEnd returns the index after the last document of the batch that starts
+// at the start index, with the given limits. A batch has always at least one
+// document, even if the sizes are not positive.
+func batchEnd(docs []json.RawMessage, start, size, maxBytes int) int {
+	if size <= 0 {
+		size = BulkBatchSize
+	}
+	if size <= 0 {
+		size = 1
+	}
+	bytes := 0
+	end := start
+	for end < len(docs) && end-start < size {
+		bytes += len(docs[end]) + 1
+		if end > start && bytes > maxBytes {
+			break
+		}
+		end++
+	}
+	return end
+}
+
+// bulkDocs sends the documents to CouchDB with _bulk_docs requests, and calls
+// fn with the index of the first document of each batch and the responses.
+func bulkDocs(db Database, doctype string, docs []json.RawMessage, size int, fn func(offset int, res []UpdateResponse) error) error {
+	if err := checkBulkSizes(db, doctype, docs); err != nil {
+		return err
+	}
+	for start := 0; start < len(docs); {
+		end := batchEnd(docs, start, size, BulkBatchMaxBytes)
+		body := struct {
+			Docs []json.RawMessage `json:"docs"`
+		}{
+			Docs: docs[start:end],
+		}
+		var res []UpdateResponse
+		if err := makeRequest(db, doctype, http.MethodPost, "_bulk_docs", body, &res); err != nil {
+			return err
+		}
+		if len(res) != end-start {
+			return errors.New("BulkUpdateDoc receive an unexpected number of responses")
+		}
+		if err := fn(start, res); err != nil {
+			return err
+		}
+		start = end
+	}
+	return nil
+}
+
+// checkBulkSizes checks the size of each document of a bulk write, before
+// any of them is sent to CouchDB, so that a too large document rejects the
+// whole call instead of leaving it half done.
+func checkBulkSizes(db Database, doctype string, docs []json.RawMessage) error {
+	couch := config.GetConfig().CouchDB
+	log := logger.WithDomain(db.DomainName()).WithField("nspace", "couchdb")
+	for _, doc := range docs {
+		size := len(doc)
+		if (couch.WarnDocumentSize <= 0 || size <= couch.WarnDocumentSize) &&
+			(couch.MaxDocumentSize <= 0 || size <= couch.MaxDocumentSize) {
+			continue
+		}
+		// The _id is only decoded for the documents that are reported
+		var meta struct {
+			ID string `json:"_id"`
+		}
+		_ = json.Unmarshal(doc, &meta)
+		if err := checkDocumentSize(log, doctype, meta.ID, size); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // BulkUpdateDocs is used to update several docs in one call, as a bulk.
 // olddocs parameter is used for realtime / event triggers.
 func BulkUpdateDocs(db Database, doctype string, docs, olddocs []interface{}) error {
+	return BulkUpdateDocsWithBatchSize(db, doctype, docs, olddocs, BulkBatchSize)
+}
+
+// BulkUpdateDocsWithBatchSize is like BulkUpdateDocs, but with a custom
+// number of documents for each _bulk_docs request.
+func BulkUpdateDocsWithBatchSize(db Database, doctype string, docs, olddocs []interface{}, batchSize int) error {
 	if len(docs) == 0 {
 		return nil
 	}
-	body := struct {
-		Docs []interface{} `json:"docs"`
-	}{
-		Docs: docs,
-	}
-	var res []UpdateResponse
-	if err := makeRequest(db, doctype, http.MethodPost, "_bulk_docs", body, &res); err != nil {
-		return err
-	}
-	if len(res) != len(docs) {
-		return errors.New("BulkUpdateDoc receive an unexpected number of responses")
-	}
+	encoded := make([]json.RawMessage, len(docs))
 	for i, doc := range docs {
-		if d, ok := doc.(Doc); ok {
-			event := realtime.EventUpdate
-			if d.Rev() == "" {
-				event = realtime.EventCreate
-				d.SetID(res[i].ID)
+		data, err := json.Marshal(doc)
+		if err != nil {
+			return err
+		}
+		encoded[i] = data
+	}
+	return bulkDocs(db, doctype, encoded, batchSize, func(offset int, res []UpdateResponse) error {
+		for j := range res {
+			i := offset + j
+			if d, ok := docs[i].(Doc); ok {
+				event := realtime.EventUpdate
+				if d.Rev() == "" {
+					event = realtime.EventCreate
+					d.SetID(res[j].ID)
+				}
+				d.SetRev(res[j].Rev)
+				if old, ok := olddocs[i].(Doc); ok {
+					event = realtime.EventUpdate
+					RTEvent(db, event, d, old)
+				} else {
+					RTEvent(db, event, d, nil)
+				}
+				teeWrite(db, event, d)
 			}
-			d.SetRev(res[i].Rev)
-			if old, ok := olddocs[i].(Doc); ok {
-				RTEvent(db, realtime.EventUpdate, d, old)
-			} else {
-				RTEvent(db, event, d, nil)
+		}
+		return nil
+	})
+}
+
+// BulkUpdateConditional updates several documents in one call, as a bulk,
+// where each document must have the revision it is expected to have in
+// CouchDB. The IDs of the documents that are stale (their revision is not the
+// current one) are returned, and the other documents are updated with their
+// new revision.
+func BulkUpdateConditional(db Database, doctype string, docs []Doc) ([]string, error) {
+	encoded := make([]json.RawMessage, len(docs))
+	for i, doc := range docs {
+		if doc.ID() == "" || doc.Rev() == "" {
+			return nil, fmt.Errorf("BulkUpdateConditional docs should have id and rev")
+		}
+		data, err := json.Marshal(doc)
+		if err != nil {
+			return nil, err
+		}
+		encoded[i] = data
+	}
+	var stale []string
+	var errm error
+	err := bulkDocs(db, doctype, encoded, BulkBatchSize, func(offset int, res []UpdateResponse) error {
+		for j := range res {
+			doc := docs[offset+j]
+			switch res[j].Error {
+			case "":
+				doc.SetRev(res[j].Rev)
+				RTEvent(db, realtime.EventUpdate, doc, nil)
+				teeWrite(db, realtime.EventUpdate, doc)
+			case "conflict":
+				stale = append(stale, doc.ID())
+			default:
+				if errm == nil {
+					errm = &Error{
+						StatusCode: http.StatusBadRequest,
+						Name:       res[j].Error,
+						Reason:     res[j].Reason,
+					}
+				}
 			}
 		}
+		return nil
+	})
+	if err != nil {
+		return stale, err
 	}
-	return nil
+	return stale, errm
 }
 
 // BulkDeleteDocs is used to delete serveral documents in one call.
 func BulkDeleteDocs(db Database, doctype string, docs []Doc) error {
-	if len(docs) == 0 {
-		return nil
-	}
-	body := struct {
-		Docs []json.RawMessage `json:"docs"`
-	}{
-		Docs: make([]json.RawMessage, 0, len(docs)),
-	}
+	_, err := bulkDeleteDocs(db, doctype, docs, BulkBatchSize)
+	return err
+}
+
+// BulkDeleteDocsWithBatchSize is like BulkDeleteDocs, but with a custom
+// number of documents for each _bulk_docs request.
+func BulkDeleteDocsWithBatchSize(db Database, doctype string, docs []Doc, batchSize int) error {
+	_, err := bulkDeleteDocs(db, doctype, docs, batchSize)
+	return err
+}
+
+// bulkDeleteDocs is BulkDeleteDocs, but it also returns the number of
+// documents that have been deleted (the others are in conflict).
+func bulkDeleteDocs(db Database, doctype string, docs []Doc, batchSize int) (int, error) {
+	encoded := make([]json.RawMessage, 0, len(docs))
 	for _, doc := range docs {
-		body.Docs = append(body.Docs, json.RawMessage(
-			fmt.Sprintf(`{"_id":"%s","_rev":"%s","_deleted":true}`, doc.ID(), doc.Rev()),
-		))
-	}
-	var res []UpdateResponse
-	if err := makeRequest(db, doctype, http.MethodPost, "_bulk_docs", body, &res); err != nil {
-		return err
+		data, err := json.Marshal(map[string]interface{}{
+			"_id":      doc.ID(),
+			"_rev":     doc.Rev(),
+			"_deleted": true,
+		})
+		if err != nil {
+			return 0, err
+		}
+		encoded = append(encoded, data)
 	}
-	for i, doc := range docs {
-		if d, ok := doc.(Doc); ok {
-			d.SetRev(res[i].Rev)
-			RTEvent(db, realtime.EventDelete, d, nil)
+	deleted := 0
+	err := bulkDocs(db, doctype, encoded, batchSize, func(offset int, res []UpdateResponse) error {
+		for j := range res {
+			if res[j].Error != "" {
+				continue
+			}
+			doc := docs[offset+j]
+			doc.SetRev(res[j].Rev)
+			RTEvent(db, realtime.EventDelete, doc, nil)
+			teeWrite(db, realtime.EventDelete, doc)
+			deleted++
+		}
+		return nil
+	})
+	return deleted, err
+}
+
+// DeleteBySelector deletes all the documents of the doctype that match the
+// selector, and returns the number of deleted documents. The documents are
+// deleted by batches of BulkBatchSize, and an index must exist for the selector. The documents
+// that are updated concurrently are not deleted.
+func DeleteBySelector(db Database, doctype string, selector mango.Filter) (int, error) {
+	deleted := 0
+	limit := BulkBatchSize
+	var pages bookmarkTracker
+	bookmark := ""
+	for {
+		req := &FindRequest{
+			Selector: selector,
+			Fields:   []string{"_id", "_rev"},
+			Bookmark: bookmark,
+			Limit:    &limit,
+		}
+		var results []IDRev
+		res, err := FindDocsRaw(db, doctype, req, &results)
+		if IsNoDatabaseError(err) {
+			return deleted, nil
 		}
+		if err != nil {
+			return deleted, err
+		}
+		if len(results) > 0 {
+			if err = pages.check(results[0].ID); err != nil {
+				return deleted, err
+			}
+		}
+
+		docs := make([]Doc, 0, len(results))
+		for _, r := range results {
+			docs = append(docs, &JSONDoc{
+				Type: doctype,
+				M:    map[string]interface{}{"_id": r.ID, "_rev": r.Rev},
+			})
+		}
+		n, err := bulkDeleteDocs(db, doctype, docs, BulkBatchSize)
+		deleted += n
+		if err != nil {
+			return deleted, err
+		}
+
+		if len(results) < BulkBatchSize || res.Bookmark == "" {
+			return deleted, nil
+		}
+		bookmark = res.Bookmark
 	}
-	return nil
+}
+
+// ExpiryTimeLayout is the layout of the timestamps used by ExpireDocs. It has
+// a fixed width, in UTC, so that the timestamps can be compared as strings.
+const ExpiryTimeLayout = "2006-01-02T15:04:05.000000000Z"
+
+// ExpireDocs deletes the documents of the doctype with a timestamp in the
+// expiryField that is before the given time, and returns the number of deleted
+// documents. The timestamps are compared as strings, so they must be written
+// with ExpiryTimeLayout: the RFC 3339 format of the time.Time values encoded
+// in JSON has a variable number of digits for the fractional seconds, and
+// can't be compared this way. The documents without a string in the
+// expiryField (null, number, etc.) are kept. An index on the expiryField is
+// required.
+func ExpireDocs(db Database, doctype, expiryField string, before time.Time) (int, error) {
+	selector := mango.And(
+		mango.Gt(expiryField, ""),
+		mango.Lt(expiryField, before.UTC().Format(ExpiryTimeLayout)),
+	)
+	return DeleteBySelector(db, doctype, selector)
 }
 
 // BulkForceUpdateDocs is used to update several docs in one call, and to force
 // the revisions history. It is used by replications.
 func BulkForceUpdateDocs(db Database, doctype string, docs []map[string]interface{}) error {
-	if len(docs) == 0 {
-		return nil
+	encoded := make([]json.RawMessage, len(docs))
+	for i, doc := range docs {
+		data, err := json.Marshal(doc)
+		if err != nil {
+			return err
+		}
+		encoded[i] = data
 	}
-	body := struct {
-		NewEdits bool                     `json:"new_edits"`
-		Docs     []map[string]interface{} `json:"docs"`
-	}{
-		NewEdits: false,
-		Docs:     docs,
+	if err := checkBulkSizes(db, doctype, encoded); err != nil {
+		return err
 	}
-	// XXX CouchDB returns just an empty array when new_edits is false, so we
-	// ignore the response
-	return makeRequest(db, doctype, http.MethodPost, "_bulk_docs", body, nil)
+	for start := 0; start < len(encoded); {
+		end := batchEnd(encoded, start, BulkBatchSize, BulkBatchMaxBytes)
+		body := struct {
+			NewEdits bool              `json:"new_edits"`
+			Docs     []json.RawMessage `json:"docs"`
+		}{
+			NewEdits: false,
+			Docs:     encoded[start:end],
+		}
+		// XXX CouchDB returns just an empty array when new_edits is false, so we
+		// ignore the response
+		if err := makeRequest(db, doctype, http.MethodPost, "_bulk_docs", body, nil); err != nil {
+			return err
+		}
+		start = end
+	}
+	return nil
 }
@@ -0,0 +1,122 @@
+package couchdb
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"sort"
+	"strconv"
+)
+
+// ExportCanonical returns the canonical JSON serialization of a document: the
+// keys of the objects are sorted, the numbers are normalized (1.0 is written
+// as 1), and there are no spaces. Two documents with the same content have the
+// same serialization, which can be used for hashing and diffing them, even
+// between two instances.
+func ExportCanonical(doc Doc) ([]byte, error) {
+	return exportCanonical(doc)
+}
+
+// DocContentHash returns the SHA-256 hash, in hexadecimal, of the canonical
+// serialization of the document, without its _rev. It can be used to know if
+// the content of a document has really changed between two revisions.
+func DocContentHash(doc Doc) (string, error) {
+	data, err := exportCanonical(doc, "_rev")
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// exportCanonical is ExportCanonical, without the given top-level fields.
+func exportCanonical(doc Doc, excluded ...string) ([]byte, error) {
+	data, err := json.Marshal(doc)
+	if err != nil {
+		return nil, err
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var value interface{}
+	if err := dec.Decode(&value); err != nil {
+		return nil, err
+	}
+	if m, ok := value.(map[string]interface{}); ok {
+		for _, field := range excluded {
+			delete(m, field)
+		}
+	}
+	var buf bytes.Buffer
+	if err := writeCanonical(&buf, value); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func writeCanonical(buf *bytes.Buffer, value interface{}) error {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		keys := make([]string, 0, len(v))
+		for k := range v {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		buf.WriteByte('{')
+		for i, k := range keys {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			writeCanonicalString(buf, k)
+			buf.WriteByte(':')
+			if err := writeCanonical(buf, v[k]); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte('}')
+	case []interface{}:
+		buf.WriteByte('[')
+		for i, item := range v {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			if err := writeCanonical(buf, item); err != nil {
+				return err
+			}
+		}
+		buf.WriteByte(']')
+	case json.Number:
+		buf.WriteString(canonicalNumber(v))
+	case string:
+		writeCanonicalString(buf, v)
+	default:
+		data, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		buf.Write(data)
+	}
+	return nil
+}
+
+// canonicalNumber normalizes a number: the integers are kept as is, to avoid
+// losing precision on the large ones, and the other numbers are written in
+// their shortest form.
+func canonicalNumber(n json.Number) string {
+	if i, err := strconv.ParseInt(string(n), 10, 64); err == nil {
+		return strconv.FormatInt(i, 10)
+	}
+	f, err := strconv.ParseFloat(string(n), 64)
+	if err != nil {
+		return string(n)
+	}
+	return strconv.FormatFloat(f, 'g', -1, 64)
+}
+
+func writeCanonicalString(buf *bytes.Buffer, s string) {
+	enc := json.NewEncoder(buf)
+	enc.SetEscapeHTML(false)
+	_ = enc.Encode(s)
+	// Encode adds a newline after the value
+	buf.Truncate(buf.Len() - 1)
+}
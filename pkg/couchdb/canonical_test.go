@@ -0,0 +1,49 @@
+package couchdb
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestExportCanonical(t *testing.T) {
+	doc1 := &JSONDoc{Type: TestDoctype, M: map[string]interface{}{}}
+	doc1.M["_id"] = "foo"
+	doc1.M["name"] = "<b>"
+	doc1.M["size"] = 1.0
+	doc1.M["metadata"] = map[string]interface{}{"z": 1.5, "a": []interface{}{3, "x"}}
+
+	doc2 := &JSONDoc{Type: TestDoctype, M: map[string]interface{}{}}
+	doc2.M["metadata"] = map[string]interface{}{"a": []interface{}{3.0, "x"}, "z": 1.5}
+	doc2.M["size"] = 1
+	doc2.M["name"] = "<b>"
+	doc2.M["_id"] = "foo"
+
+	data1, err := ExportCanonical(doc1)
+	assert.NoError(t, err)
+	data2, err := ExportCanonical(doc2)
+	assert.NoError(t, err)
+	assert.Equal(t, string(data1), string(data2))
+	assert.Equal(t, `{"_id":"foo","metadata":{"a":[3,"x"],"z":1.5},"name":"<b>","size":1}`, string(data1))
+
+	typed := &testDoc{TestID: "foo", Test: "bar", FieldB: 12345678901234567}
+	data, err := ExportCanonical(typed)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"_id":"foo","fieldB":12345678901234567,"test":"bar"}`, string(data))
+}
+
+func TestDocContentHash(t *testing.T) {
+	doc1 := &testDoc{TestID: "foo", TestRev: "1-abc", Test: "bar"}
+	doc2 := &testDoc{TestID: "foo", TestRev: "2-def", Test: "bar"}
+	hash1, err := DocContentHash(doc1)
+	assert.NoError(t, err)
+	hash2, err := DocContentHash(doc2)
+	assert.NoError(t, err)
+	assert.Equal(t, hash1, hash2)
+	assert.Len(t, hash1, 64)
+
+	doc2.Test = "baz"
+	hash2, err = DocContentHash(doc2)
+	assert.NoError(t, err)
+	assert.NotEqual(t, hash1, hash2)
+}
@@ -1,9 +1,13 @@
 package couchdb
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"net/http"
+	"net/url"
+	"strings"
 
 	"github.com/google/go-querystring/query"
 )
@@ -125,7 +129,9 @@ type Change struct {
 	} `json:"changes"`
 }
 
-// GetChanges returns a list of change in couchdb
+// GetChanges returns a list of change in couchdb. If the response is
+// interrupted, for example by a restart of CouchDB, a StreamInterruptedError
+// is returned with the since sequence of the request, to retry it.
 func GetChanges(db Database, req *ChangesRequest) (*ChangesResponse, error) {
 	if req.DocType == "" {
 		return nil, errors.New("Empty doctype in GetChanges")
@@ -139,9 +145,153 @@ func GetChanges(db Database, req *ChangesRequest) (*ChangesResponse, error) {
 	var response ChangesResponse
 	url := "_changes?" + v.Encode()
 	err = makeRequest(db, req.DocType, http.MethodGet, url, nil, &response)
-
+	if isTruncatedResponseError(err) {
+		return nil, newStreamInterruptedError(req.Since, err)
+	}
 	if err != nil {
 		return nil, err
 	}
 	return &response, nil
 }
+
+// ChangedDocsSince calls fn for each document of the doctype that has been
+// created or modified since the given sequence (an empty string for all the
+// changes), and returns the last sequence, to be used as since for the next
+// call. It is made for the incremental exports. The deleted documents and the
+// design docs are skipped.
+//
+// The changes are fetched by batches. If fn returns an error, or if the
+// stream is interrupted (StreamInterruptedError), the sequence of the last
+// document that has been processed is returned with the error, and it can be
+// used to resume.
+func ChangedDocsSince(db Database, doctype, since string, fn func(doc json.RawMessage) error) (string, error) {
+	return changedDocsSince(db, doctype, since, false, fn)
+}
+
+// ChangedDocsWithTombstonesSince is like ChangedDocsSince, but the deleted
+// documents are also given to fn, as tombstones with _id, _rev and _deleted.
+func ChangedDocsWithTombstonesSince(db Database, doctype, since string, fn func(doc json.RawMessage) error) (string, error) {
+	return changedDocsSince(db, doctype, since, true, fn)
+}
+
+func changedDocsSince(db Database, doctype, since string, tombstones bool, fn func(doc json.RawMessage) error) (string, error) {
+	limit := 100
+	for {
+		req := &ChangesRequest{
+			IncludeDocs: true,
+			Limit:       limit,
+			Since:       since,
+		}
+		v, err := query.Values(req)
+		if err != nil {
+			return since, err
+		}
+
+		var res struct {
+			LastSeq string `json:"last_seq"`
+			Results []struct {
+				ID      string          `json:"id"`
+				Seq     string          `json:"seq"`
+				Deleted bool            `json:"deleted"`
+				Doc     json.RawMessage `json:"doc"`
+			} `json:"results"`
+		}
+		url := "_changes?" + v.Encode()
+		err = makeRequest(db, doctype, http.MethodGet, url, nil, &res)
+		if isTruncatedResponseError(err) {
+			return since, newStreamInterruptedError(since, err)
+		}
+		if err != nil {
+			return since, err
+		}
+
+		for _, result := range res.Results {
+			skip := strings.HasPrefix(result.ID, "_design") ||
+				(result.Deleted && !tombstones)
+			if !skip {
+				if err = fn(result.Doc); err != nil {
+					return since, err
+				}
+			}
+			since = result.Seq
+		}
+		if res.LastSeq != "" {
+			since = res.LastSeq
+		}
+		if len(res.Results) < limit {
+			return since, nil
+		}
+	}
+}
+
+// ChangeRow is a change of a document, as streamed by StreamChangesForDocs.
+type ChangeRow struct {
+	Seq     string `json:"seq"`
+	ID      string `json:"id"`
+	Deleted bool   `json:"deleted,omitempty"`
+	Changes []struct {
+		Rev string `json:"rev"`
+	} `json:"changes"`
+	// Doc is the document, or a tombstone for a deleted document
+	Doc json.RawMessage `json:"doc,omitempty"`
+}
+
+// changesHeartbeat is the period in milliseconds of the empty lines sent by
+// CouchDB to keep the continuous changes feed alive.
+const changesHeartbeat = 30000
+
+// StreamChangesForDocs follows the changes of the documents with the given
+// IDs, since the given sequence ("now" for only the next changes), and calls
+// fn for each change, with the document. The _doc_ids filter is applied by
+// CouchDB, which is far cheaper than filtering the whole feed. The continuous
+// feed is used, and the function returns when the context is done (with its
+// error), or when fn returns an error.
+//
+// The HTTP client should not have a timeout, as the response never ends: see
+// WithClient. If the stream is interrupted, a StreamInterruptedError is
+// returned with the sequence of the last change, to resume from it.
+func StreamChangesForDocs(ctx context.Context, db Database, doctype string, docIDs []string, since string, fn func(ChangeRow) error) error {
+	if len(docIDs) == 0 {
+		return errors.New("StreamChangesForDocs should have at least one document ID")
+	}
+	body, err := json.Marshal(map[string][]string{"doc_ids": docIDs})
+	if err != nil {
+		return err
+	}
+	v := url.Values{}
+	v.Add("feed", "continuous")
+	v.Add("filter", "_doc_ids")
+	v.Add("include_docs", "true")
+	v.Add("heartbeat", fmt.Sprintf("%d", changesHeartbeat))
+	if since != "" {
+		v.Add("since", since)
+	}
+	header := http.Header{"Content-Type": {"application/json"}}
+	resp, err := makeFeedRequestCtx(ctx, db, doctype, http.MethodPost, "_changes?"+v.Encode(), header, body)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	decoder := getSerializer().NewDecoder(resp.Body)
+	for {
+		var row struct {
+			ChangeRow
+			LastSeq string `json:"last_seq"`
+		}
+		err = decoder.Decode(&row)
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return ctxErr
+		}
+		if err != nil {
+			return newStreamInterruptedError(since, err)
+		}
+		if row.LastSeq != "" {
+			return nil
+		}
+		if err = fn(row.ChangeRow); err != nil {
+			return err
+		}
+		since = row.Seq
+	}
+}
@@ -0,0 +1,67 @@
+package couchdb
+
+import (
+	"net/http"
+
+	"github.com/cozy/cozy-stack/pkg/config/config"
+)
+
+// optionsDatabase is a Database with some options for the requests to
+// CouchDB, set by WithClient and WithReadReplica.
+type optionsDatabase struct {
+	Database
+	client      *http.Client
+	readReplica bool
+}
+
+// withOptions returns a copy of the options of the database, and the
+// database without them.
+func withOptions(db Database) optionsDatabase {
+	if odb, ok := db.(*optionsDatabase); ok {
+		return *odb
+	}
+	return optionsDatabase{Database: db}
+}
+
+// WithClient returns a Database that uses the given HTTP client for the
+// requests to CouchDB, instead of the client from the configuration. It can
+// be used by the long jobs, like the exports, with a client without timeout.
+// The authentication is still added to the requests.
+func WithClient(db Database, client *http.Client) Database {
+	odb := withOptions(db)
+	odb.client = client
+	return odb.simplify()
+}
+
+// WithReadReplica returns a Database for which the GET requests are sent to
+// a read replica, if some are configured (couchdb.read_urls). The read
+// replicas can lag behind the primary, so it must be used only for the reads
+// that can tolerate stale results, and never to read a revision before a
+// write.
+func WithReadReplica(db Database) Database {
+	odb := withOptions(db)
+	odb.readReplica = true
+	return odb.simplify()
+}
+
+func (odb optionsDatabase) simplify() Database {
+	if odb.client == nil && !odb.readReplica {
+		return odb.Database
+	}
+	return &odb
+}
+
+// clientFor returns the HTTP client to use for the requests of the database.
+func clientFor(db Database) *http.Client {
+	if odb, ok := db.(*optionsDatabase); ok && odb.client != nil {
+		return odb.client
+	}
+	return config.GetConfig().CouchDB.Client
+}
+
+// usesReadReplica returns true if the GET requests of the database can be
+// sent to a read replica.
+func usesReadReplica(db Database) bool {
+	odb, ok := db.(*optionsDatabase)
+	return ok && odb.readReplica
+}
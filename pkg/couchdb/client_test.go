@@ -0,0 +1,46 @@
+package couchdb
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/cozy/cozy-stack/pkg/config/config"
+	"github.com/stretchr/testify/assert"
+)
+
+type countingTransport struct {
+	calls int
+}
+
+func (t *countingTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	t.calls++
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func TestWithClient(t *testing.T) {
+	var user string
+	defer withFakeCouch(t, func(w http.ResponseWriter, r *http.Request) {
+		user, _, _ = r.BasicAuth()
+		_, _ = w.Write([]byte(`{"db_name": "alice-cozy-tools%2Fio-cozy-tests"}`))
+	})()
+	config.GetConfig().CouchDB.Auth = url.UserPassword("admin", "secret")
+	config.GetConfig().CouchDB.SessionAuth = false
+	config.GetConfig().CouchDB.ProxyAuthUser = ""
+
+	transport := &countingTransport{}
+	client := &http.Client{Transport: transport}
+	db := WithClient(newDatabase("alice.cozy.tools"), client)
+	assert.Equal(t, "alice.cozy.tools", db.DBPrefix())
+
+	_, err := DBStatus(db, "io.cozy.tests")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, transport.calls)
+	assert.Equal(t, "admin", user)
+
+	same := WithClient(db, nil)
+	_, err = DBStatus(same, "io.cozy.tests")
+	assert.NoError(t, err)
+	assert.Equal(t, 1, transport.calls)
+	assert.Equal(t, newDatabase("alice.cozy.tools"), same)
+}
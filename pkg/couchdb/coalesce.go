@@ -0,0 +1,63 @@
+package couchdb
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sync"
+)
+
+// inflightGet is a GetDoc request shared by the concurrent callers.
+type inflightGet struct {
+	wg   sync.WaitGroup
+	data json.RawMessage
+	err  error
+}
+
+var inflightGetsMu sync.Mutex
+var inflightGets = make(map[string]*inflightGet)
+
+// GetDocCoalesced fetches a document like GetDoc, but the concurrent calls
+// for the same document share a single request to CouchDB. It is useful for
+// the hot documents, like the instance settings, that are read by many
+// goroutines at the same time.
+//
+// The response is shared, so a caller can receive a document that has been
+// fetched just before its own call started. Each caller gets its own copy of
+// the document in out.
+func GetDocCoalesced(db Database, doctype, id string, out Doc) error {
+	var err error
+	id, err = validateDocID(id)
+	if err != nil {
+		return err
+	}
+	if id == "" {
+		return fmt.Errorf("Missing ID for GetDocCoalesced")
+	}
+
+	key := makeDBName(db, doctype) + "/" + id
+	inflightGetsMu.Lock()
+	call, ok := inflightGets[key]
+	if !ok {
+		call = &inflightGet{}
+		call.wg.Add(1)
+		inflightGets[key] = call
+	}
+	inflightGetsMu.Unlock()
+
+	if ok {
+		call.wg.Wait()
+	} else {
+		call.err = makeRequest(db, doctype, http.MethodGet, url.PathEscape(id), nil, &call.data)
+		inflightGetsMu.Lock()
+		delete(inflightGets, key)
+		inflightGetsMu.Unlock()
+		call.wg.Done()
+	}
+
+	if call.err != nil {
+		return call.err
+	}
+	return json.Unmarshal(call.data, out)
+}
@@ -0,0 +1,88 @@
+package couchdb
+
+import (
+	"context"
+	"runtime"
+	"sync"
+	"sync/atomic"
+
+	"github.com/cozy/cozy-stack/pkg/config/config"
+)
+
+// maxConcurrency is the value given to SetMaxConcurrency, or 0 to use the
+// configuration.
+var maxConcurrency int32
+
+// SetMaxConcurrency overrides the maximal number of concurrent requests made
+// by each call of the bulk helpers, which is read from the configuration by
+// default. A value of 0 restores the default.
+func SetMaxConcurrency(n int) {
+	if n < 0 {
+		n = 0
+	}
+	atomic.StoreInt32(&maxConcurrency, int32(n))
+}
+
+func concurrencyLimit() int {
+	if n := atomic.LoadInt32(&maxConcurrency); n > 0 {
+		return int(n)
+	}
+	if n := config.GetConfig().CouchDB.MaxConcurrency; n > 0 {
+		return n
+	}
+	return runtime.NumCPU()
+}
+
+// runConcurrently calls fn for the indexes from 0 to n-1, in goroutines,
+// without exceeding the concurrency limit, and returns the first error. No new
+// call is started after an error or the cancellation of the context. The
+// limit is for this call only, so fn can call runConcurrently itself.
+func runConcurrently(ctx context.Context, n int, fn func(i int) error) error {
+	workers := concurrencyLimit()
+	if workers > n {
+		workers = n
+	}
+
+	var mu sync.Mutex
+	var errm error
+	next := 0
+	// take returns the next index to process, and false when there is none
+	// left or when the calls must stop.
+	take := func() (int, bool) {
+		mu.Lock()
+		defer mu.Unlock()
+		if errm != nil || next >= n || ctx.Err() != nil {
+			return 0, false
+		}
+		next++
+		return next - 1, true
+	}
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				i, ok := take()
+				if !ok {
+					return
+				}
+				if err := fn(i); err != nil {
+					mu.Lock()
+					if errm == nil {
+						errm = err
+					}
+					mu.Unlock()
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	if errm != nil {
+		return errm
+	}
+	return ctx.Err()
+}
@@ -0,0 +1,230 @@
+package couchdb
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// ConflictInfo is a document with conflicts, as returned by ListConflicts
+type ConflictInfo struct {
+	ID string `json:"id"`
+	// Rev is the winning revision
+	Rev string `json:"rev"`
+	// Conflicts are the revisions of the other leaves of the revision tree
+	Conflicts []string `json:"conflicts"`
+}
+
+// conflictsView returns the view used by ListConflicts for the doctype. Only
+// the documents with conflicts are emitted, so the index stays small.
+func conflictsView(doctype string) *View {
+	return &View{
+		Name:    "conflicts",
+		Doctype: doctype,
+		Map: `
+function(doc) {
+  if (doc._conflicts) {
+    emit(doc._id, {rev: doc._rev, conflicts: doc._conflicts});
+  }
+}`,
+	}
+}
+
+// ListConflicts returns the documents of the doctype that have conflicts,
+// with their conflicting revisions. A view is defined for that if it doesn't
+// exist yet. It can be used to detect the divergences after a sync.
+func ListConflicts(db Database, doctype string) ([]ConflictInfo, error) {
+	view := conflictsView(doctype)
+	if err := DefineViews(db, []*View{view}); err != nil {
+		return nil, err
+	}
+	var res struct {
+		Rows []struct {
+			ID    string          `json:"id"`
+			Value json.RawMessage `json:"value"`
+		} `json:"rows"`
+	}
+	if err := ExecView(db, view, &ViewRequest{}, &res); err != nil {
+		return nil, err
+	}
+	conflicts := make([]ConflictInfo, 0, len(res.Rows))
+	for _, row := range res.Rows {
+		info := ConflictInfo{ID: row.ID}
+		if err := json.Unmarshal(row.Value, &info); err != nil {
+			return nil, err
+		}
+		conflicts = append(conflicts, info)
+	}
+	return conflicts, nil
+}
+
+// RevInfo is a revision in the history of a document, with its status:
+// "available", "missing" (removed by a compaction), or "deleted".
+type RevInfo struct {
+	Rev    string `json:"rev"`
+	Status string `json:"status"`
+}
+
+// DocInspection is everything CouchDB knows about a document, for debugging
+// its conflicts. Doc is the winning revision, without the _conflicts,
+// _deleted_conflicts and _revs_info fields, which are parsed in the other
+// fields.
+type DocInspection struct {
+	Doc *JSONDoc `json:"doc"`
+	// Conflicts are the revisions of the other leaves of the revision tree
+	Conflicts []string `json:"conflicts"`
+	// DeletedConflicts are the leaves that have been deleted, often by a
+	// previous resolution of the conflicts
+	DeletedConflicts []string `json:"deleted_conflicts"`
+	// RevsInfo is the history of the winning revision, from the newest
+	RevsInfo []RevInfo `json:"revs_info"`
+}
+
+// InspectDoc fetches a document with its conflicts, its deleted conflicts and
+// the availability of the revisions of its history, in a single request.
+func InspectDoc(db Database, doctype, id string) (*DocInspection, error) {
+	var err error
+	id, err = validateDocID(id)
+	if err != nil {
+		return nil, err
+	}
+	if id == "" {
+		return nil, fmt.Errorf("Missing ID for InspectDoc")
+	}
+
+	var raw map[string]json.RawMessage
+	u := url.PathEscape(id) + "?meta=true"
+	if err = makeRequest(db, doctype, http.MethodGet, u, nil, &raw); err != nil {
+		return nil, err
+	}
+	inspection := &DocInspection{
+		Conflicts:        []string{},
+		DeletedConflicts: []string{},
+		RevsInfo:         []RevInfo{},
+	}
+	fields := map[string]interface{}{
+		"_conflicts":         &inspection.Conflicts,
+		"_deleted_conflicts": &inspection.DeletedConflicts,
+		"_revs_info":         &inspection.RevsInfo,
+	}
+	for field, out := range fields {
+		if value, ok := raw[field]; ok {
+			if err = json.Unmarshal(value, out); err != nil {
+				return nil, err
+			}
+			delete(raw, field)
+		}
+	}
+	data, err := json.Marshal(raw)
+	if err != nil {
+		return nil, err
+	}
+	inspection.Doc = &JSONDoc{Type: doctype}
+	if err = json.Unmarshal(data, inspection.Doc); err != nil {
+		return nil, err
+	}
+	return inspection, nil
+}
+
+// DocsNearRevsLimit returns the IDs of the documents of the doctype that
+// have at least threshold revisions in their history, as the documents
+// updated very often reach the _revs_limit of the database (1000 by default),
+// and become slow to update and replicate. The design docs are skipped.
+//
+// The generation of the current revision (the N in N-abcdef) is an upper
+// bound of the length of the history: the history is pruned to _revs_limit,
+// and it can be shorter for a document that has been replicated. So the
+// revisions are listed with _all_docs, without the documents, and only the
+// history of the documents with a generation above the threshold is fetched
+// to count its revisions.
+func DocsNearRevsLimit(db Database, doctype string, threshold int) ([]string, error) {
+	if threshold < 1 {
+		return nil, fmt.Errorf("DocsNearRevsLimit should have a positive threshold")
+	}
+	candidates, err := idsWithGeneration(db, doctype, threshold)
+	if err != nil {
+		return nil, err
+	}
+	lengths := make([]int, len(candidates))
+	err = runConcurrently(context.Background(), len(candidates), func(i int) error {
+		var doc struct {
+			Revisions struct {
+				IDs []string `json:"ids"`
+			} `json:"_revisions"`
+		}
+		u := url.PathEscape(candidates[i]) + "?revs=true"
+		err := makeRequest(db, doctype, http.MethodGet, u, nil, &doc)
+		if IsNotFoundError(err) && !IsNoDatabaseError(err) {
+			// The document has been deleted in the meantime
+			return nil
+		}
+		lengths[i] = len(doc.Revisions.IDs)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	ids := []string{}
+	for i, id := range candidates {
+		if lengths[i] >= threshold {
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
+// idsWithGeneration returns the IDs of the documents of the doctype, except
+// the design docs, with a current revision of at least the given generation.
+func idsWithGeneration(db Database, doctype string, generation int) ([]string, error) {
+	var ids []string
+	limit := 1000
+	startKey := ""
+	for {
+		req := &AllDocsRequest{StartKeyDocID: startKey, Limit: limit}
+		if startKey != "" {
+			req.Skip = 1
+		}
+		v, err := req.Values()
+		if err != nil {
+			return nil, err
+		}
+		var res struct {
+			Rows []struct {
+				ID    string `json:"id"`
+				Value struct {
+					Rev string `json:"rev"`
+				} `json:"value"`
+			} `json:"rows"`
+		}
+		if err = makeRequest(db, doctype, http.MethodGet, "_all_docs?"+v.Encode(), nil, &res); err != nil {
+			return nil, err
+		}
+		for _, row := range res.Rows {
+			startKey = row.ID
+			if !strings.HasPrefix(row.ID, "_design") && revGeneration(row.Value.Rev) >= generation {
+				ids = append(ids, row.ID)
+			}
+		}
+		if len(res.Rows) < limit {
+			return ids, nil
+		}
+	}
+}
+
+// revGeneration returns the generation of a revision, ie the number before
+// the dash, or 0 if the revision is invalid.
+func revGeneration(rev string) int {
+	parts := strings.SplitN(rev, "-", 2)
+	if len(parts) != 2 {
+		return 0
+	}
+	gen, err := strconv.Atoi(parts[0])
+	if err != nil {
+		return 0
+	}
+	return gen
+}
@@ -0,0 +1,134 @@
+package couchdb
+
+import (
+	"net/http"
+	"strings"
+)
+
+// QueryCostEstimate is a rough estimation of the cost of a _find request,
+// made before running it.
+type QueryCostEstimate struct {
+	// Index is the design doc of the index chosen by CouchDB, or _all_docs
+	Index string `json:"index"`
+	// FullScan is true when no index can be used for the request
+	FullScan bool `json:"full_scan"`
+	// Covered is true when all the fields of the selector are in the index,
+	// and CouchDB doesn't have to filter the documents read from it
+	Covered bool `json:"covered"`
+	// DocCount is the number of documents in the database
+	DocCount int `json:"doc_count"`
+	// EstimatedDocs is the estimated number of documents that CouchDB will
+	// examine for the request. It is an upper bound.
+	EstimatedDocs int `json:"estimated_docs"`
+}
+
+type explainResponse struct {
+	Index struct {
+		DesignDoc *string `json:"ddoc"`
+		Name      string  `json:"name"`
+		Type      string  `json:"type"`
+		Def       struct {
+			Fields []map[string]string `json:"fields"`
+		} `json:"def"`
+	} `json:"index"`
+	Selector map[string]interface{} `json:"selector"`
+	Limit    int                    `json:"limit"`
+	Skip     int                    `json:"skip"`
+}
+
+// EstimateFindCost asks CouchDB which index it would use for the _find
+// request (_explain), and combines it with the number of documents of the
+// database to estimate how many documents would be examined. It can be used
+// to reject the expensive requests from untrusted callers. The request is not
+// executed.
+//
+// The estimation is coarse: CouchDB doesn't say how many rows are in the range
+// of an index, so only a request covered by its index and with a limit is
+// estimated below the number of documents of the database.
+func EstimateFindCost(db Database, doctype string, req *FindRequest) (*QueryCostEstimate, error) {
+	if req.UseIndex == "" {
+		if useIndex := registeredQueryIndex(doctype, req.Selector); useIndex != "" {
+			copied := *req
+			copied.UseIndex = useIndex
+			req = &copied
+		}
+	}
+	var explain explainResponse
+	if err := makeRequest(db, doctype, http.MethodPost, "_explain", req, &explain); err != nil {
+		return nil, err
+	}
+	status, err := DBStatus(db, doctype)
+	if err != nil {
+		return nil, err
+	}
+	return estimateFromExplain(&explain, status.DocCount), nil
+}
+
+func estimateFromExplain(explain *explainResponse, docCount int) *QueryCostEstimate {
+	estimate := &QueryCostEstimate{
+		Index:         explain.Index.Name,
+		FullScan:      explain.Index.Type == "special",
+		DocCount:      docCount,
+		EstimatedDocs: docCount,
+	}
+	if explain.Index.DesignDoc != nil {
+		estimate.Index = *explain.Index.DesignDoc
+	}
+	if estimate.FullScan {
+		return estimate
+	}
+
+	indexed := make(map[string]bool)
+	for _, field := range explain.Index.Def.Fields {
+		for name := range field {
+			indexed[name] = true
+		}
+	}
+	fields, ok := explainSelectorFields(explain.Selector)
+	if !ok {
+		return estimate
+	}
+	for _, field := range fields {
+		if !indexed[field] {
+			return estimate
+		}
+	}
+	estimate.Covered = true
+	if explain.Limit > 0 && explain.Skip+explain.Limit < docCount {
+		estimate.EstimatedDocs = explain.Skip + explain.Limit
+	}
+	return estimate
+}
+
+// explainSelectorFields returns the fields used by a selector, as normalized
+// by CouchDB in the _explain response. The boolean is false if the selector
+// uses a combination operator other than $and, as it can't be covered by an
+// index.
+func explainSelectorFields(selector map[string]interface{}) ([]string, bool) {
+	var fields []string
+	for key, value := range selector {
+		if key == "$and" {
+			subs, ok := value.([]interface{})
+			if !ok {
+				return nil, false
+			}
+			for _, sub := range subs {
+				m, ok := sub.(map[string]interface{})
+				if !ok {
+					return nil, false
+				}
+				subFields, ok := explainSelectorFields(m)
+				if !ok {
+					return nil, false
+				}
+				fields = append(fields, subFields...)
+			}
+			continue
+		}
+		if strings.HasPrefix(key, "$") {
+			return nil, false
+		}
+		fields = append(fields, key)
+	}
+	return fields, true
+}
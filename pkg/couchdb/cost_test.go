@@ -0,0 +1,56 @@
+package couchdb
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestEstimateFromExplain(t *testing.T) {
+	parse := func(body string) *explainResponse {
+		var explain explainResponse
+		assert.NoError(t, json.Unmarshal([]byte(body), &explain))
+		return &explain
+	}
+
+	fullScan := parse(`{
+		"index": {"ddoc": null, "name": "_all_docs", "type": "special", "def": {"fields": [{"_id": "asc"}]}},
+		"selector": {"worker": {"$eq": "sendmail"}},
+		"limit": 25, "skip": 0
+	}`)
+	estimate := estimateFromExplain(fullScan, 1000)
+	assert.Equal(t, "_all_docs", estimate.Index)
+	assert.True(t, estimate.FullScan)
+	assert.Equal(t, 1000, estimate.EstimatedDocs)
+
+	covered := parse(`{
+		"index": {"ddoc": "_design/by-worker", "name": "by-worker", "type": "json",
+			"def": {"fields": [{"worker": "asc"}, {"queued_at": "asc"}]}},
+		"selector": {"$and": [{"worker": {"$eq": "sendmail"}}, {"queued_at": {"$gt": 1}}]},
+		"limit": 25, "skip": 10
+	}`)
+	estimate = estimateFromExplain(covered, 1000)
+	assert.Equal(t, "_design/by-worker", estimate.Index)
+	assert.False(t, estimate.FullScan)
+	assert.True(t, estimate.Covered)
+	assert.Equal(t, 35, estimate.EstimatedDocs)
+
+	filtered := parse(`{
+		"index": {"ddoc": "_design/by-worker", "name": "by-worker", "type": "json",
+			"def": {"fields": [{"worker": "asc"}]}},
+		"selector": {"worker": {"$eq": "sendmail"}, "state": {"$eq": "done"}},
+		"limit": 25, "skip": 0
+	}`)
+	estimate = estimateFromExplain(filtered, 1000)
+	assert.False(t, estimate.Covered)
+	assert.Equal(t, 1000, estimate.EstimatedDocs)
+
+	or := parse(`{
+		"index": {"ddoc": "_design/by-worker", "name": "by-worker", "type": "json",
+			"def": {"fields": [{"worker": "asc"}]}},
+		"selector": {"$or": [{"worker": {"$eq": "sendmail"}}, {"worker": {"$eq": "push"}}]},
+		"limit": 25, "skip": 0
+	}`)
+	assert.False(t, estimateFromExplain(or, 1000).Covered)
+}
@@ -2,13 +2,18 @@ package couchdb
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"net/url"
 	"reflect"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	build "github.com/cozy/cozy-stack/pkg/config"
@@ -17,6 +22,7 @@ import (
 	"github.com/cozy/cozy-stack/pkg/logger"
 	"github.com/cozy/cozy-stack/pkg/prefixer"
 	"github.com/cozy/cozy-stack/pkg/realtime"
+	"github.com/google/go-querystring/query"
 	"github.com/sirupsen/logrus"
 )
 
@@ -56,12 +62,20 @@ func newDatabase(prefix string) prefixer.Prefixer {
 
 // RTEvent published a realtime event for a couchDB change
 func RTEvent(db Database, verb string, doc, oldDoc Doc) {
+	RTEventWithContext(context.Background(), db, verb, doc, oldDoc)
+}
+
+// RTEventWithContext is like RTEvent, but the event is tagged with the origin
+// of the change found in the context (see realtime.WithOrigin).
+func RTEventWithContext(ctx context.Context, db Database, verb string, doc, oldDoc Doc) {
 	if err := runHooks(db, verb, doc, oldDoc); err != nil {
 		logger.WithDomain(db.DomainName()).WithField("nspace", "couchdb").
 			Errorf("error in hooks on %s %s %v\n", verb, doc.DocType(), err)
 	}
 	docClone := doc.Clone()
-	go realtime.GetHub().Publish(db, verb, docClone, oldDoc)
+	observeEvent(db, verb, docClone, oldDoc)
+	origin := realtime.OriginFromContext(ctx)
+	go realtime.GetHub().PublishWithOrigin(db, verb, docClone, oldDoc, origin)
 }
 
 // GlobalDB is the prefix used for stack-scoped db
@@ -77,6 +91,43 @@ type View struct {
 	Doctype string `json:"-"`
 	Map     string `json:"map"`
 	Reduce  string `json:"reduce,omitempty"`
+
+	// Options are the options of the view, like {"collation": "raw"} for
+	// sorting the keys by their raw bytes.
+	Options map[string]interface{} `json:"options,omitempty"`
+
+	// DesignDoc is the name of the design doc that holds the view. When it is
+	// empty, the view has its own design doc, with the same name as the view.
+	// Views sharing a design doc are defined together by DefineViews.
+	DesignDoc string `json:"-"`
+}
+
+// UnmarshalJSON implements json.Unmarshaler on View. The design docs created
+// by CouchDB for the mango indexes (with the "query" language) have an object
+// for the map function, and it is ignored.
+func (v *View) UnmarshalJSON(data []byte) error {
+	var raw struct {
+		Map     json.RawMessage        `json:"map"`
+		Reduce  string                 `json:"reduce"`
+		Options map[string]interface{} `json:"options"`
+	}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	v.Reduce = raw.Reduce
+	v.Options = raw.Options
+	v.Map = ""
+	if len(raw.Map) > 0 && raw.Map[0] == '"' {
+		return json.Unmarshal(raw.Map, &v.Map)
+	}
+	return nil
+}
+
+func (v *View) designDocName() string {
+	if v.DesignDoc != "" {
+		return v.DesignDoc
+	}
+	return v.Name
 }
 
 // JSONDoc is a map representing a simple json object that implements
@@ -87,7 +138,8 @@ type JSONDoc struct {
 }
 
 // ID returns the identifier field of the document
-//   "io.cozy.event/123abc123" == doc.ID()
+//
+//	"io.cozy.event/123abc123" == doc.ID()
 func (j *JSONDoc) ID() string {
 	id, ok := j.M["_id"].(string)
 	if ok {
@@ -97,7 +149,8 @@ func (j *JSONDoc) ID() string {
 }
 
 // Rev returns the revision field of the document
-//   "3-1234def1234" == doc.Rev()
+//
+//	"3-1234def1234" == doc.Rev()
 func (j *JSONDoc) Rev() string {
 	rev, ok := j.M["_rev"].(string)
 	if ok {
@@ -107,7 +160,8 @@ func (j *JSONDoc) Rev() string {
 }
 
 // DocType returns the document type of the document
-//   "io.cozy.event" == doc.Doctype()
+//
+//	"io.cozy.event" == doc.Doctype()
 func (j *JSONDoc) DocType() string {
 	return j.Type
 }
@@ -202,8 +256,10 @@ func (j *JSONDoc) Get(key string) interface{} {
 // rule has the format "doctype/id" and it cannot directly be compared to the
 // same field of a JSONDoc since, in the latter, the format is:
 // "referenced_by": [
-//     {"type": "doctype1", "id": "id1"},
-//     {"type": "doctype2", "id": "id2"},
+//
+//	{"type": "doctype1", "id": "id1"},
+//	{"type": "doctype2", "id": "id2"},
+//
 // ]
 func (j *JSONDoc) Fetch(field string) []string {
 	if field == SelectorReferencedBy {
@@ -225,10 +281,57 @@ func (j *JSONDoc) Fetch(field string) []string {
 	return []string{fmt.Sprintf("%v", j.Get(field))}
 }
 
+// unescapeCouchdbName is the reverse of EscapeCouchdbName, but it is lossy:
+// the doctypes with a ':' or some uppercase letters can't be recovered from
+// the database name. DoctypeFromDBName should be preferred.
 func unescapeCouchdbName(name string) string {
 	return strings.Replace(name, "-", ".", -1)
 }
 
+var knownDoctypesMu sync.RWMutex
+var knownDoctypes map[string]string
+
+// RegisterDoctypes adds some doctypes to the registry used to find the
+// doctype of a database. The doctypes of the views and indexes of the stack,
+// and the doctypes for which a database has been created by this process are
+// registered automatically.
+func RegisterDoctypes(doctypes ...string) {
+	knownDoctypesMu.Lock()
+	defer knownDoctypesMu.Unlock()
+	if knownDoctypes == nil {
+		knownDoctypes = make(map[string]string)
+		for _, v := range Views {
+			knownDoctypes[EscapeCouchdbName(v.Doctype)] = v.Doctype
+		}
+		for _, idx := range Indexes {
+			knownDoctypes[EscapeCouchdbName(idx.Doctype)] = idx.Doctype
+		}
+	}
+	for _, doctype := range doctypes {
+		knownDoctypes[EscapeCouchdbName(doctype)] = doctype
+	}
+}
+
+// DoctypeFromDBName returns the doctype for the name of a database of the
+// given instance, and false if the database is not for this instance. The
+// escaping of the database names is lossy, so the registry of the known
+// doctypes is used to recover the original doctype, and the unknown ones are
+// unescaped on a best-effort basis.
+func DoctypeFromDBName(db Database, dbname string) (string, bool) {
+	hasPrefix, name := dbNameHasPrefix(dbname, db.DBPrefix())
+	if !hasPrefix || name == "" || strings.Contains(name, "/") {
+		return "", false
+	}
+	RegisterDoctypes()
+	knownDoctypesMu.RLock()
+	doctype, ok := knownDoctypes[name]
+	knownDoctypesMu.RUnlock()
+	if ok {
+		return doctype, true
+	}
+	return unescapeCouchdbName(name), true
+}
+
 // EscapeCouchdbName can be used to build the name of a database from the
 // instance prefix and doctype.
 func EscapeCouchdbName(name string) string {
@@ -237,6 +340,78 @@ func EscapeCouchdbName(name string) string {
 	return strings.ToLower(name)
 }
 
+// EncodeCouchdbName is a reversible alternative to EscapeCouchdbName: two
+// distinct names can't have the same encoding. The lowercase letters, the
+// digits and the '/' are kept, the '.' is replaced by '-', and the other
+// characters are replaced by their hexadecimal code point between
+// parenthesis (for example, ':' is encoded as "(3a)").
+//
+// The database names are still built with EscapeCouchdbName. Switching to
+// this encoding will require to migrate the existing databases, and
+// DetectDBNameCollisions can be used to find the doctypes that are impacted
+// by the current escaping.
+func EncodeCouchdbName(name string) string {
+	var sb strings.Builder
+	for _, r := range name {
+		switch {
+		case r >= 'a' && r <= 'z', r >= '0' && r <= '9', r == '/':
+			sb.WriteRune(r)
+		case r == '.':
+			sb.WriteByte('-')
+		default:
+			fmt.Fprintf(&sb, "(%x)", r)
+		}
+	}
+	return sb.String()
+}
+
+// DecodeCouchdbName is the reverse of EncodeCouchdbName.
+func DecodeCouchdbName(name string) (string, error) {
+	var sb strings.Builder
+	for i := 0; i < len(name); i++ {
+		switch c := name[i]; c {
+		case '-':
+			sb.WriteByte('.')
+		case '(':
+			end := strings.IndexByte(name[i:], ')')
+			if end < 0 {
+				return "", fmt.Errorf("Invalid encoded name %q", name)
+			}
+			code, err := strconv.ParseInt(name[i+1:i+end], 16, 32)
+			if err != nil {
+				return "", fmt.Errorf("Invalid encoded name %q", name)
+			}
+			sb.WriteRune(rune(code))
+			i += end
+		default:
+			sb.WriteByte(c)
+		}
+	}
+	return sb.String(), nil
+}
+
+// DetectDBNameCollisions returns the groups of doctypes that have the same
+// database name with EscapeCouchdbName (like io.cozy.foo:bar and
+// io.cozy.foo.bar).
+func DetectDBNameCollisions(doctypes []string) [][]string {
+	byName := make(map[string][]string)
+	var names []string
+	for _, doctype := range doctypes {
+		name := EscapeCouchdbName(doctype)
+		if _, ok := byName[name]; !ok {
+			names = append(names, name)
+		}
+		byName[name] = append(byName[name], doctype)
+	}
+	var collisions [][]string
+	for _, name := range names {
+		if group := byName[name]; len(group) > 1 {
+			collisions = append(collisions, group)
+		}
+	}
+	return collisions
+}
+
 func makeDBName(db Database, doctype string) string {
 	dbname := EscapeCouchdbName(db.DBPrefix() + "/" + doctype)
 	return url.PathEscape(dbname)
@@ -250,12 +425,61 @@ func dbNameHasPrefix(dbname, dbprefix string) (bool, string) {
 	return true, strings.Replace(dbname, dbprefix, "", 1)
 }
 
+// maxTooManyRequestsRetries is the maximal number of times a GET request is
+// retried after a 429 Too Many Requests response.
+const maxTooManyRequestsRetries = 3
+
+// maxRetryAfter is the maximal delay that the stack accepts to wait before
+// retrying a request: if the Retry-After header asks for a longer delay, the
+// error is returned to the caller.
+const maxRetryAfter = 10 * time.Second
+
+// parseRetryAfter parses the Retry-After header of a 429 response, which can
+// be a number of seconds or an HTTP date. It returns false if the request
+// should not be retried.
+func parseRetryAfter(header string) (time.Duration, bool) {
+	var wait time.Duration
+	if header == "" {
+		wait = 1 * time.Second
+	} else if secs, err := strconv.Atoi(header); err == nil {
+		wait = time.Duration(secs) * time.Second
+	} else if date, err := http.ParseTime(header); err == nil {
+		wait = time.Until(date)
+	} else {
+		return 0, false
+	}
+	if wait < 0 {
+		wait = 0
+	}
+	if wait > maxRetryAfter {
+		return 0, false
+	}
+	return wait, true
+}
+
 func makeRequest(db Database, doctype, method, path string, reqbody interface{}, resbody interface{}) error {
+	return makeRequestCtx(context.Background(), db, doctype, method, path, reqbody, resbody)
+}
+
+// makeRequestCtx is like makeRequest, but the request is canceled when the
+// context is done.
+func makeRequestCtx(ctx context.Context, db Database, doctype, method, path string, reqbody interface{}, resbody interface{}) error {
+	return makeRequestToURLCtx(ctx, db, "", doctype, method, path, reqbody, resbody)
+}
+
+// makeRequestToURL is like makeRequest, but the request is sent to the given
+// CouchDB URL instead of the one from the configuration.
+func makeRequestToURL(db Database, couchURL, doctype, method, path string, reqbody interface{}, resbody interface{}) error {
+	return makeRequestToURLCtx(context.Background(), db, couchURL, doctype, method, path, reqbody, resbody)
+}
+
+func makeRequestToURLCtx(ctx context.Context, db Database, couchURL, doctype, method, path string, reqbody interface{}, resbody interface{}) error {
 	var reqjson []byte
 	var err error
+	codec := getSerializer()
 
 	if reqbody != nil {
-		reqjson, err = json.Marshal(reqbody)
+		reqjson, err = codec.Marshal(reqbody)
 		if err != nil {
 			return err
 		}
@@ -275,41 +499,28 @@ func makeRequest(db Database, doctype, method, path string, reqbody interface{},
 		log.Debugf("request: %s %s %s", method, path, string(bytes.TrimSpace(reqjson)))
 	}
 
-	req, err := http.NewRequest(
-		method,
-		config.CouchURL().String()+path,
-		bytes.NewReader(reqjson),
-	)
-	// Possible err = wrong method, unparsable url
-	if err != nil {
-		return newRequestError(err)
-	}
-	req.Header.Add("Accept", "application/json")
-	if reqbody != nil {
-		req.Header.Add("Content-Type", "application/json")
-	}
-
-	auth := config.GetConfig().CouchDB.Auth
-	if auth != nil {
-		if p, ok := auth.Password(); ok {
-			req.SetBasicAuth(auth.Username(), p)
+	if doc, ok := reqbody.(Doc); ok {
+		if err = checkDocumentSize(log, doc.DocType(), doc.ID(), len(reqjson)); err != nil {
+			return err
 		}
 	}
-	start := time.Now()
-	resp, err := config.GetConfig().CouchDB.Client.Do(req)
-	elapsed := time.Since(start)
-	// Possible err = mostly connection failure
+
+	header := http.Header{"Accept": {"application/json"}}
+	if reqbody != nil {
+		header.Set("Content-Type", "application/json")
+	}
+	resp, err := sendRequest(ctx, db, &couchRequest{
+		URL:    couchURL,
+		Method: method,
+		Path:   path,
+		Header: header,
+		Body:   reqjson,
+	})
 	if err != nil {
-		err = newConnectionError(err)
-		log.Error(err.Error())
 		return err
 	}
 	defer resp.Body.Close()
 
-	if elapsed.Seconds() >= 10 {
-		log.Printf("slow request on %s %s (%s)", method, path, elapsed)
-	}
-
 	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
 		var body []byte
 		body, err = ioutil.ReadAll(resp.Body)
@@ -325,22 +536,231 @@ func makeRequest(db Database, doctype, method, path string, reqbody interface{},
 	if resbody == nil {
 		return nil
 	}
+	newRev := resp.Header.Get("X-Couch-Update-NewRev")
 
 	if logDebug {
 		var data []byte
 		data, err = ioutil.ReadAll(resp.Body)
 		if err != nil {
-			return err
+			return newTruncatedResponseError(err)
 		}
-		log.Debugf("response: %s", string(bytes.TrimSpace(data)))
-		err = json.Unmarshal(data, &resbody)
-	} else {
-		err = json.NewDecoder(resp.Body).Decode(&resbody)
+		data = bytes.TrimSpace(data)
+		log.Debugf("response: %s", string(data))
+		if len(data) > 0 || newRev == "" {
+			if err = codec.Unmarshal(data, &resbody); err != nil {
+				return err
+			}
+		}
+		setRevFromHeader(resbody, newRev)
+		return nil
 	}
 
+	body := &countingReader{r: resp.Body}
+	err = codec.NewDecoder(body).Decode(&resbody)
+	if err == io.EOF && newRev != "" {
+		err = nil
+	}
+	if isTruncatedBodyError(err, body.n) {
+		return newTruncatedResponseError(err)
+	}
+	if err == nil {
+		setRevFromHeader(resbody, newRev)
+	}
 	return err
 }
 
+// couchRequest is a request to CouchDB, for sendRequest.
+type couchRequest struct {
+	// URL is the URL of CouchDB. If empty, it is chosen by couchURLFor: the
+	// primary or a read replica.
+	URL    string
+	Method string
+	// Path is the path of the request, from the URL of CouchDB.
+	Path   string
+	Header http.Header
+	Body   []byte
+	// Feed is true for the long-lived feeds, that are not counted as in
+	// progress for Drain.
+	Feed bool
+}
+
+// sendRequest sends a request to CouchDB, and returns the response, whatever
+// its status code. It is used for all the requests to CouchDB: it adds the
+// authentication, and opens a new session if it has expired, it retries the
+// GET requests when CouchDB asks to slow down with a 429 status code, and it
+// rejects the requests when the stack is draining.
+//
+// The body of the response must be closed by the caller, and the request is
+// counted as in progress for Drain until then.
+func sendRequest(ctx context.Context, db Database, r *couchRequest) (*http.Response, error) {
+	done := func() {}
+	if !r.Feed {
+		done = trackInFlight(db.DBPrefix())
+	}
+	if isDraining() {
+		done()
+		return nil, newDrainingError()
+	}
+	resp, err := doSendRequest(ctx, db, r)
+	if err != nil {
+		done()
+		return nil, err
+	}
+	resp.Body = &inFlightBody{ReadCloser: resp.Body, done: done}
+	return resp, nil
+}
+
+func doSendRequest(ctx context.Context, db Database, r *couchRequest) (*http.Response, error) {
+	couchURL := r.URL
+	if couchURL == "" {
+		couchURL = couchURLFor(db, r.Method, r.Path)
+	}
+	log := logger.WithDomain(db.DomainName()).WithField("nspace", "couchdb")
+
+	reauthenticated := false
+	for attempt := 0; ; attempt++ {
+		req, err := http.NewRequest(r.Method, couchURL+r.Path, bytes.NewReader(r.Body))
+		// Possible err = wrong method, unparsable url
+		if err != nil {
+			return nil, newRequestError(err)
+		}
+		req = req.WithContext(ctx)
+		for k, v := range r.Header {
+			req.Header[k] = v
+		}
+
+		if err = authenticateRequest(req); err != nil {
+			log.Error(err.Error())
+			return nil, err
+		}
+		start := time.Now()
+		resp, err := clientFor(db).Do(req)
+		elapsed := time.Since(start)
+		// Possible err = mostly connection failure
+		if err != nil {
+			if ctxErr := ctx.Err(); ctxErr != nil {
+				return nil, ctxErr
+			}
+			err = newConnectionError(err)
+			log.Error(err.Error())
+			return nil, err
+		}
+		refreshSession(resp)
+		if elapsed.Seconds() >= 10 {
+			log.Printf("slow request on %s %s (%s)", r.Method, r.Path, elapsed)
+		}
+
+		// With the session auth, the session may have expired, and a new one
+		// is opened for retrying the request.
+		if resp.StatusCode == http.StatusUnauthorized && usesSessionAuth() && !reauthenticated {
+			reauthenticated = true
+			resp.Body.Close()
+			resetSession()
+			continue
+		}
+
+		// The GET requests are retried when CouchDB, or a proxy in front of
+		// it, asks to slow down with a 429 status code.
+		if resp.StatusCode != http.StatusTooManyRequests || attempt >= maxTooManyRequestsRetries ||
+			(r.Method != http.MethodGet && r.Method != http.MethodHead) {
+			return resp, nil
+		}
+		wait, ok := parseRetryAfter(resp.Header.Get("Retry-After"))
+		if !ok {
+			return resp, nil
+		}
+		resp.Body.Close()
+		log.Infof("too many requests on %s %s, retrying in %s", r.Method, r.Path, wait)
+		select {
+		case <-time.After(wait):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// inFlightBody is the body of a response from sendRequest, that marks the
+// request as done when it is closed.
+type inFlightBody struct {
+	io.ReadCloser
+	done func()
+	once sync.Once
+}
+
+func (b *inFlightBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.done)
+	return err
+}
+
+// setRevFromHeader fills the rev of an UpdateResponse with the value of the
+// X-Couch-Update-NewRev header, for the writes where CouchDB sends the new
+// rev only in this header (new_edits=false, batch mode, etc.).
+func setRevFromHeader(resbody interface{}, newRev string) {
+	if newRev == "" {
+		return
+	}
+	var res *UpdateResponse
+	switch r := resbody.(type) {
+	case *UpdateResponse:
+		res = r
+	case **UpdateResponse:
+		if *r == nil {
+			*r = &UpdateResponse{}
+		}
+		res = *r
+	default:
+		return
+	}
+	// The status code is 2xx here, so the write has succeeded even if the
+	// body doesn't say it.
+	if res.Rev == "" {
+		res.Rev = newRev
+		res.Ok = true
+	}
+}
+
+// isTruncatedBodyError returns true if the error from decoding the body of a
+// response means that the body has been interrupted before its end, like when
+// CouchDB is restarted mid-stream. read is the number of bytes read from the
+// body: an io.EOF on an empty body is not a truncation.
+func isTruncatedBodyError(err error, read int64) bool {
+	switch err {
+	case io.ErrUnexpectedEOF:
+		return true
+	case io.EOF:
+		return read > 0
+	}
+	return false
+}
+
+// countingReader is an io.Reader that counts the number of bytes read.
+type countingReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// checkDocumentSize logs a warning when a document is larger than the
+// configured threshold, as large documents degrade the performances of
+// CouchDB, and returns an error if it is larger than the configured maximum.
+func checkDocumentSize(log *logrus.Entry, doctype, id string, size int) error {
+	couch := config.GetConfig().CouchDB
+	if couch.MaxDocumentSize > 0 && size > couch.MaxDocumentSize {
+		return newDocumentTooLargeError(size, couch.MaxDocumentSize)
+	}
+	if couch.WarnDocumentSize > 0 && size > couch.WarnDocumentSize {
+		log.Warnf("large document of %d bytes written for %s %s",
+			size, doctype, id)
+	}
+	return nil
+}
+
 // UUID requests a Universally Unique Identifier (UUID) from CouchDB.
 func UUID(db Database) (string, error) {
 	var out UUIDResponse
@@ -353,8 +773,48 @@ func UUID(db Database) (string, error) {
 // DBStatus responds with informations on the database: size, number of
 // documents, sequence numbers, etc.
 func DBStatus(db Database, doctype string) (*DBStatusResponse, error) {
+	return dbStatusCtx(context.Background(), db, doctype)
+}
+
+func dbStatusCtx(ctx context.Context, db Database, doctype string) (*DBStatusResponse, error) {
 	var out DBStatusResponse
-	return &out, makeRequest(db, doctype, http.MethodGet, "", nil, &out)
+	return &out, makeRequestCtx(ctx, db, doctype, http.MethodGet, "", nil, &out)
+}
+
+// DBFragmentation returns the fragmentation ratio of the database: the part
+// of the file that is not used by the live data, between 0 and 1. A
+// compaction can be triggered when it is too high.
+func DBFragmentation(db Database, doctype string) (float64, error) {
+	status, err := DBStatus(db, doctype)
+	if err != nil {
+		return 0, err
+	}
+	return status.fragmentation(), nil
+}
+
+func (s *DBStatusResponse) fragmentation() float64 {
+	file := s.Sizes.File
+	if file <= 0 || s.Sizes.Active >= file {
+		return 0
+	}
+	return float64(file-s.Sizes.Active) / float64(file)
+}
+
+// PurgeSeqString returns the purge sequence of the database as a string. It
+// was an integer before CouchDB 2.3, and it is a string since then.
+func (s *DBStatusResponse) PurgeSeqString() string {
+	switch seq := s.PurgeSeq.(type) {
+	case string:
+		return seq
+	case float64:
+		return strconv.FormatFloat(seq, 'f', -1, 64)
+	case json.Number:
+		return seq.String()
+	case int:
+		return strconv.Itoa(seq)
+	default:
+		return ""
+	}
 }
 
 func allDbs(db Database) ([]string, error) {
@@ -368,21 +828,19 @@ func allDbs(db Database) ([]string, error) {
 }
 
 // AllDoctypes returns a list of all the doctypes that have a database
-// on a given instance
+// on a given instance, sorted alphabetically
 func AllDoctypes(db Database) ([]string, error) {
 	dbs, err := allDbs(db)
 	if err != nil {
 		return nil, err
 	}
-	prefix := EscapeCouchdbName(db.DBPrefix())
 	var doctypes []string
 	for _, dbname := range dbs {
-		parts := strings.Split(dbname, "/")
-		if len(parts) == 2 && parts[0] == prefix {
-			doctype := unescapeCouchdbName(parts[1])
+		if doctype, ok := DoctypeFromDBName(db, dbname); ok {
 			doctypes = append(doctypes, doctype)
 		}
 	}
+	sort.Strings(doctypes)
 	return doctypes, nil
 }
 
@@ -400,6 +858,63 @@ func GetDoc(db Database, doctype, id string, out Doc) error {
 	return makeRequest(db, doctype, http.MethodGet, url.PathEscape(id), nil, out)
 }
 
+// GetDocFromNode fetches a document like GetDoc, but from a specific node of
+// a CouchDB cluster, identified by its URL (for example
+// "http://couchdb-2:5984/"). The host of the URL must be the one of a node of
+// the cluster (see Membership), as the credentials of CouchDB are sent to it.
+// It is meant to be used by the admins for debugging the inconsistencies
+// between the nodes.
+//
+// The node coordinates the request, and the read quorum is set to 1: the
+// document is the first copy that answers, which is often, but not always,
+// the copy of this node if it has a shard for the document.
+func GetDocFromNode(db Database, doctype, id, node string, out Doc) error {
+	var err error
+	id, err = validateDocID(id)
+	if err != nil {
+		return err
+	}
+	if id == "" {
+		return fmt.Errorf("Missing ID for GetDocFromNode")
+	}
+	nodeURL, err := url.Parse(node)
+	if err != nil || nodeURL.Host == "" {
+		return fmt.Errorf("Invalid node URL %q", node)
+	}
+	info, err := Membership(db)
+	if err != nil {
+		return err
+	}
+	if !info.hasHost(nodeURL.Hostname()) {
+		return fmt.Errorf("%q is not a node of the CouchDB cluster", node)
+	}
+	nodeURL.User = nil
+	if !strings.HasSuffix(nodeURL.Path, "/") {
+		nodeURL.Path += "/"
+	}
+	path := url.PathEscape(id) + "?r=1"
+	return makeRequestToURL(db, nodeURL.String(), doctype, http.MethodGet, path, nil, out)
+}
+
+// GetDocRaw fetches a document by its docType and id, and returns its JSON
+// body exactly as it was sent by CouchDB. It can be used to compute a hash of
+// the document without having to marshal it again.
+func GetDocRaw(db Database, doctype, id string) (json.RawMessage, error) {
+	var err error
+	id, err = validateDocID(id)
+	if err != nil {
+		return nil, err
+	}
+	if id == "" {
+		return nil, fmt.Errorf("Missing ID for GetDoc")
+	}
+	var raw json.RawMessage
+	if err = makeRequest(db, doctype, http.MethodGet, url.PathEscape(id), nil, &raw); err != nil {
+		return nil, err
+	}
+	return raw, nil
+}
+
 // GetDocRev fetch a document by its docType and ID on a specific revision, out
 // is filled with the document by json.Unmarshal-ing
 func GetDocRev(db Database, doctype, id, rev string, out Doc) error {
@@ -431,11 +946,123 @@ func GetDocWithRevs(db Database, doctype, id string, out Doc) error {
 	return makeRequest(db, doctype, http.MethodGet, url, nil, out)
 }
 
+// GetDocWithDeletionInfo fetches a document, like GetDoc, and tells if the
+// document has been deleted in the past, ie if its ID has been reused for a
+// new document after a deletion. The revision tree is inspected for the
+// tombstones: in the history of the winning revision (revs_info), and in the
+// other leaves (open_revs=all).
+//
+// Caveats: a compaction removes the bodies of the old revisions, and the
+// tombstones in the history of the winning revision are then reported as
+// missing by CouchDB, not as deleted. The history is also limited by the
+// revs_limit of the database. And on a CouchDB cluster, the revision tree is
+// read with the default quorum, so a very recent deletion may not be seen.
+func GetDocWithDeletionInfo(db Database, doctype, id string) (*JSONDoc, bool, error) {
+	var err error
+	id, err = validateDocID(id)
+	if err != nil {
+		return nil, false, err
+	}
+	if id == "" {
+		return nil, false, fmt.Errorf("Missing ID for GetDoc")
+	}
+
+	doc := &JSONDoc{Type: doctype}
+	u := url.PathEscape(id) + "?revs_info=true"
+	if err = makeRequest(db, doctype, http.MethodGet, u, nil, doc); err != nil {
+		return nil, false, err
+	}
+	var infos []struct {
+		Rev    string `json:"rev"`
+		Status string `json:"status"`
+	}
+	data, err := json.Marshal(doc.Get("_revs_info"))
+	if err != nil {
+		return nil, false, err
+	}
+	if err = json.Unmarshal(data, &infos); err != nil {
+		return nil, false, err
+	}
+	delete(doc.M, "_revs_info")
+	for _, info := range infos {
+		if info.Status == "deleted" {
+			return doc, true, nil
+		}
+	}
+
+	var leaves []struct {
+		OK *struct {
+			Deleted bool `json:"_deleted"`
+		} `json:"ok"`
+	}
+	u = url.PathEscape(id) + "?open_revs=all"
+	if err = makeRequest(db, doctype, http.MethodGet, u, nil, &leaves); err != nil {
+		return nil, false, err
+	}
+	for _, leaf := range leaves {
+		if leaf.OK != nil && leaf.OK.Deleted {
+			return doc, true, nil
+		}
+	}
+	return doc, false, nil
+}
+
+// GetDocHistory returns the available revisions of a document, from the
+// newest to the oldest, with at most limit revisions (0 for no limit). The
+// revisions that have been removed by a compaction are skipped.
+func GetDocHistory(db Database, doctype, id string, limit int) ([]json.RawMessage, error) {
+	var doc JSONDoc
+	if err := GetDocWithRevs(db, doctype, id, &doc); err != nil {
+		return nil, err
+	}
+	var revisions struct {
+		Start int      `json:"start"`
+		IDs   []string `json:"ids"`
+	}
+	data, err := json.Marshal(doc.Get("_revisions"))
+	if err != nil {
+		return nil, err
+	}
+	if err = json.Unmarshal(data, &revisions); err != nil {
+		return nil, err
+	}
+
+	var history []json.RawMessage
+	for i, revID := range revisions.IDs {
+		if limit > 0 && len(history) >= limit {
+			break
+		}
+		rev := fmt.Sprintf("%d-%s", revisions.Start-i, revID)
+		u := url.PathEscape(id) + "?rev=" + url.QueryEscape(rev)
+		var raw json.RawMessage
+		err = makeRequest(db, doctype, http.MethodGet, u, nil, &raw)
+		if IsNotFoundError(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		history = append(history, raw)
+	}
+	return history, nil
+}
+
 // EnsureDBExist creates the database for the doctype if it doesn't exist
 func EnsureDBExist(db Database, doctype string) error {
-	if _, err := DBStatus(db, doctype); IsNoDatabaseError(err) {
-		if err = CreateDB(db, doctype); err != nil {
-			_, err = DBStatus(db, doctype)
+	return EnsureDBExistCtx(context.Background(), db, doctype)
+}
+
+// EnsureDBExistCtx is like EnsureDBExist, but the requests to CouchDB are
+// canceled when the context is done. It is useful to bound the time spent
+// on the creation of the databases when an instance is provisioned.
+func EnsureDBExistCtx(ctx context.Context, db Database, doctype string) error {
+	_, err := dbStatusCtx(ctx, db, doctype)
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		return ctxErr
+	}
+	if IsNoDatabaseError(err) {
+		if err = createDBCtx(ctx, db, doctype); err != nil {
+			_, err = dbStatusCtx(ctx, db, doctype)
 			return err
 		}
 	}
@@ -444,15 +1071,61 @@ func EnsureDBExist(db Database, doctype string) error {
 
 // CreateDB creates the necessary database for a doctype
 func CreateDB(db Database, doctype string) error {
+	return createDBCtx(context.Background(), db, doctype)
+}
+
+func createDBCtx(ctx context.Context, db Database, doctype string) error {
 	// XXX On dev release of the stack, we force some parameters at the
 	// creation of a database. It helps CouchDB to have more acceptable
 	// performances inside Docker. Those parameters are not suitable for
 	// production, and we must not override the CouchDB configuration.
 	query := ""
 	if build.IsDevRelease() {
-		query = "?q=1&n=1"
+		query = devCreateDBQuery()
 	}
-	return makeRequest(db, doctype, http.MethodPut, query, nil, nil)
+	RegisterDoctypes(doctype)
+	return makeRequestCtx(ctx, db, doctype, http.MethodPut, query, nil, nil)
+}
+
+// devCreateDBQuery returns the query string used for the creation of the
+// databases on a dev release, with the q and n from the configuration.
+func devCreateDBQuery() string {
+	couch := config.GetConfig().CouchDB
+	q, n := couch.DevQ, couch.DevN
+	if q <= 0 {
+		q = 1
+	}
+	if n <= 0 {
+		n = 1
+	}
+	return fmt.Sprintf("?q=%d&n=%d", q, n)
+}
+
+// DBCreateOptions are the parameters that can be given to CouchDB for the
+// creation of a database. The zero values let CouchDB use its defaults.
+type DBCreateOptions struct {
+	// Q is the number of shards for the database
+	Q int `url:"q,omitempty"`
+	// N is the number of replicas of each document
+	N int `url:"n,omitempty"`
+	// Partitioned creates a partitioned database
+	Partitioned bool `url:"partitioned,omitempty"`
+}
+
+// CreateDBWithOptions creates the database for a doctype with the given
+// sharding options. Contrary to CreateDB, it doesn't force any parameter on
+// dev releases.
+func CreateDBWithOptions(db Database, doctype string, opts DBCreateOptions) error {
+	v, err := query.Values(opts)
+	if err != nil {
+		return err
+	}
+	path := ""
+	if len(v) > 0 {
+		path = "?" + v.Encode()
+	}
+	RegisterDoctypes(doctype)
+	return makeRequest(db, doctype, http.MethodPut, path, nil, nil)
 }
 
 // DeleteDB destroy the database for a doctype
@@ -500,6 +1173,13 @@ func ResetDB(db Database, doctype string) error {
 // a CouchdbError(409 conflict) will be returned.
 // The document's SetRev will be called with tombstone revision
 func DeleteDoc(db Database, doc Doc) error {
+	return DeleteDocCtx(context.Background(), db, doc)
+}
+
+// DeleteDocCtx is like DeleteDoc, but the request is canceled when the
+// context is done, and the realtime event is tagged with the origin from the
+// context (see realtime.WithOrigin).
+func DeleteDocCtx(ctx context.Context, db Database, doc Doc) error {
 	id, err := validateDocID(doc.ID())
 	if err != nil {
 		return err
@@ -508,31 +1188,68 @@ func DeleteDoc(db Database, doc Doc) error {
 		return fmt.Errorf("Missing ID for DeleteDoc")
 	}
 	old := doc.Clone()
-
-	// XXX Specific log for the deletion of an account, to help monitor this
-	// metric.
-	if doc.DocType() == accountDocType {
-		logger.WithDomain(db.DomainName()).
-			WithFields(logrus.Fields{
-				"log_id":      "account_delete",
-				"account_id":  doc.ID(),
-				"account_rev": doc.Rev(),
-				"nspace":      "couchb",
-			}).
-			Infof("Deleting account %s", doc.ID())
-	}
+	logDeletion(db, doc.DocType(), id, doc.Rev())
 
 	var res UpdateResponse
 	url := url.PathEscape(id) + "?rev=" + url.QueryEscape(doc.Rev())
-	err = makeRequest(db, doc.DocType(), http.MethodDelete, url, nil, &res)
+	err = makeRequestCtx(ctx, db, doc.DocType(), http.MethodDelete, url, nil, &res)
 	if err != nil {
 		return err
 	}
 	doc.SetRev(res.Rev)
+	RTEventWithContext(ctx, db, realtime.EventDelete, doc, old)
+	teeWrite(db, realtime.EventDelete, doc)
+	return nil
+}
+
+// DeleteDocByID deletes a document from its doctype, id and current rev,
+// without having to fetch it first. The realtime event is emitted with a
+// minimal JSONDoc that has only the _id, _rev and _deleted fields.
+func DeleteDocByID(db Database, doctype, id, rev string) error {
+	id, err := validateDocID(id)
+	if err != nil {
+		return err
+	}
+	if id == "" || rev == "" || doctype == "" {
+		return fmt.Errorf("DeleteDocByID should have doctype, id and rev")
+	}
+	logDeletion(db, doctype, id, rev)
+
+	var res UpdateResponse
+	url := url.PathEscape(id) + "?rev=" + url.QueryEscape(rev)
+	err = makeRequest(db, doctype, http.MethodDelete, url, nil, &res)
+	if err != nil {
+		return err
+	}
+	old := &JSONDoc{
+		Type: doctype,
+		M:    map[string]interface{}{"_id": id, "_rev": rev},
+	}
+	doc := &JSONDoc{
+		Type: doctype,
+		M:    map[string]interface{}{"_id": id, "_rev": res.Rev, "_deleted": true},
+	}
 	RTEvent(db, realtime.EventDelete, doc, old)
+	teeWrite(db, realtime.EventDelete, doc)
 	return nil
 }
 
+// logDeletion is a specific log for the deletion of an account, to help
+// monitor this metric.
+func logDeletion(db Database, doctype, id, rev string) {
+	if doctype != accountDocType {
+		return
+	}
+	logger.WithDomain(db.DomainName()).
+		WithFields(logrus.Fields{
+			"log_id":      "account_delete",
+			"account_id":  id,
+			"account_rev": rev,
+			"nspace":      "couchb",
+		}).
+		Infof("Deleting account %s", id)
+}
+
 // NewEmptyObjectOfSameType takes an object and returns a new object of the
 // same type. For example, if NewEmptyObjectOfSameType is called with a pointer
 // to a JSONDoc, it will return a pointer to an empty JSONDoc (and not a nil
@@ -549,6 +1266,12 @@ func NewEmptyObjectOfSameType(obj interface{}) interface{} {
 // UpdateDoc update a document. The document ID and Rev should be filled.
 // The doc SetRev function will be called with the new rev.
 func UpdateDoc(db Database, doc Doc) error {
+	return UpdateDocCtx(context.Background(), db, doc)
+}
+
+// UpdateDocCtx is like UpdateDoc, with a context for the requests and the
+// origin of the realtime event.
+func UpdateDocCtx(ctx context.Context, db Database, doc Doc) error {
 	id, err := validateDocID(doc.ID())
 	if err != nil {
 		return err
@@ -562,23 +1285,30 @@ func UpdateDoc(db Database, doc Doc) error {
 	// The old doc is requested to be emitted thought RTEvent.
 	// This is useful to keep track of the modifications for the triggers.
 	oldDoc := NewEmptyObjectOfSameType(doc).(Doc)
-	err = makeRequest(db, doctype, http.MethodGet, url, nil, oldDoc)
+	err = makeRequestCtx(ctx, db, doctype, http.MethodGet, url, nil, oldDoc)
 	if err != nil {
 		return err
 	}
 	var res UpdateResponse
-	err = makeRequest(db, doctype, http.MethodPut, url, doc, &res)
+	err = makeRequestCtx(ctx, db, doctype, http.MethodPut, url, doc, &res)
 	if err != nil {
 		return err
 	}
 	doc.SetRev(res.Rev)
-	RTEvent(db, realtime.EventUpdate, doc, oldDoc)
+	RTEventWithContext(ctx, db, realtime.EventUpdate, doc, oldDoc)
+	teeWrite(db, realtime.EventUpdate, doc)
 	return nil
 }
 
 // UpdateDocWithOld updates a document, like UpdateDoc. The difference is that
 // if we already have oldDoc there is no need to refetch it from database.
 func UpdateDocWithOld(db Database, doc, oldDoc Doc) error {
+	return UpdateDocWithOldCtx(context.Background(), db, doc, oldDoc)
+}
+
+// UpdateDocWithOldCtx is like UpdateDocWithOld, with a context for the
+// request and the origin of the realtime event.
+func UpdateDocWithOldCtx(ctx context.Context, db Database, doc, oldDoc Doc) error {
 	id, err := validateDocID(doc.ID())
 	if err != nil {
 		return err
@@ -590,20 +1320,35 @@ func UpdateDocWithOld(db Database, doc, oldDoc Doc) error {
 
 	url := url.PathEscape(id)
 	var res UpdateResponse
-	err = makeRequest(db, doctype, http.MethodPut, url, doc, &res)
+	err = makeRequestCtx(ctx, db, doctype, http.MethodPut, url, doc, &res)
 	if err != nil {
 		return err
 	}
 	doc.SetRev(res.Rev)
-	RTEvent(db, realtime.EventUpdate, doc, oldDoc)
+	RTEventWithContext(ctx, db, realtime.EventUpdate, doc, oldDoc)
+	teeWrite(db, realtime.EventUpdate, doc)
 	return nil
 }
 
+// UpdateDocWithoutOld updates a document, like UpdateDoc, but without
+// fetching the old document: the realtime event is emitted with a nil old
+// document. It saves a request for the hot paths where the subscribers and
+// the triggers don't need the old values.
+func UpdateDocWithoutOld(db Database, doc Doc) error {
+	return UpdateDocWithOld(db, doc, nil)
+}
+
 // CreateNamedDoc persist a document with an ID.
 // if the document already exist, it will return a 409 error.
 // The document ID should be fillled.
 // The doc SetRev function will be called with the new rev.
 func CreateNamedDoc(db Database, doc Doc) error {
+	return CreateNamedDocCtx(context.Background(), db, doc)
+}
+
+// CreateNamedDocCtx is like CreateNamedDoc, with a context for the request and
+// the origin of the realtime event.
+func CreateNamedDocCtx(ctx context.Context, db Database, doc Doc) error {
 	id, err := validateDocID(doc.ID())
 	if err != nil {
 		return err
@@ -613,12 +1358,13 @@ func CreateNamedDoc(db Database, doc Doc) error {
 		return fmt.Errorf("CreateNamedDoc should have type and id but no rev")
 	}
 	var res UpdateResponse
-	err = makeRequest(db, doctype, http.MethodPut, url.PathEscape(id), doc, &res)
+	err = makeRequestCtx(ctx, db, doctype, http.MethodPut, url.PathEscape(id), doc, &res)
 	if err != nil {
 		return err
 	}
 	doc.SetRev(res.Rev)
-	RTEvent(db, realtime.EventCreate, doc, nil)
+	RTEventWithContext(ctx, db, realtime.EventCreate, doc, nil)
+	teeWrite(db, realtime.EventCreate, doc)
 	return nil
 }
 
@@ -663,15 +1409,114 @@ func Upsert(db Database, doc Doc) error {
 	return UpdateDoc(db, doc)
 }
 
-func createDocOrDB(db Database, doc Doc, response interface{}) error {
+// FindOrCreate looks for the single document of the doctype that matches the
+// selector, and creates the create document if there is none. It returns the
+// found or created document, and true if the document was created. When
+// create has an ID, a concurrent creation of the same document is detected
+// by the conflict, and the document is then fetched again. Without an ID, two
+// concurrent calls may create two documents.
+func FindOrCreate(db Database, doctype string, selector mango.Filter, create Doc) (Doc, bool, error) {
+	found, err := findOne(db, doctype, selector, create)
+	if err != nil && !IsNoDatabaseError(err) {
+		return nil, false, err
+	}
+	if found != nil {
+		return found, false, nil
+	}
+
+	if create.ID() == "" {
+		err = CreateDoc(db, create)
+	} else {
+		err = CreateNamedDocWithDB(db, create)
+		if IsConflictError(err) {
+			found, err = findOne(db, doctype, selector, create)
+			if err == nil && found == nil {
+				err = newConflictError()
+			}
+			if err != nil {
+				return nil, false, err
+			}
+			return found, false, nil
+		}
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return create, true, nil
+}
+
+// findOne returns the first document that matches the selector, decoded in
+// an object of the same type as model, or nil if there is no such document.
+func findOne(db Database, doctype string, selector mango.Filter, model Doc) (Doc, error) {
+	var results []json.RawMessage
+	limit := 1
+	req := &FindRequest{Selector: selector, Limit: &limit}
+	if err := FindDocs(db, doctype, req, &results); err != nil {
+		return nil, err
+	}
+	if len(results) == 0 {
+		return nil, nil
+	}
+	doc := NewEmptyObjectOfSameType(model).(Doc)
+	if err := json.Unmarshal(results[0], doc); err != nil {
+		return nil, err
+	}
+	if j, ok := doc.(*JSONDoc); ok {
+		j.Type = doctype
+	}
+	return doc, nil
+}
+
+// UpsertMerge creates the doc, or if it already exists, updates it by merging
+// the fields of doc into the existing document: the top-level fields of doc
+// replace the existing ones, and the fields that are not in doc are kept. On
+// success, doc contains all the fields of the document and its new revision.
+func UpsertMerge(db Database, doc *JSONDoc) error {
+	id, err := validateDocID(doc.ID())
+	if err != nil {
+		return err
+	}
+
+	var old JSONDoc
+	err = GetDoc(db, doc.DocType(), id, &old)
+	if IsNoDatabaseError(err) {
+		err = CreateDB(db, doc.DocType())
+		if err != nil {
+			return err
+		}
+		return CreateNamedDoc(db, doc)
+	}
+	if IsNotFoundError(err) {
+		return CreateNamedDoc(db, doc)
+	}
+	if err != nil {
+		return err
+	}
+	old.Type = doc.DocType()
+
+	merged := make(map[string]interface{}, len(old.M)+len(doc.M))
+	for k, v := range old.M {
+		merged[k] = v
+	}
+	for k, v := range doc.M {
+		if k != "_rev" {
+			merged[k] = v
+		}
+	}
+	doc.M = merged
+	doc.SetRev(old.Rev())
+	return UpdateDocWithOld(db, doc, &old)
+}
+
+func createDocOrDB(ctx context.Context, db Database, doc Doc, response interface{}) error {
 	doctype := doc.DocType()
-	err := makeRequest(db, doctype, http.MethodPost, "", doc, response)
+	err := makeRequestCtx(ctx, db, doctype, http.MethodPost, "", doc, response)
 	if err == nil || !IsNoDatabaseError(err) {
 		return err
 	}
 	err = CreateDB(db, doctype)
 	if err == nil || IsFileExists(err) {
-		err = makeRequest(db, doctype, http.MethodPost, "", doc, response)
+		err = makeRequestCtx(ctx, db, doctype, http.MethodPost, "", doc, response)
 	}
 	return err
 }
@@ -681,13 +1526,19 @@ func createDocOrDB(db Database, doc Doc, response interface{}) error {
 // with the document's new ID and Rev.
 // This function creates a database if this is the first document of its type
 func CreateDoc(db Database, doc Doc) error {
+	return CreateDocCtx(context.Background(), db, doc)
+}
+
+// CreateDocCtx is like CreateDoc, with a context for the requests and the
+// origin of the realtime event.
+func CreateDocCtx(ctx context.Context, db Database, doc Doc) error {
 	var res *UpdateResponse
 
 	if doc.ID() != "" {
 		return newDefinedIDError()
 	}
 
-	err := createDocOrDB(db, doc, &res)
+	err := createDocOrDB(ctx, db, doc, &res)
 	if err != nil {
 		return err
 	} else if !res.Ok {
@@ -696,50 +1547,169 @@ func CreateDoc(db Database, doc Doc) error {
 
 	doc.SetID(res.ID)
 	doc.SetRev(res.Rev)
-	RTEvent(db, realtime.EventCreate, doc, nil)
+	RTEventWithContext(ctx, db, realtime.EventCreate, doc, nil)
+	teeWrite(db, realtime.EventCreate, doc)
 	return nil
 }
 
-// DefineViews creates a design doc with some views
+// UUIDCollisionRetries is the number of times CreateDocWithUUID tries again
+// with a new UUID when a document with the same ID already exists.
+var UUIDCollisionRetries = 3
+
+// CreateDocWithUUID creates a document with an ID taken from CouchDB (_uuids)
+// before the request, so that the ID is known even if the response is lost.
+// In the unlikely case of a collision with an existing document, a new UUID
+// is fetched, up to UUIDCollisionRetries times, and then an error is returned
+// that can be checked with IsIDCollisionError.
+//
+// On the other errors, the ID is kept on the document: the document may have
+// been created if the response has been lost, and the caller can check it
+// with this ID.
+func CreateDocWithUUID(db Database, doc Doc) error {
+	if doc.ID() != "" {
+		return newDefinedIDError()
+	}
+	for i := 0; i <= UUIDCollisionRetries; i++ {
+		id, err := UUID(db)
+		if err != nil {
+			return err
+		}
+		doc.SetID(id)
+		err = CreateNamedDocWithDB(db, doc)
+		if !IsConflictError(err) {
+			return err
+		}
+		doc.SetID("")
+	}
+	return newIDCollisionError(UUIDCollisionRetries + 1)
+}
+
+// DefineViews creates the design docs of some views. The views with the same
+// DesignDoc are put together in a single design doc, and the others have
+// their own design doc. The design docs are created concurrently, within the
+// limit of SetMaxConcurrency.
 func DefineViews(db Database, views []*View) error {
+	var docs []*ViewDesignDoc
+	var doctypes []string
+	byKey := make(map[string]*ViewDesignDoc)
 	for _, v := range views {
-		id := "_design/" + v.Name
-		url := url.PathEscape(id)
-		doc := &ViewDesignDoc{
-			ID:    id,
-			Lang:  "javascript",
-			Views: map[string]*View{v.Name: v},
-		}
-		err := makeRequest(db, v.Doctype, http.MethodPut, url, &doc, nil)
-		if IsNoDatabaseError(err) {
-			err = CreateDB(db, v.Doctype)
-			if err != nil {
-				return err
+		key := v.Doctype + "/" + v.designDocName()
+		doc, ok := byKey[key]
+		if !ok {
+			doc = &ViewDesignDoc{
+				ID:    "_design/" + v.designDocName(),
+				Lang:  "javascript",
+				Views: make(map[string]*View),
 			}
-			err = makeRequest(db, v.Doctype, http.MethodPut, url, &doc, nil)
+			byKey[key] = doc
+			docs = append(docs, doc)
+			doctypes = append(doctypes, v.Doctype)
 		}
-		if IsConflictError(err) {
-			var old ViewDesignDoc
-			err = makeRequest(db, v.Doctype, http.MethodGet, url, nil, &old)
-			if err != nil {
-				return err
-			}
-			if !equalViews(&old, doc) {
-				doc.Rev = old.Rev
-				err = makeRequest(db, v.Doctype, http.MethodPut, url, &doc, nil)
-			} else {
-				err = nil
-			}
+		doc.Views[v.Name] = v
+	}
+	return runConcurrently(context.Background(), len(docs), func(i int) error {
+		return defineDesignDoc(db, doctypes[i], docs[i])
+	})
+}
+
+// DefineViewGroup creates a single design doc with several views of the same
+// doctype. Those views are built together by CouchDB. The views given by the
+// caller are not modified: copies with their DesignDoc set to designName are
+// returned, to query them with ExecView, and to define them again with
+// DefineViews.
+func DefineViewGroup(db Database, designName string, views []*View) ([]*View, error) {
+	if len(views) == 0 {
+		return nil, nil
+	}
+	doctype := views[0].Doctype
+	doc := &ViewDesignDoc{
+		ID:    "_design/" + designName,
+		Lang:  "javascript",
+		Views: make(map[string]*View, len(views)),
+	}
+	grouped := make([]*View, len(views))
+	for i, v := range views {
+		if v.Doctype != doctype {
+			return nil, fmt.Errorf("DefineViewGroup: views %s and %s have different doctypes",
+				views[0].Name, v.Name)
 		}
+		if v.DesignDoc != "" && v.DesignDoc != designName {
+			return nil, fmt.Errorf("DefineViewGroup: view %s belongs to the design doc %s",
+				v.Name, v.DesignDoc)
+		}
+		copied := *v
+		copied.DesignDoc = designName
+		grouped[i] = &copied
+		doc.Views[v.Name] = &copied
+	}
+	if err := defineDesignDoc(db, doctype, doc); err != nil {
+		return nil, err
+	}
+	return grouped, nil
+}
+
+// DefineDesignDoc creates or updates a design doc, with its views and its
+// other functions. The design doc is replaced as a whole, and it is not
+// written if it has not changed, to avoid rebuilding its views. DefineViews
+// can be used instead for the design docs with only views.
+func DefineDesignDoc(db Database, doctype string, doc *ViewDesignDoc) error {
+	if !strings.HasPrefix(doc.ID, "_design/") || doc.ID == "_design/" {
+		return newBadIDError(doc.ID)
+	}
+	if doc.Lang == "" {
+		doc.Lang = "javascript"
+	}
+	return defineDesignDoc(db, doctype, doc)
+}
+
+// defineDesignDoc puts the design doc in the database of the doctype. If a
+// design doc with the same ID already exists, it is updated only when its
+// content has changed, to avoid an unnecessary rebuild of the index.
+func defineDesignDoc(db Database, doctype string, doc *ViewDesignDoc) error {
+	url := url.PathEscape(doc.ID)
+	err := makeRequest(db, doctype, http.MethodPut, url, &doc, nil)
+	if IsNoDatabaseError(err) {
+		err = CreateDB(db, doctype)
+		if err != nil && !IsFileExists(err) {
+			return err
+		}
+		err = makeRequest(db, doctype, http.MethodPut, url, &doc, nil)
+	}
+	if IsConflictError(err) {
+		var old ViewDesignDoc
+		err = makeRequest(db, doctype, http.MethodGet, url, nil, &old)
 		if err != nil {
 			return err
 		}
+		if !equalViews(&old, doc) {
+			doc.Rev = old.Rev
+			err = makeRequest(db, doctype, http.MethodPut, url, &doc, nil)
+		} else {
+			err = nil
+		}
 	}
-	return nil
+	return err
+}
+
+// equalFunctions compares the functions of two design docs, by name. A nil
+// map and an empty one are equal.
+func equalFunctions(f1, f2 map[string]string) bool {
+	if len(f1) != len(f2) {
+		return false
+	}
+	for name, fn := range f1 {
+		if other, ok := f2[name]; !ok || other != fn {
+			return false
+		}
+	}
+	return true
 }
 
 func equalViews(v1 *ViewDesignDoc, v2 *ViewDesignDoc) bool {
-	if v1.Lang != v2.Lang {
+	if v1.Lang != v2.Lang || v1.ValidateDocUpdate != v2.ValidateDocUpdate {
+		return false
+	}
+	if !equalFunctions(v1.Updates, v2.Updates) || !equalFunctions(v1.Filters, v2.Filters) {
 		return false
 	}
 	if len(v1.Views) != len(v2.Views) {
@@ -750,20 +1720,81 @@ func equalViews(v1 *ViewDesignDoc, v2 *ViewDesignDoc) bool {
 		if !ok {
 			return false
 		}
-		if view1.Map != view2.Map ||
-			view1.Reduce != view2.Reduce {
+		if !equalView(view1, view2) {
 			return false
 		}
 	}
 	return true
 }
 
+func equalView(v1 *View, v2 *View) bool {
+	return v1.Map == v2.Map && v1.Reduce == v2.Reduce &&
+		equalViewOptions(v1.Options, v2.Options)
+}
+
+// equalViewOptions compares the options of two views by their JSON
+// serialization, as the options read from CouchDB don't have the same types
+// as the ones defined in the code (float64 for the numbers, for example).
+func equalViewOptions(o1, o2 map[string]interface{}) bool {
+	if len(o1) == 0 || len(o2) == 0 {
+		return len(o1) == len(o2)
+	}
+	j1, err := json.Marshal(o1)
+	if err != nil {
+		return false
+	}
+	j2, err := json.Marshal(o2)
+	if err != nil {
+		return false
+	}
+	return bytes.Equal(j1, j2)
+}
+
+// ViewNeedsUpdate returns true if defining the view would change its design
+// doc, and thus would trigger a rebuild of the index by CouchDB. Nothing is
+// written in the database.
+func ViewNeedsUpdate(db Database, view *View) (bool, error) {
+	id := "_design/" + view.designDocName()
+	var old ViewDesignDoc
+	err := makeRequest(db, view.Doctype, http.MethodGet, url.PathEscape(id), nil, &old)
+	if IsNotFoundError(err) {
+		return true, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if view.DesignDoc != "" {
+		existing, ok := old.Views[view.Name]
+		return !ok || !equalView(existing, view), nil
+	}
+	doc := &ViewDesignDoc{
+		ID:    id,
+		Lang:  "javascript",
+		Views: map[string]*View{view.Name: view},
+	}
+	return !equalViews(&old, doc), nil
+}
+
+// viewProcessErrorDelay is the time to wait before retrying a view request
+// when the view server of CouchDB has crashed.
+var viewProcessErrorDelay = 5 * time.Second
+
 // ExecView executes the specified view function
 func ExecView(db Database, view *View, req *ViewRequest, results interface{}) error {
-	viewurl := fmt.Sprintf("_design/%s/_view/%s", view.Name, view.Name)
+	viewurl := fmt.Sprintf("_design/%s/_view/%s", view.designDocName(), view.Name)
+	if err := req.validate(); err != nil {
+		return err
+	}
+	// The request is copied, as the caller may reuse it
+	copied := *req
+	req = &copied
 	if req.GroupLevel > 0 {
 		req.Group = true
 	}
+	if req.GroupLimit > 0 {
+		req.Group = true
+		req.Limit = req.GroupLimit
+	}
 	v, err := req.Values()
 	if err != nil {
 		return err
@@ -774,8 +1805,14 @@ func ExecView(db Database, view *View, req *ViewRequest, results interface{}) er
 	}
 	err = makeRequest(db, view.Doctype, http.MethodGet, viewurl, nil, &results)
 	if IsInternalServerError(err) {
-		time.Sleep(1 * time.Second)
-		// Retry the error on 500, sa it may be just that CouchDB is slow to build the view
+		// Retry the error on 500, sa it may be just that CouchDB is slow to
+		// build the view, or that the view server has crashed and needs a bit
+		// more time to recover.
+		if IsViewProcessError(err) {
+			time.Sleep(viewProcessErrorDelay)
+		} else {
+			time.Sleep(1 * time.Second)
+		}
 		err = makeRequest(db, view.Doctype, http.MethodGet, viewurl, nil, &results)
 		if IsInternalServerError(err) {
 			logger.
@@ -788,6 +1825,178 @@ func ExecView(db Database, view *View, req *ViewRequest, results interface{}) er
 	return err
 }
 
+// ViewKeysChunkSize is the maximal number of keys sent to CouchDB in a
+// single request by ExecViewKeys.
+var ViewKeysChunkSize = 500
+
+// ExecViewKeys queries a view for the rows matching the given keys. The keys
+// are split in chunks of ViewKeysChunkSize, sent in several requests to stay
+// below the size limits of CouchDB, and the rows are merged in the order of
+// the keys.
+func ExecViewKeys(db Database, view *View, keys []interface{}, includeDocs bool) (*ViewResponse, error) {
+	size := ViewKeysChunkSize
+	if size <= 0 {
+		size = len(keys)
+	}
+	merged := &ViewResponse{Rows: []*ViewResponseRow{}}
+	for start := 0; start < len(keys); start += size {
+		end := start + size
+		if end > len(keys) {
+			end = len(keys)
+		}
+		req := &ViewRequest{
+			Keys:        keys[start:end],
+			IncludeDocs: includeDocs,
+		}
+		var res ViewResponse
+		if err := ExecView(db, view, req, &res); err != nil {
+			return nil, err
+		}
+		merged.Total = res.Total
+		merged.Rows = append(merged.Rows, res.Rows...)
+	}
+	return merged, nil
+}
+
+// DecodeViewDocs decodes the documents included in the rows of a view
+// response (IncludeDocs) in out, that must be a pointer to a slice, like
+// *[]*MyDoc. The rows without a document (deleted or missing) are skipped.
+func DecodeViewDocs(resp *ViewResponse, out interface{}) error {
+	docs := make([]json.RawMessage, 0, len(resp.Rows))
+	for _, row := range resp.Rows {
+		if len(row.Doc) == 0 || string(row.Doc) == "null" {
+			continue
+		}
+		docs = append(docs, row.Doc)
+	}
+	data, err := json.Marshal(docs)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, out)
+}
+
+// DecodeViewJSONDocs is like DecodeViewDocs, but the documents are decoded as
+// JSONDoc with the given doctype.
+func DecodeViewJSONDocs(resp *ViewResponse, doctype string) ([]*JSONDoc, error) {
+	var docs []*JSONDoc
+	if err := DecodeViewDocs(resp, &docs); err != nil {
+		return nil, err
+	}
+	for _, doc := range docs {
+		doc.Type = doctype
+	}
+	return docs, nil
+}
+
+// ExecReduce executes the specified view function with reduce, and decodes
+// the value of the single row returned by CouchDB in out. It is useful for
+// scalar aggregates, like a total count or sum.
+func ExecReduce(db Database, view *View, req *ViewRequest, out interface{}) error {
+	reduced := *req
+	reduced.Reduce = true
+	var res struct {
+		Rows []struct {
+			Value json.RawMessage `json:"value"`
+		} `json:"rows"`
+	}
+	if err := ExecView(db, view, &reduced, &res); err != nil {
+		return err
+	}
+	if len(res.Rows) != 1 {
+		return newUnexpectedRowsError(view.Name, len(res.Rows))
+	}
+	return json.Unmarshal(res.Rows[0].Value, out)
+}
+
+// ReduceStatsValue is the value computed by the _stats built-in reduce
+// function of CouchDB.
+type ReduceStatsValue struct {
+	Sum    float64 `json:"sum"`
+	Count  float64 `json:"count"`
+	Min    float64 `json:"min"`
+	Max    float64 `json:"max"`
+	SumSqr float64 `json:"sumsqr"`
+}
+
+// ExecStatsView executes a view with the _stats reduce function, grouped by
+// key, and returns the stats for each key. The keys that are not strings are
+// serialized in JSON, like ["2020", "01"].
+func ExecStatsView(db Database, view *View, req *ViewRequest) (map[string]ReduceStatsValue, error) {
+	grouped := *req
+	grouped.Reduce = true
+	grouped.Group = true
+	var res statsViewResponse
+	if err := ExecView(db, view, &grouped, &res); err != nil {
+		return nil, err
+	}
+	return res.decode()
+}
+
+type statsViewResponse struct {
+	Rows []struct {
+		Key   interface{}      `json:"key"`
+		Value ReduceStatsValue `json:"value"`
+	} `json:"rows"`
+}
+
+func (res *statsViewResponse) decode() (map[string]ReduceStatsValue, error) {
+	stats := make(map[string]ReduceStatsValue, len(res.Rows))
+	for _, row := range res.Rows {
+		key, err := rowKeyString(row.Key)
+		if err != nil {
+			return nil, err
+		}
+		stats[key] = row.Value
+	}
+	return stats, nil
+}
+
+// rowKeyString returns the key of a row of a view as a string, serialized in
+// JSON if it is not already a string.
+func rowKeyString(key interface{}) (string, error) {
+	if str, ok := key.(string); ok {
+		return str, nil
+	}
+	k, err := json.Marshal(key)
+	if err != nil {
+		return "", err
+	}
+	return string(k), nil
+}
+
+// validate checks that the combination of parameters of the request is
+// handled predictably by CouchDB.
+func (vr *ViewRequest) validate() error {
+	if vr.GroupLimit < 0 {
+		return newInvalidViewRequestError("group_limit cannot be negative")
+	}
+	if vr.GroupLimit > 0 {
+		if !vr.Reduce {
+			return newInvalidViewRequestError("group_limit can only be used with reduce")
+		}
+		if vr.Limit != 0 && vr.Limit != vr.GroupLimit {
+			return newInvalidViewRequestError("group_limit and limit are mutually exclusive")
+		}
+	}
+	// Skip is applied on the groups, and some versions of CouchDB ignore it
+	// when group_level is used.
+	if vr.Reduce && vr.GroupLevel > 0 && vr.Skip > 0 {
+		return newInvalidViewRequestError("skip cannot be used with group_level")
+	}
+	if vr.Keys != nil {
+		// With reduce but without group, CouchDB collapses the rows of all the
+		// keys in a single one.
+		if vr.Reduce && !vr.Group && vr.GroupLevel == 0 && vr.GroupLimit == 0 {
+			return newInvalidViewRequestError("keys can only be used with reduce if the results are grouped")
+		}
+		if vr.Key != nil || vr.StartKey != nil || vr.EndKey != nil {
+			return newInvalidViewRequestError("keys cannot be used with key, start_key or end_key")
+		}
+	}
+	return nil
+}
+
 // DefineIndex define the index on the doctype database
 // see query package on how to define an index
 func DefineIndex(db Database, index *mango.Index) error {
@@ -801,7 +2010,7 @@ func DefineIndexRaw(db Database, doctype string, index interface{}) (*IndexCreat
 	response := &IndexCreationResponse{}
 	err := makeRequest(db, doctype, http.MethodPost, url, &index, &response)
 	if IsNoDatabaseError(err) {
-		if err = CreateDB(db, doctype); err != nil {
+		if err = CreateDB(db, doctype); err != nil && !IsFileExists(err) {
 			return nil, err
 		}
 		err = makeRequest(db, doctype, http.MethodPost, url, &index, &response)
@@ -812,14 +2021,12 @@ func DefineIndexRaw(db Database, doctype string, index interface{}) (*IndexCreat
 	return response, nil
 }
 
-// DefineIndexes defines a list of indexes
+// DefineIndexes defines a list of indexes. The indexes are created
+// concurrently, within the limit of SetMaxConcurrency.
 func DefineIndexes(db Database, indexes []*mango.Index) error {
-	for _, index := range indexes {
-		if err := DefineIndex(db, index); err != nil {
-			return err
-		}
-	}
-	return nil
+	return runConcurrently(context.Background(), len(indexes), func(i int) error {
+		return DefineIndex(db, indexes[i])
+	})
 }
 
 // FindDocs returns all documents matching the passed FindRequest
@@ -838,6 +2045,29 @@ func FindDocsUnoptimized(db Database, doctype string, req *FindRequest, results
 
 func findDocsRaw(db Database, doctype string, req interface{}, results interface{}, ignoreUnoptimized bool) (*FindResponse, error) {
 	url := "_find"
+	var explained *FindRequest
+	if r, ok := req.(*FindRequest); ok {
+		couch := config.GetConfig().CouchDB
+		withStats := r.ExecutionStats == nil && (couch.ExecutionStats || couch.FullScanRatio > 0)
+		var useIndex string
+		if r.UseIndex == "" {
+			useIndex = registeredQueryIndex(doctype, r.Selector)
+		}
+		if withStats || useIndex != "" {
+			copied := *r
+			if withStats {
+				enabled := true
+				copied.ExecutionStats = &enabled
+			}
+			if useIndex != "" {
+				copied.UseIndex = useIndex
+			}
+			req = &copied
+		}
+		if couch.LogIndexSelection && r.UseIndex == "" && useIndex == "" {
+			explained = r
+		}
+	}
 	// prepare a structure to receive the results
 	var response FindResponse
 	err := makeRequest(db, doctype, http.MethodPost, url, &req, &response)
@@ -853,9 +2083,25 @@ func findDocsRaw(db Database, doctype string, req interface{}, results interface
 		}
 		return nil, err
 	}
-	if !ignoreUnoptimized && response.Warning != "" {
-		// Developer should not rely on unoptimized index.
-		return nil, unoptimalError()
+	if response.ExecutionStats != nil {
+		logExecutionStats(db, doctype, req, response.ExecutionStats)
+		checkFullScan(db, doctype, req, response.ExecutionStats)
+	}
+	if isIndexUsageTracked() {
+		trackIndexUsage(db, doctype, req)
+	}
+	if explained != nil {
+		logIndexSelection(db, doctype, explained)
+	}
+	if !ignoreUnoptimized {
+		for _, warning := range response.Warnings() {
+			if warning.IsNoMatchingIndex() {
+				// Developer should not rely on unoptimized index.
+				return nil, unoptimalError()
+			}
+			logger.WithDomain(db.DomainName()).WithField("nspace", "couchdb").
+				Debugf("Warning on _find for %s: %s", doctype, warning)
+		}
 	}
 	if response.Bookmark == "nil" {
 		// CouchDB surprisingly returns "nil" when there is no doc
@@ -864,6 +2110,49 @@ func findDocsRaw(db Database, doctype string, req interface{}, results interface
 	return &response, json.Unmarshal(response.Docs, results)
 }
 
+func logExecutionStats(db Database, doctype string, req interface{}, stats *ExecutionStats) {
+	if stats == nil {
+		return
+	}
+	threshold := config.GetConfig().CouchDB.SlowQueryThreshold
+	elapsed := time.Duration(stats.ExecutionTimeMs * float64(time.Millisecond))
+	if elapsed < threshold {
+		return
+	}
+	jsonReq, _ := json.Marshal(req)
+	logger.WithDomain(db.DomainName()).WithField("nspace", "couchdb").
+		Infof("slow _find on %s (%s): %d keys and %d docs examined for %d results, req: %s",
+			doctype, elapsed, stats.TotalKeysExamined, stats.TotalDocsExamined,
+			stats.ResultsReturned, string(jsonReq))
+}
+
+// fullScanMinDocs is the number of examined documents below which a _find
+// request is not considered as a full scan, whatever its ratio.
+const fullScanMinDocs = 1000
+
+// checkFullScan logs a warning when a _find request has examined many more
+// documents than it has returned, as it is a sign of a missing index.
+func checkFullScan(db Database, doctype string, req interface{}, stats *ExecutionStats) {
+	if !isFullScan(stats, config.GetConfig().CouchDB.FullScanRatio) {
+		return
+	}
+	jsonReq, _ := json.Marshal(req)
+	logger.WithDomain(db.DomainName()).WithField("nspace", "couchdb").
+		Warnf("probable full scan on %s: %d docs examined for %d results, req: %s",
+			doctype, stats.TotalDocsExamined, stats.ResultsReturned, string(jsonReq))
+}
+
+func isFullScan(stats *ExecutionStats, ratio float64) bool {
+	if stats == nil || ratio <= 0 || stats.TotalDocsExamined < fullScanMinDocs {
+		return false
+	}
+	returned := stats.ResultsReturned
+	if returned < 1 {
+		returned = 1
+	}
+	return float64(stats.TotalDocsExamined)/float64(returned) > ratio
+}
+
 // FindDocsRaw find documents
 // TODO: pagination
 func FindDocsRaw(db Database, doctype string, req interface{}, results interface{}) (*FindResponse, error) {
@@ -879,14 +2168,14 @@ func NormalDocs(db Database, doctype string, skip, limit int, bookmark string) (
 	}
 	req := FindRequest{
 		Selector: mango.Gte("_id", nil),
-		Limit:    limit,
+		Limit:    &limit,
 	}
 	// Both bookmark and skip can be used for pagination, but bookmark is more efficient.
 	// See https://docs.couchdb.org/en/latest/api/database/find.html#pagination
 	if bookmark != "" {
 		req.Bookmark = bookmark
 	} else {
-		req.Skip = skip
+		req.Skip = &skip
 	}
 	err := makeRequest(db, doctype, http.MethodPost, "_find", &req, &findRes)
 	if err != nil {
@@ -923,6 +2212,64 @@ func NormalDocs(db Database, doctype string, skip, limit int, bookmark string) (
 	return &res, nil
 }
 
+// BrowseResult is a page of documents of a doctype, as returned by BrowseDocs
+type BrowseResult struct {
+	Docs       []*JSONDoc `json:"docs"`
+	PageSize   int        `json:"page_size"`
+	TotalPages int        `json:"total_pages"`
+	Total      int        `json:"total"`
+	// Bookmark is the bookmark for the next page. It is empty when there are
+	// no more documents.
+	Bookmark string `json:"bookmark,omitempty"`
+}
+
+// BrowseDocs returns a page of the documents of a doctype, without the design
+// docs, for browsing them. The first page is returned for an empty bookmark,
+// and the next ones with the bookmark of the previous page: the pages are not
+// fetched with a skip, which is slow for the last pages of a big database. It
+// is built on NormalDocs, with the documents decoded and the metadata of the
+// pagination computed.
+func BrowseDocs(db Database, doctype, bookmark string, pageSize int) (*BrowseResult, error) {
+	if pageSize < 1 {
+		return nil, fmt.Errorf("BrowseDocs should have a positive page size")
+	}
+	res, err := NormalDocs(db, doctype, 0, pageSize, bookmark)
+	if err != nil {
+		return nil, err
+	}
+	docs, err := JSONDocsFromRaw(doctype, res.Rows)
+	if err != nil {
+		return nil, err
+	}
+	next := res.Bookmark
+	if len(docs) < pageSize {
+		next = ""
+	}
+	return &BrowseResult{
+		Docs:       docs,
+		PageSize:   pageSize,
+		TotalPages: (res.Total + pageSize - 1) / pageSize,
+		Total:      res.Total,
+		Bookmark:   next,
+	}, nil
+}
+
+// JSONDocsFromRaw decodes the rows, like the ones of NormalDocsResponse, as
+// JSONDoc with the given doctype. It stops on the first malformed row, and the
+// error gives its index.
+func JSONDocsFromRaw(doctype string, rows []json.RawMessage) ([]*JSONDoc, error) {
+	docs := make([]*JSONDoc, 0, len(rows))
+	for i, row := range rows {
+		doc := &JSONDoc{Type: doctype}
+		if err := json.Unmarshal(row, doc); err != nil {
+			return nil, fmt.Errorf("JSONDocsFromRaw: invalid row %d: %s", i, err)
+		}
+		doc.Type = doctype
+		docs = append(docs, doc)
+	}
+	return docs, nil
+}
+
 func validateDocID(id string) (string, error) {
 	if len(id) > 0 && id[0] == '_' {
 		return "", newBadIDError(id)
@@ -930,12 +2277,17 @@ func validateDocID(id string) (string, error) {
 	return id, nil
 }
 
-// ViewDesignDoc is the structure if a _design doc containing views
+// ViewDesignDoc is the structure if a _design doc containing views. It can
+// also have some update functions (see ExecUpdate), some filter functions for
+// the changes feed and the replications, and a validate_doc_update function.
 type ViewDesignDoc struct {
-	ID    string           `json:"_id,omitempty"`
-	Rev   string           `json:"_rev,omitempty"`
-	Lang  string           `json:"language"`
-	Views map[string]*View `json:"views"`
+	ID                string            `json:"_id,omitempty"`
+	Rev               string            `json:"_rev,omitempty"`
+	Lang              string            `json:"language"`
+	Views             map[string]*View  `json:"views,omitempty"`
+	Updates           map[string]string `json:"updates,omitempty"`
+	Filters           map[string]string `json:"filters,omitempty"`
+	ValidateDocUpdate string            `json:"validate_doc_update,omitempty"`
 }
 
 // IndexCreationResponse is the response from couchdb when we create an Index
@@ -949,32 +2301,97 @@ type IndexCreationResponse struct {
 
 // UpdateResponse is the response from couchdb when updating documents
 type UpdateResponse struct {
-	ID  string `json:"id"`
-	Rev string `json:"rev"`
-	Ok  bool   `json:"ok"`
+	ID     string `json:"id"`
+	Rev    string `json:"rev"`
+	Ok     bool   `json:"ok"`
+	Error  string `json:"error,omitempty"`
+	Reason string `json:"reason,omitempty"`
 }
 
-// FindResponse is the response from couchdb on a find request
+// FindResponse is the response from couchdb on a find request. The
+// ExecutionStats are nil if they were not requested, or if the version of
+// CouchDB doesn't support them (it ignores the parameter).
 type FindResponse struct {
-	Warning  string          `json:"warning"`
-	Bookmark string          `json:"bookmark"`
-	Docs     json.RawMessage `json:"docs"`
+	Warning        string          `json:"warning"`
+	Bookmark       string          `json:"bookmark"`
+	Docs           json.RawMessage `json:"docs"`
+	ExecutionStats *ExecutionStats `json:"execution_stats,omitempty"`
 }
 
-// FindRequest is used to build a find request
+// FindWarning is a warning sent by CouchDB in the response of a _find request
+type FindWarning string
+
+// IsNoMatchingIndex returns true if the warning says that no index matches
+// the query, and that all the documents have been scanned.
+func (w FindWarning) IsNoMatchingIndex() bool {
+	return strings.Contains(strings.ToLower(string(w)), "no matching index found")
+}
+
+// Warnings returns the list of the warnings of the response, as CouchDB can
+// send several of them in the warning field.
+func (r *FindResponse) Warnings() []FindWarning {
+	var warnings []FindWarning
+	for _, line := range strings.Split(r.Warning, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			warnings = append(warnings, FindWarning(line))
+		}
+	}
+	return warnings
+}
+
+// ExecutionStats are the statistics sent by CouchDB on a find request with
+// the execution_stats parameter
+type ExecutionStats struct {
+	TotalKeysExamined       int     `json:"total_keys_examined"`
+	TotalDocsExamined       int     `json:"total_docs_examined"`
+	TotalQuorumDocsExamined int     `json:"total_quorum_docs_examined"`
+	ResultsReturned         int     `json:"results_returned"`
+	ExecutionTimeMs         float64 `json:"execution_time_ms"`
+}
+
+// FindRequest is used to build a find request. For the pagination with a
+// bookmark, the sort must be stable: see StabilizeSort.
 type FindRequest struct {
-	Selector  mango.Filter `json:"selector"`
-	UseIndex  string       `json:"use_index,omitempty"`
-	Bookmark  string       `json:"bookmark,omitempty"`
-	Limit     int          `json:"limit,omitempty"`
-	Skip      int          `json:"skip,omitempty"`
+	Selector mango.Filter `json:"selector"`
+	UseIndex string       `json:"use_index,omitempty"`
+	Bookmark string       `json:"bookmark,omitempty"`
+	// Limit is the maximal number of documents. It is sent when it is not nil,
+	// even for 0, and CouchDB uses its default limit of 25 when it is nil.
+	Limit *int `json:"limit,omitempty"`
+	// Skip is the number of documents to skip. It is sent when it is not nil,
+	// even for 0.
+	Skip      *int         `json:"skip,omitempty"`
 	Sort      mango.SortBy `json:"sort,omitempty"`
 	Fields    []string     `json:"fields,omitempty"`
 	Conflicts bool         `json:"conflicts,omitempty"`
+	// ExecutionStats asks CouchDB to send some statistics about the query.
+	// When it is nil, they are asked for all the requests if the
+	// execution_stats or full_scan_ratio parameters of the config are set,
+	// and a false value disables them for this request.
+	ExecutionStats *bool `json:"execution_stats,omitempty"`
+	// CountOnly asks CouchDB to return no documents, with a limit of 0, for
+	// the requests where only the execution stats are useful. It takes
+	// precedence over Limit.
+	CountOnly bool `json:"-"`
+}
+
+// MarshalJSON implements json.Marshaler on FindRequest, to send the limit of
+// 0 for CountOnly.
+func (r FindRequest) MarshalJSON() ([]byte, error) {
+	type plain FindRequest
+	if r.CountOnly {
+		zero := 0
+		r.Limit = &zero
+	}
+	return json.Marshal(plain(r))
 }
 
 // ViewRequest are all params that can be passed to a view
 // It can be encoded either as a POST-json or a GET-url.
+//
+// When the view is reduced, CouchDB applies limit and skip on the groups and
+// not on the rows emitted by the map function. GroupLimit can be used to make
+// this intent explicit.
 type ViewRequest struct {
 	Key      interface{} `json:"key,omitempty" url:"key,omitempty"`
 	StartKey interface{} `json:"start_key,omitempty" url:"start_key,omitempty"`
@@ -993,9 +2410,25 @@ type ViewRequest struct {
 
 	InclusiveEnd bool `json:"inclusive_end,omitempty" url:"inclusive_end,omitempty"`
 
+	// Reduce and Group are always sent to CouchDB, even when false: a view
+	// with a reduce function is queried without reducing the rows, unless
+	// Reduce is true. It is not possible to let CouchDB use its default.
 	Reduce     bool `json:"reduce" url:"reduce"`
 	Group      bool `json:"group" url:"group"`
 	GroupLevel int  `json:"group_level,omitempty" url:"group_level,omitempty"`
+
+	// UpdateSeq asks CouchDB to include the update_seq of the view in the
+	// response, to know how fresh the results are.
+	UpdateSeq bool `json:"update_seq,omitempty" url:"update_seq,omitempty"`
+
+	// GroupLimit is the maximal number of groups returned by a reduced
+	// request. It implies Group and is sent to CouchDB as the limit.
+	GroupLimit int `json:"-" url:"-"`
+
+	// Extra are some parameters added as is to the query string, for the
+	// options of CouchDB that have no field in this struct. They must not
+	// collide with the parameters from the other fields.
+	Extra map[string]string `json:"-" url:"-"`
 }
 
 // ViewResponseRow is a row in a ViewResponse
@@ -1011,6 +2444,8 @@ type ViewResponse struct {
 	Total  int                `json:"total_rows"`
 	Offset int                `json:"offset,omitempty"`
 	Rows   []*ViewResponseRow `json:"rows"`
+	// UpdateSeq is only filled when the request has UpdateSeq
+	UpdateSeq interface{} `json:"update_seq,omitempty"`
 }
 
 // UUIDResponse is the response from _uuids
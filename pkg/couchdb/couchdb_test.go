@@ -1,19 +1,30 @@
 package couchdb
 
 import (
+	"bytes"
+	"context"
+	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
 	"os"
 	"reflect"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 	"unsafe"
 
 	"github.com/cozy/cozy-stack/pkg/config/config"
 	"github.com/cozy/cozy-stack/pkg/couchdb/mango"
+	"github.com/cozy/cozy-stack/pkg/prefixer"
 	"github.com/cozy/cozy-stack/pkg/realtime"
+	"github.com/sirupsen/logrus"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -192,6 +203,38 @@ func TestBulkUpdateDocs(t *testing.T) {
 	}
 }
 
+func TestBulkUpdateDocsWithBatchSize(t *testing.T) {
+	docs := make([]interface{}, 5)
+	olddocs := make([]interface{}, 5)
+	for i := range docs {
+		docs[i] = &testDoc{Test: "batch"}
+	}
+	err := BulkUpdateDocsWithBatchSize(TestPrefix, TestDoctype, docs, olddocs, 2)
+	assert.NoError(t, err)
+	for _, doc := range docs {
+		assert.NotEmpty(t, doc.(*testDoc).ID())
+		assert.NotEmpty(t, doc.(*testDoc).Rev())
+	}
+}
+
+func TestBatchEnd(t *testing.T) {
+	docs := []json.RawMessage{
+		json.RawMessage(`{"a":1}`),
+		json.RawMessage(`{"b":2}`),
+		json.RawMessage(`{"c":3}`),
+	}
+	assert.Equal(t, 2, batchEnd(docs, 0, 2, 1000))
+	assert.Equal(t, 3, batchEnd(docs, 2, 2, 1000))
+	assert.Equal(t, 2, batchEnd(docs, 0, 10, 16))
+	assert.Equal(t, 1, batchEnd(docs, 0, 10, 1))
+
+	batchSize := BulkBatchSize
+	defer func() { BulkBatchSize = batchSize }()
+	BulkBatchSize = 0
+	assert.Equal(t, 1, batchEnd(docs, 0, 0, 1000))
+	assert.Equal(t, 3, batchEnd(docs, 2, -1, 1000))
+}
+
 func TestDefineIndex(t *testing.T) {
 	err := DefineIndex(TestPrefix, mango.IndexOnFields(TestDoctype, "my-index", []string{"fieldA", "fieldB"}))
 	assert.NoError(t, err)
@@ -399,129 +442,2008 @@ func TestUpdateJSONDoc(t *testing.T) {
 	assert.Equal(t, "3", evt.Doc.(*JSONDoc).M["test"])
 }
 
-func TestMain(m *testing.M) {
-	config.UseTestFile()
+func TestExecReduce(t *testing.T) {
+	view := &View{
+		Name:    "count-by-test",
+		Doctype: TestDoctype,
+		Map:     `function(doc) { emit(doc.test); }`,
+		Reduce:  "_count",
+	}
+	assert.NoError(t, DefineViews(TestPrefix, []*View{view}))
+	assert.NoError(t, CreateDoc(TestPrefix, &testDoc{Test: "reduce"}))
+	assert.NoError(t, CreateDoc(TestPrefix, &testDoc{Test: "reduce"}))
 
-	if _, err := CheckStatus(); err != nil {
-		fmt.Println("This test need couchdb to run.")
-		os.Exit(1)
+	var count int
+	err := ExecReduce(TestPrefix, view, &ViewRequest{Key: "reduce"}, &count)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, count)
+
+	err = ExecReduce(TestPrefix, view, &ViewRequest{Group: true}, &count)
+	assert.Error(t, err)
+}
+
+func TestCountByField(t *testing.T) {
+	assert.NoError(t, CreateDoc(TestPrefix, &testDoc{Test: "count-a"}))
+	assert.NoError(t, CreateDoc(TestPrefix, &testDoc{Test: "count-a"}))
+	assert.NoError(t, CreateDoc(TestPrefix, &testDoc{Test: "count-b"}))
+
+	counts, err := CountByField(TestPrefix, TestDoctype, "test")
+	assert.NoError(t, err)
+	assert.Equal(t, 2, counts["count-a"])
+	assert.Equal(t, 1, counts["count-b"])
+
+	counts, err = CountByField(TestPrefix, "io.cozy.no-such-doctype", "test")
+	assert.NoError(t, err)
+	assert.Empty(t, counts)
+}
+
+func TestViewUpdateSeq(t *testing.T) {
+	view := &View{
+		Name:    "update-seq",
+		Doctype: TestDoctype,
+		Map:     `function(doc) { emit(doc.test); }`,
 	}
+	assert.NoError(t, DefineViews(TestPrefix, []*View{view}))
 
-	err := ResetDB(TestPrefix, TestDoctype)
-	if err != nil {
-		fmt.Printf("Cant reset db (%s, %s) %s\n", TestPrefix, TestDoctype, err.Error())
-		os.Exit(1)
+	var res ViewResponse
+	assert.NoError(t, ExecView(TestPrefix, view, &ViewRequest{}, &res))
+	assert.Nil(t, res.UpdateSeq)
+	assert.NoError(t, ExecView(TestPrefix, view, &ViewRequest{UpdateSeq: true}, &res))
+	assert.NotNil(t, res.UpdateSeq)
+}
+
+func TestExecViewKeys(t *testing.T) {
+	view := &View{
+		Name:    "by-keys",
+		Doctype: TestDoctype,
+		Map:     `function(doc) { emit(doc.test); }`,
+	}
+	assert.NoError(t, DefineViews(TestPrefix, []*View{view}))
+	for _, name := range []string{"keys-a", "keys-b", "keys-c"} {
+		assert.NoError(t, CreateDoc(TestPrefix, &testDoc{Test: name}))
 	}
 
-	receivedEvents = make(map[string]*realtime.Event)
-	eventChan := realtime.GetHub().Subscriber(TestPrefix)
-	_ = eventChan.Subscribe(TestDoctype)
-	go func() {
-		for ev := range eventChan.Channel {
-			receivedEventsMutex.Lock()
-			receivedEvents[ev.Verb+ev.Doc.ID()] = ev
-			receivedEventsMutex.Unlock()
+	size := ViewKeysChunkSize
+	ViewKeysChunkSize = 2
+	defer func() { ViewKeysChunkSize = size }()
+
+	keys := []interface{}{"keys-c", "keys-missing", "keys-a", "keys-b"}
+	res, err := ExecViewKeys(TestPrefix, view, keys, true)
+	assert.NoError(t, err)
+	if assert.Len(t, res.Rows, 3) {
+		assert.Equal(t, "keys-c", res.Rows[0].Key)
+		assert.Equal(t, "keys-a", res.Rows[1].Key)
+		assert.Equal(t, "keys-b", res.Rows[2].Key)
+		assert.NotEmpty(t, res.Rows[0].Doc)
+	}
+}
+
+func TestViewNeedsUpdate(t *testing.T) {
+	view := &View{
+		Name:    "drift",
+		Doctype: TestDoctype,
+		Map:     `function(doc) { emit(doc.test); }`,
+	}
+	needed, err := ViewNeedsUpdate(TestPrefix, view)
+	assert.NoError(t, err)
+	assert.True(t, needed)
+
+	assert.NoError(t, DefineViews(TestPrefix, []*View{view}))
+	needed, err = ViewNeedsUpdate(TestPrefix, view)
+	assert.NoError(t, err)
+	assert.False(t, needed)
+
+	changed := *view
+	changed.Map = `function(doc) { emit(doc.fieldA); }`
+	needed, err = ViewNeedsUpdate(TestPrefix, &changed)
+	assert.NoError(t, err)
+	assert.True(t, needed)
+}
+
+func TestGetDesignDoc(t *testing.T) {
+	view := &View{
+		Name:    "design-doc",
+		Doctype: TestDoctype,
+		Map:     `function(doc) { emit(doc.test); }`,
+	}
+	assert.NoError(t, DefineViews(TestPrefix, []*View{view}))
+	err := DefineIndex(TestPrefix, mango.IndexOnFields(TestDoctype, "design-index", []string{"fieldA"}))
+	assert.NoError(t, err)
+
+	doc, err := GetDesignDoc(TestPrefix, TestDoctype, "design-doc")
+	assert.NoError(t, err)
+	assert.Equal(t, "_design/design-doc", doc.ID)
+	if assert.Contains(t, doc.Views, "design-doc") {
+		assert.Equal(t, view.Map, doc.Views["design-doc"].Map)
+	}
+
+	_, err = GetDesignDoc(TestPrefix, TestDoctype, "no-such-design-doc")
+	assert.True(t, IsNotFoundError(err))
+
+	docs, err := ListDesignDocs(TestPrefix, TestDoctype)
+	assert.NoError(t, err)
+	var ids []string
+	for _, d := range docs {
+		ids = append(ids, d.ID)
+	}
+	assert.Contains(t, ids, "_design/design-doc")
+	assert.Contains(t, ids, "_design/design-index")
+}
+
+func TestDefineViewGroup(t *testing.T) {
+	doctype := "io.cozy.tests.viewgroup"
+	defer func() { _ = DeleteDB(TestPrefix, doctype) }()
+	assert.NoError(t, ResetDB(TestPrefix, doctype))
+
+	byA := &View{Name: "by-a", Doctype: doctype, Map: `function(doc) { emit(doc.a); }`}
+	byB := &View{Name: "by-b", Doctype: doctype, Map: `function(doc) { emit(doc.b); }`}
+	grouped, err := DefineViewGroup(TestPrefix, "group", []*View{byA, byB})
+	assert.NoError(t, err)
+	assert.Empty(t, byA.DesignDoc)
+	assert.Empty(t, byB.DesignDoc)
+	if assert.Len(t, grouped, 2) {
+		assert.Equal(t, "group", grouped[0].DesignDoc)
+		assert.Equal(t, "by-b", grouped[1].Name)
+	}
+	doc, err := GetDesignDoc(TestPrefix, doctype, "group")
+	assert.NoError(t, err)
+	assert.Len(t, doc.Views, 2)
+
+	assert.NoError(t, DefineViews(TestPrefix, grouped))
+	again, err := GetDesignDoc(TestPrefix, doctype, "group")
+	assert.NoError(t, err)
+	assert.Equal(t, doc.Rev, again.Rev)
+	assert.Contains(t, again.Views, "by-a")
+	assert.Contains(t, again.Views, "by-b")
+
+	var res ViewResponse
+	assert.NoError(t, ExecView(TestPrefix, grouped[0], &ViewRequest{}, &res))
+}
+
+func TestDefineViewGroupQueries(t *testing.T) {
+	var paths []string
+	defer withFakeCouch(t, func(w http.ResponseWriter, r *http.Request) {
+		paths = append(paths, r.Method+" "+r.URL.Path)
+		if r.Method == http.MethodPut {
+			w.WriteHeader(http.StatusCreated)
+			_, _ = w.Write([]byte(`{"ok": true, "id": "_design/group", "rev": "1-abc"}`))
+			return
 		}
-	}()
+		_, _ = w.Write([]byte(`{"rows": []}`))
+	})()
 
-	res := m.Run()
+	byA := &View{Name: "by-a", Doctype: TestDoctype, Map: `function(doc) { emit(doc.a); }`}
+	grouped, err := DefineViewGroup(TestPrefix, "group", []*View{byA})
+	assert.NoError(t, err)
+	var res ViewResponse
+	assert.NoError(t, ExecView(TestPrefix, grouped[0], &ViewRequest{}, &res))
+	assert.Equal(t, []string{
+		"PUT /couchdb-tests/io-cozy-testobject/_design/group",
+		"GET /couchdb-tests/io-cozy-testobject/_design/group/_view/by-a",
+	}, paths)
+}
 
-	eventChan.Close()
-	_ = DeleteDB(TestPrefix, TestDoctype)
+func TestVerifyAndRepairViews(t *testing.T) {
+	doctype := "io.cozy.tests.verifyviews"
+	defer func() { _ = DeleteDB(TestPrefix, doctype) }()
+	assert.NoError(t, ResetDB(TestPrefix, doctype))
 
-	os.Exit(res)
+	ok := &View{Name: "ok", Doctype: doctype, Map: `function(doc) { emit(doc.a); }`}
+	stale := &View{Name: "stale", Doctype: doctype, Map: `function(doc) { emit(doc.b); }`}
+	missing := &View{Name: "missing", Doctype: doctype, Map: `function(doc) { emit(doc.c); }`}
+	old := &View{Name: "stale", Doctype: doctype, Map: `function(doc) { emit(doc.old); }`}
+	assert.NoError(t, DefineViews(TestPrefix, []*View{ok, old}))
+
+	expected := []*View{ok, stale, missing}
+	invalid, err := VerifyViews(TestPrefix, expected)
+	assert.NoError(t, err)
+	assert.Equal(t, []*View{stale, missing}, invalid)
+
+	before, err := GetDesignDoc(TestPrefix, doctype, "ok")
+	assert.NoError(t, err)
+	repaired, err := RepairViews(TestPrefix, expected)
+	assert.NoError(t, err)
+	assert.Equal(t, []*View{stale, missing}, repaired)
+	after, err := GetDesignDoc(TestPrefix, doctype, "ok")
+	assert.NoError(t, err)
+	assert.Equal(t, before.Rev, after.Rev)
+
+	invalid, err = VerifyViews(TestPrefix, expected)
+	assert.NoError(t, err)
+	assert.Empty(t, invalid)
 }
 
-func TestJSONDocClone(t *testing.T) {
-	var m map[string]interface{}
-	data := []byte(`{
-	"foo1": "bar",
-	"foo2": [0,1,2,3],
-	"foo3": ["abc", 1, 1.1],
-	"foo4": {
-		"bar1":"bar",
-		"bar2": [0,1,2,3],
-		"bar3": ["abc", 1, 1.1, { "key": "value", "key2": [{}, 1, 2, 3] }],
-		"bar4": {}
-	},
-	"foo5": 1,
-	"foo6": 0.001,
-	"foo7": "toto"
-}`)
+func TestCancelViewBuild(t *testing.T) {
+	view := &View{
+		Name:    "cancel-build",
+		Doctype: TestDoctype,
+		Map:     `function(doc) { emit(doc.test); }`,
+	}
+	assert.NoError(t, DefineViews(TestPrefix, []*View{view}))
+	before, err := GetDesignDoc(TestPrefix, TestDoctype, "cancel-build")
+	assert.NoError(t, err)
 
-	err := json.Unmarshal(data, &m)
+	err = CancelViewBuild(TestPrefix, TestDoctype, "cancel-build", false)
+	assert.Error(t, err)
+	err = CancelViewBuild(TestPrefix, TestDoctype, "_design/cancel-build", true)
 	assert.NoError(t, err)
-	j1 := JSONDoc{
-		Type: "toto",
-		M:    m,
+
+	after, err := GetDesignDoc(TestPrefix, TestDoctype, "cancel-build")
+	assert.NoError(t, err)
+	assert.NotEqual(t, before.Rev, after.Rev)
+	assert.True(t, equalViews(before, after))
+}
+
+func TestOnEvent(t *testing.T) {
+	var verbs []string
+	var olds []Doc
+	OnEvent(TestDoctype, func(db prefixer.Prefixer, verb string, doc, old Doc) {
+		verbs = append(verbs, verb)
+		olds = append(olds, old)
+	})
+	defer OnEvent(TestDoctype, nil)
+
+	doc := &testDoc{Test: "observed"}
+	assert.NoError(t, CreateDoc(TestPrefix, doc))
+	doc.Test = "observed again"
+	assert.NoError(t, UpdateDoc(TestPrefix, doc))
+	assert.Equal(t, []string{realtime.EventCreate, realtime.EventUpdate}, verbs)
+	assert.Nil(t, olds[0])
+	if assert.NotNil(t, olds[1]) {
+		assert.Equal(t, "observed", olds[1].(*testDoc).Test)
 	}
-	j2 := j1.Clone().(*JSONDoc)
+}
 
-	assert.Equal(t, j1.Type, j2.Type)
-	assert.True(t, reflect.DeepEqual(j1.M, j2.M))
+type recordingSink struct {
+	verbs []string
+}
 
-	assert.False(t, reflect.ValueOf(j1.M["foo2"]).Pointer() == reflect.ValueOf(j2.M["foo2"]).Pointer())
-	assert.False(t, reflect.ValueOf(j1.M["foo3"]).Pointer() == reflect.ValueOf(j2.M["foo3"]).Pointer())
-	assert.False(t, reflect.ValueOf(j1.M["foo4"]).Pointer() == reflect.ValueOf(j2.M["foo4"]).Pointer())
+func (s *recordingSink) OnWrite(db prefixer.Prefixer, verb string, doctype string, doc Doc) {
+	if doctype == TestDoctype {
+		s.verbs = append(s.verbs, verb)
+	}
+}
 
-	s1 := j1.M["foo1"].(string)
-	s2 := j2.M["foo1"].(string)
-	s3 := j1.M["foo7"].(string)
-	s4 := j2.M["foo7"].(string)
+func TestWriteSink(t *testing.T) {
+	sink := &recordingSink{}
+	SetWriteSink(sink)
+	defer SetWriteSink(nil)
 
-	hdr1 := (*reflect.StringHeader)(unsafe.Pointer(&s1))
-	hdr2 := (*reflect.StringHeader)(unsafe.Pointer(&s2))
-	hdr3 := (*reflect.StringHeader)(unsafe.Pointer(&s3))
-	hdr4 := (*reflect.StringHeader)(unsafe.Pointer(&s4))
+	doc := &testDoc{Test: "teed"}
+	assert.NoError(t, CreateDoc(TestPrefix, doc))
+	doc.Test = "teed again"
+	assert.NoError(t, UpdateDoc(TestPrefix, doc))
+	assert.NoError(t, DeleteDoc(TestPrefix, doc))
+	expected := []string{realtime.EventCreate, realtime.EventUpdate, realtime.EventDelete}
+	assert.Equal(t, expected, sink.verbs)
 
-	assert.Equal(t, hdr1.Data, hdr2.Data)
-	assert.Equal(t, hdr1.Len, hdr2.Len)
+	err := UpdateDoc(TestPrefix, doc)
+	assert.Error(t, err)
+	assert.Len(t, sink.verbs, 3)
+
+	// The bulk writes are also sent to the sink
+	bulk := &testDoc{Test: "teed in bulk"}
+	assert.NoError(t, BulkUpdateDocs(TestPrefix, TestDoctype, []interface{}{bulk}, []interface{}{nil}))
+	assert.NoError(t, BulkDeleteDocs(TestPrefix, TestDoctype, []Doc{bulk}))
+	expected = append(expected, realtime.EventCreate, realtime.EventDelete)
+	assert.Equal(t, expected, sink.verbs)
+}
 
-	assert.Equal(t, hdr3.Data, hdr4.Data)
-	assert.Equal(t, hdr3.Len, hdr4.Len)
+func TestBulkDeleteDocsEscaping(t *testing.T) {
+	var sent []map[string]interface{}
+	defer withFakeCouch(t, func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			Docs []map[string]interface{} `json:"docs"`
+		}
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&body))
+		sent = body.Docs
+		w.WriteHeader(http.StatusCreated)
+		_, _ = w.Write([]byte(`[{"ok":true,"id":"a\"b\\c","rev":"2-abc"}]`))
+	})()
+
+	doc := &testDoc{TestID: `a"b\c`, TestRev: "1-abc"}
+	assert.NoError(t, BulkDeleteDocs(TestPrefix, TestDoctype, []Doc{doc}))
+	if assert.Len(t, sent, 1) {
+		assert.Equal(t, `a"b\c`, sent[0]["_id"])
+		assert.Equal(t, "1-abc", sent[0]["_rev"])
+		assert.Equal(t, true, sent[0]["_deleted"])
+	}
+	assert.Equal(t, "2-abc", doc.Rev())
+}
 
-	assert.NotEqual(t, hdr1.Data, hdr4.Data)
-	assert.NotEqual(t, hdr1.Len, hdr4.Len)
+func TestDeleteDocByID(t *testing.T) {
+	doc := &testDoc{Test: "delete by id"}
+	assert.NoError(t, CreateDoc(TestPrefix, doc))
+	assertGotEvent(t, realtime.EventCreate, doc.ID())
+
+	err := DeleteDocByID(TestPrefix, TestDoctype, doc.ID(), "1-123")
+	assert.True(t, IsConflictError(err))
+
+	err = DeleteDocByID(TestPrefix, TestDoctype, doc.ID(), doc.Rev())
+	assert.NoError(t, err)
+	evt := assertGotEvent(t, realtime.EventDelete, doc.ID())
+	assert.Equal(t, true, evt.Doc.(*JSONDoc).Get("_deleted"))
+
+	err = GetDoc(TestPrefix, TestDoctype, doc.ID(), &testDoc{})
+	assert.True(t, IsNotFoundError(err))
 }
 
-func TestLocalDocuments(t *testing.T) {
-	id := "foo"
-	_, err := GetLocal(TestPrefix, TestDoctype, id)
+func TestGetDocRaw(t *testing.T) {
+	doc := &testDoc{Test: "raw"}
+	assert.NoError(t, CreateDoc(TestPrefix, doc))
+
+	raw, err := GetDocRaw(TestPrefix, TestDoctype, doc.ID())
+	assert.NoError(t, err)
+	var fetched testDoc
+	assert.NoError(t, json.Unmarshal(raw, &fetched))
+	assert.Equal(t, doc.Rev(), fetched.Rev())
+	assert.Equal(t, "raw", fetched.Test)
+
+	_, err = GetDocRaw(TestPrefix, TestDoctype, "no-such-doc")
 	assert.True(t, IsNotFoundError(err))
+}
 
-	doc := map[string]interface{}{"bar": "baz"}
-	err = PutLocal(TestPrefix, TestDoctype, id, doc)
+func TestUpsertMerge(t *testing.T) {
+	doc := &JSONDoc{Type: TestDoctype, M: map[string]interface{}{
+		"_id":    "upsert-merge",
+		"fieldA": "a",
+		"fieldB": "b",
+	}}
+	assert.NoError(t, UpsertMerge(TestPrefix, doc))
+	assert.NotEmpty(t, doc.Rev())
+
+	patch := &JSONDoc{Type: TestDoctype, M: map[string]interface{}{
+		"_id":    "upsert-merge",
+		"fieldB": "B",
+		"fieldC": "C",
+	}}
+	assert.NoError(t, UpsertMerge(TestPrefix, patch))
+	assert.NotEqual(t, doc.Rev(), patch.Rev())
+
+	var fetched JSONDoc
+	assert.NoError(t, GetDoc(TestPrefix, TestDoctype, "upsert-merge", &fetched))
+	assert.Equal(t, patch.Rev(), fetched.Rev())
+	assert.Equal(t, "a", fetched.Get("fieldA"))
+	assert.Equal(t, "B", fetched.Get("fieldB"))
+	assert.Equal(t, "C", fetched.Get("fieldC"))
+}
+
+func TestFindOrCreate(t *testing.T) {
+	err := DefineIndex(TestPrefix, mango.IndexOnFields(TestDoctype, "find-or-create", []string{"test"}))
 	assert.NoError(t, err)
-	assert.NotEmpty(t, doc["_rev"])
+	selector := mango.Equal("test", "find-or-create")
 
-	out, err := GetLocal(TestPrefix, TestDoctype, id)
+	doc, created, err := FindOrCreate(TestPrefix, TestDoctype, selector, &testDoc{Test: "find-or-create"})
 	assert.NoError(t, err)
-	assert.Equal(t, "baz", out["bar"])
+	assert.True(t, created)
+	assert.NotEmpty(t, doc.ID())
 
-	err = DeleteLocal(TestPrefix, TestDoctype, id)
+	found, created, err := FindOrCreate(TestPrefix, TestDoctype, selector, &testDoc{Test: "find-or-create"})
 	assert.NoError(t, err)
+	assert.False(t, created)
+	assert.Equal(t, doc.ID(), found.ID())
+	assert.Equal(t, "find-or-create", found.(*testDoc).Test)
 
-	_, err = GetLocal(TestPrefix, TestDoctype, id)
-	assert.True(t, IsNotFoundError(err))
+	named := &testDoc{TestID: doc.ID(), Test: "find-or-create"}
+	found, created, err = FindOrCreate(TestPrefix, TestDoctype, mango.Equal("test", "other"), named)
+	assert.Error(t, err)
+	assert.False(t, created)
+	assert.Nil(t, found)
 }
 
-func assertGotEvent(t *testing.T, eventType, id string) *realtime.Event {
-	t.Helper()
+func TestDeleteBySelector(t *testing.T) {
+	err := DefineIndex(TestPrefix, mango.IndexOnFields(TestDoctype, "delete-by-selector", []string{"fieldA"}))
+	assert.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		assert.NoError(t, CreateDoc(TestPrefix, &testDoc{FieldA: "to-delete"}))
+	}
+	kept := &testDoc{FieldA: "to-keep"}
+	assert.NoError(t, CreateDoc(TestPrefix, kept))
 
-	var event *realtime.Event
-	var ok bool
+	deleted, err := DeleteBySelector(TestPrefix, TestDoctype, mango.Equal("fieldA", "to-delete"))
+	assert.NoError(t, err)
+	assert.Equal(t, 3, deleted)
 
-	for i := 0; i < 200; i++ {
-		receivedEventsMutex.Lock()
-		event, ok = receivedEvents[eventType+id]
-		receivedEventsMutex.Unlock()
-		if ok {
-			delete(receivedEvents, eventType+id)
-			break
+	var results []*testDoc
+	req := &FindRequest{Selector: mango.Equal("fieldA", "to-delete")}
+	assert.NoError(t, FindDocs(TestPrefix, TestDoctype, req, &results))
+	assert.Empty(t, results)
+	assert.NoError(t, GetDoc(TestPrefix, TestDoctype, kept.ID(), &testDoc{}))
+}
+
+func TestExpireDocs(t *testing.T) {
+	err := DefineIndex(TestPrefix, mango.IndexOnFields(TestDoctype, "by-expires-at", []string{"expires_at"}))
+	assert.NoError(t, err)
+	now := time.Now()
+	for _, d := range []time.Duration{-2 * time.Hour, -time.Hour, -time.Millisecond, time.Hour} {
+		doc := &JSONDoc{Type: TestDoctype, M: map[string]interface{}{
+			"expires_at": now.Add(d).UTC().Format(ExpiryTimeLayout),
+		}}
+		assert.NoError(t, CreateDoc(TestPrefix, doc))
+	}
+	kept := []interface{}{nil, 0, false}
+	for _, value := range kept {
+		doc := &JSONDoc{Type: TestDoctype, M: map[string]interface{}{"expires_at": value}}
+		assert.NoError(t, CreateDoc(TestPrefix, doc))
+	}
+
+	deleted, err := ExpireDocs(TestPrefix, TestDoctype, "expires_at", now)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, deleted)
+	deleted, err = ExpireDocs(TestPrefix, TestDoctype, "expires_at", now)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, deleted)
+
+	var remaining []*JSONDoc
+	req := &FindRequest{Selector: mango.Lt("expires_at", "")}
+	assert.NoError(t, FindDocs(TestPrefix, TestDoctype, req, &remaining))
+	assert.Len(t, remaining, len(kept))
+}
+
+func TestStreamAllDocs(t *testing.T) {
+	view := &View{
+		Name:    "stream",
+		Doctype: TestDoctype,
+		Map:     `function(doc) { emit(doc.test); }`,
+	}
+	assert.NoError(t, DefineViews(TestPrefix, []*View{view}))
+	doc := &testDoc{Test: "stream"}
+	assert.NoError(t, CreateDoc(TestPrefix, doc))
+
+	revs := make(map[string]string)
+	err := StreamAllDocs(TestPrefix, TestDoctype, false, func(id, rev string, raw json.RawMessage) error {
+		revs[id] = rev
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, doc.Rev(), revs[doc.ID()])
+	assert.NotContains(t, revs, "_design/stream")
+
+	err = StreamAllDocs(TestPrefix, TestDoctype, true, func(id, rev string, raw json.RawMessage) error {
+		revs[id] = rev
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Contains(t, revs, "_design/stream")
+}
+
+func TestChangedDocsSince(t *testing.T) {
+	doctype := "io.cozy.tests.changedsince"
+	defer func() { _ = DeleteDB(TestPrefix, doctype) }()
+	assert.NoError(t, ResetDB(TestPrefix, doctype))
+
+	doc1 := &JSONDoc{Type: doctype, M: map[string]interface{}{"n": 1}}
+	assert.NoError(t, CreateDoc(TestPrefix, doc1))
+	doc2 := &JSONDoc{Type: doctype, M: map[string]interface{}{"n": 2}}
+	assert.NoError(t, CreateDoc(TestPrefix, doc2))
+
+	var ids []string
+	collect := func(raw json.RawMessage) error {
+		ids = append(ids, rawDocID(raw))
+		return nil
+	}
+	seq, err := ChangedDocsSince(TestPrefix, doctype, "", collect)
+	assert.NoError(t, err)
+	assert.NotEmpty(t, seq)
+	assert.ElementsMatch(t, []string{doc1.ID(), doc2.ID()}, ids)
+
+	doc3 := &JSONDoc{Type: doctype, M: map[string]interface{}{"n": 3}}
+	assert.NoError(t, CreateDoc(TestPrefix, doc3))
+	assert.NoError(t, DeleteDoc(TestPrefix, doc1))
+
+	ids = nil
+	next, err := ChangedDocsSince(TestPrefix, doctype, seq, collect)
+	assert.NoError(t, err)
+	assert.NotEqual(t, seq, next)
+	assert.Equal(t, []string{doc3.ID()}, ids)
+
+	ids = nil
+	_, err = ChangedDocsWithTombstonesSince(TestPrefix, doctype, seq, collect)
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{doc1.ID(), doc3.ID()}, ids)
+}
+
+func TestRunConcurrently(t *testing.T) {
+	SetMaxConcurrency(2)
+	defer SetMaxConcurrency(0)
+
+	var mu sync.Mutex
+	var running, maxRunning int
+	err := runConcurrently(context.Background(), 10, func(i int) error {
+		mu.Lock()
+		running++
+		if running > maxRunning {
+			maxRunning = running
 		}
-		time.Sleep(time.Millisecond)
+		mu.Unlock()
+		time.Sleep(5 * time.Millisecond)
+		mu.Lock()
+		running--
+		mu.Unlock()
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 2, maxRunning)
+
+	err = runConcurrently(context.Background(), 10, func(i int) error {
+		if i == 3 {
+			return errors.New("failed")
+		}
+		return nil
+	})
+	assert.EqualError(t, err, "failed")
+
+	// The nested calls have their own limit
+	var calls int32
+	err = runConcurrently(context.Background(), 4, func(i int) error {
+		return runConcurrently(context.Background(), 4, func(j int) error {
+			atomic.AddInt32(&calls, 1)
+			return nil
+		})
+	})
+	assert.NoError(t, err)
+	assert.EqualValues(t, 16, atomic.LoadInt32(&calls))
+}
+
+func TestGetDocFromNode(t *testing.T) {
+	defer withFakeCouch(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/_membership" {
+			_, _ = w.Write([]byte(`{
+				"all_nodes": ["couchdb@127.0.0.1"],
+				"cluster_nodes": ["couchdb@127.0.0.1", "couchdb@couchdb-2"]
+			}`))
+			return
+		}
+		assert.Equal(t, "1", r.URL.Query().Get("r"))
+		_, _ = w.Write([]byte(`{"_id": "from-node", "_rev": "1-abc", "test": "from node"}`))
+	})()
+
+	var fetched testDoc
+	assert.NoError(t, GetDocFromNode(TestPrefix, TestDoctype, "from-node", config.CouchURL().String(), &fetched))
+	assert.Equal(t, "1-abc", fetched.Rev())
+
+	err := GetDocFromNode(TestPrefix, TestDoctype, "from-node", "not-a-node", &fetched)
+	assert.Error(t, err)
+	err = GetDocFromNode(TestPrefix, TestDoctype, "from-node", "http://attacker.example/", &fetched)
+	assert.Error(t, err)
+}
+
+func TestGetDocCoalesced(t *testing.T) {
+	doc := &testDoc{Test: "hot"}
+	assert.NoError(t, CreateDoc(TestPrefix, doc))
+
+	var wg sync.WaitGroup
+	fetched := make([]testDoc, 10)
+	for i := range fetched {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			assert.NoError(t, GetDocCoalesced(TestPrefix, TestDoctype, doc.ID(), &fetched[i]))
+		}(i)
+	}
+	wg.Wait()
+	for _, f := range fetched {
+		assert.Equal(t, "hot", f.Test)
+		assert.Equal(t, doc.Rev(), f.Rev())
 	}
 
-	assert.True(t, ok, "Expected event %s:%s", eventType, id)
-	return event
+	var missing testDoc
+	err := GetDocCoalesced(TestPrefix, TestDoctype, "no-such-doc", &missing)
+	assert.True(t, IsNotFoundError(err))
+}
+
+func TestUpdateDocWithoutOld(t *testing.T) {
+	doc := &testDoc{Test: "before"}
+	assert.NoError(t, CreateDoc(TestPrefix, doc))
+	rev := doc.Rev()
+
+	doc.Test = "after"
+	assert.NoError(t, UpdateDocWithoutOld(TestPrefix, doc))
+	assert.NotEqual(t, rev, doc.Rev())
+
+	var fetched testDoc
+	assert.NoError(t, GetDoc(TestPrefix, TestDoctype, doc.ID(), &fetched))
+	assert.Equal(t, "after", fetched.Test)
+}
+
+func TestBulkUpdateConditional(t *testing.T) {
+	doc1 := &testDoc{Test: "one"}
+	doc2 := &testDoc{Test: "two"}
+	assert.NoError(t, CreateDoc(TestPrefix, doc1))
+	assert.NoError(t, CreateDoc(TestPrefix, doc2))
+	rev1 := doc1.Rev()
+
+	// doc2 is modified concurrently
+	concurrent := &testDoc{TestID: doc2.ID(), TestRev: doc2.Rev(), Test: "other"}
+	assert.NoError(t, UpdateDoc(TestPrefix, concurrent))
+
+	doc1.Test = "one bis"
+	doc2.Test = "two bis"
+	stale, err := BulkUpdateConditional(TestPrefix, TestDoctype, []Doc{doc1, doc2})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{doc2.ID()}, stale)
+	assert.NotEqual(t, rev1, doc1.Rev())
+}
+
+func TestGetDocHistory(t *testing.T) {
+	doc := &testDoc{Test: "v1"}
+	assert.NoError(t, CreateDoc(TestPrefix, doc))
+	doc.Test = "v2"
+	assert.NoError(t, UpdateDoc(TestPrefix, doc))
+	doc.Test = "v3"
+	assert.NoError(t, UpdateDoc(TestPrefix, doc))
+
+	history, err := GetDocHistory(TestPrefix, TestDoctype, doc.ID(), 2)
+	assert.NoError(t, err)
+	if assert.Len(t, history, 2) {
+		var v testDoc
+		assert.NoError(t, json.Unmarshal(history[0], &v))
+		assert.Equal(t, "v3", v.Test)
+		assert.NoError(t, json.Unmarshal(history[1], &v))
+		assert.Equal(t, "v2", v.Test)
+	}
+
+	history, err = GetDocHistory(TestPrefix, TestDoctype, doc.ID(), 0)
+	assert.NoError(t, err)
+	assert.Len(t, history, 3)
+}
+
+func TestGetDocWithDeletionInfo(t *testing.T) {
+	doc := &testDoc{TestID: "reused-id", Test: "first"}
+	assert.NoError(t, CreateNamedDoc(TestPrefix, doc))
+	got, wasDeleted, err := GetDocWithDeletionInfo(TestPrefix, TestDoctype, doc.ID())
+	assert.NoError(t, err)
+	assert.False(t, wasDeleted)
+	assert.Equal(t, "first", got.Get("test"))
+	assert.Nil(t, got.Get("_revs_info"))
+
+	assert.NoError(t, DeleteDoc(TestPrefix, doc))
+	doc = &testDoc{TestID: "reused-id", Test: "second"}
+	assert.NoError(t, CreateNamedDoc(TestPrefix, doc))
+	got, wasDeleted, err = GetDocWithDeletionInfo(TestPrefix, TestDoctype, doc.ID())
+	assert.NoError(t, err)
+	assert.True(t, wasDeleted)
+	assert.Equal(t, "second", got.Get("test"))
+}
+
+func TestMaintenanceLock(t *testing.T) {
+	release, err := AcquireMaintenanceLock(TestPrefix, TestDoctype, "alice", time.Minute)
+	assert.NoError(t, err)
+	_, err = AcquireMaintenanceLock(TestPrefix, TestDoctype, "bob", time.Minute)
+	assert.True(t, IsMaintenanceLockedError(err))
+	release()
+
+	release, err = AcquireMaintenanceLock(TestPrefix, TestDoctype, "bob", -time.Second)
+	assert.NoError(t, err)
+	_, err = AcquireMaintenanceLock(TestPrefix, TestDoctype, "alice", time.Minute)
+	assert.NoError(t, err, "an expired lock can be taken")
+	release()
+	_, err = AcquireMaintenanceLock(TestPrefix, TestDoctype, "bob", time.Minute)
+	assert.True(t, IsMaintenanceLockedError(err), "bob cannot release the lock of alice")
+	assert.NoError(t, DeleteLocal(TestPrefix, TestDoctype, maintenanceLockID))
+}
+
+func TestListConflicts(t *testing.T) {
+	doctype := "io.cozy.tests.conflicts"
+	assert.NoError(t, ResetDB(TestPrefix, doctype))
+	defer func() { _ = DeleteDB(TestPrefix, doctype) }()
+	doc := &JSONDoc{Type: doctype, M: map[string]interface{}{"_id": "conflicted", "v": 1}}
+	assert.NoError(t, CreateNamedDoc(TestPrefix, doc))
+	other := &JSONDoc{Type: doctype, M: map[string]interface{}{"_id": "clean", "v": 1}}
+	assert.NoError(t, CreateNamedDoc(TestPrefix, other))
+
+	conflicts, err := ListConflicts(TestPrefix, doctype)
+	assert.NoError(t, err)
+	assert.Empty(t, conflicts)
+
+	forced := map[string]interface{}{"_id": "conflicted", "_rev": "1-0123456789abcdef", "v": 2}
+	assert.NoError(t, BulkForceUpdateDocs(TestPrefix, doctype, []map[string]interface{}{forced}))
+	conflicts, err = ListConflicts(TestPrefix, doctype)
+	assert.NoError(t, err)
+	if assert.Len(t, conflicts, 1) {
+		assert.Equal(t, "conflicted", conflicts[0].ID)
+		assert.NotEmpty(t, conflicts[0].Rev)
+		assert.Len(t, conflicts[0].Conflicts, 1)
+	}
+}
+
+func TestInspectDoc(t *testing.T) {
+	doctype := "io.cozy.tests.inspect"
+	assert.NoError(t, ResetDB(TestPrefix, doctype))
+	defer func() { _ = DeleteDB(TestPrefix, doctype) }()
+	doc := &JSONDoc{Type: doctype, M: map[string]interface{}{"_id": "inspected", "v": 1}}
+	assert.NoError(t, CreateNamedDoc(TestPrefix, doc))
+
+	forced := map[string]interface{}{"_id": "inspected", "_rev": "1-0123456789abcdef", "v": 2}
+	assert.NoError(t, BulkForceUpdateDocs(TestPrefix, doctype, []map[string]interface{}{forced}))
+	inspection, err := InspectDoc(TestPrefix, doctype, "inspected")
+	assert.NoError(t, err)
+	assert.Equal(t, "inspected", inspection.Doc.ID())
+	assert.Equal(t, doctype, inspection.Doc.DocType())
+	assert.NotContains(t, inspection.Doc.M, "_conflicts")
+	assert.NotContains(t, inspection.Doc.M, "_revs_info")
+	assert.Len(t, inspection.Conflicts, 1)
+	assert.Empty(t, inspection.DeletedConflicts)
+	if assert.NotEmpty(t, inspection.RevsInfo) {
+		assert.Equal(t, inspection.Doc.Rev(), inspection.RevsInfo[0].Rev)
+		assert.Equal(t, "available", inspection.RevsInfo[0].Status)
+	}
+
+	loser := &JSONDoc{Type: doctype, M: map[string]interface{}{
+		"_id":  "inspected",
+		"_rev": inspection.Conflicts[0],
+	}}
+	assert.NoError(t, DeleteDoc(TestPrefix, loser))
+	inspection, err = InspectDoc(TestPrefix, doctype, "inspected")
+	assert.NoError(t, err)
+	assert.Empty(t, inspection.Conflicts)
+	assert.Len(t, inspection.DeletedConflicts, 1)
+
+	_, err = InspectDoc(TestPrefix, doctype, "missing")
+	assert.True(t, IsNotFoundError(err))
+}
+
+func TestDocsNearRevsLimit(t *testing.T) {
+	doctype := "io.cozy.tests.revslimit"
+	assert.NoError(t, ResetDB(TestPrefix, doctype))
+	defer func() { _ = DeleteDB(TestPrefix, doctype) }()
+	hot := &JSONDoc{Type: doctype, M: map[string]interface{}{"n": 0}}
+	assert.NoError(t, CreateDoc(TestPrefix, hot))
+	for i := 1; i < 5; i++ {
+		hot.M["n"] = i
+		assert.NoError(t, UpdateDoc(TestPrefix, hot))
+	}
+	cold := &JSONDoc{Type: doctype, M: map[string]interface{}{"n": 0}}
+	assert.NoError(t, CreateDoc(TestPrefix, cold))
+
+	ids, err := DocsNearRevsLimit(TestPrefix, doctype, 5)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{hot.ID()}, ids)
+	ids, err = DocsNearRevsLimit(TestPrefix, doctype, 6)
+	assert.NoError(t, err)
+	assert.Empty(t, ids)
+	_, err = DocsNearRevsLimit(TestPrefix, doctype, 0)
+	assert.Error(t, err)
+
+	assert.Equal(t, 12, revGeneration("12-abcdef"))
+	assert.Equal(t, 0, revGeneration("invalid"))
+}
+
+func TestBulkGetMixed(t *testing.T) {
+	albums := "io.cozy.tests.albums"
+	assert.NoError(t, ResetDB(TestPrefix, albums))
+	defer func() { _ = DeleteDB(TestPrefix, albums) }()
+	album := &JSONDoc{Type: albums, M: map[string]interface{}{"name": "holidays"}}
+	assert.NoError(t, CreateDoc(TestPrefix, album))
+	doc := &testDoc{Test: "mixed"}
+	assert.NoError(t, CreateDoc(TestPrefix, doc))
+
+	refs := []DocReference{
+		{Type: albums, ID: album.ID()},
+		{Type: TestDoctype, ID: doc.ID()},
+		{Type: albums, ID: "missing"},
+		{Type: "io.cozy.tests.nodb", ID: "nodb"},
+	}
+	out := make(map[string][]json.RawMessage)
+	missing, err := BulkGetMixed(TestPrefix, refs, out)
+	assert.NoError(t, err)
+	assert.Equal(t, refs[2:], missing)
+	if assert.Len(t, out[albums], 1) {
+		assert.Equal(t, album.ID(), rawDocID(out[albums][0]))
+	}
+	if assert.Len(t, out[TestDoctype], 1) {
+		assert.Equal(t, doc.ID(), rawDocID(out[TestDoctype][0]))
+	}
+}
+
+func TestAddReferenceToDocs(t *testing.T) {
+	doctype := "io.cozy.tests.refs"
+	assert.NoError(t, ResetDB(TestPrefix, doctype))
+	defer func() { _ = DeleteDB(TestPrefix, doctype) }()
+	ref := DocReference{Type: "io.cozy.photos.albums", ID: "album1"}
+	tagged := &JSONDoc{Type: doctype, M: map[string]interface{}{
+		"referenced_by": []interface{}{map[string]interface{}{"type": ref.Type, "id": ref.ID}},
+	}}
+	assert.NoError(t, CreateDoc(TestPrefix, tagged))
+	untagged := &JSONDoc{Type: doctype, M: map[string]interface{}{}}
+	assert.NoError(t, CreateDoc(TestPrefix, untagged))
+
+	ids := []string{tagged.ID(), untagged.ID(), "missing"}
+	assert.NoError(t, AddReferenceToDocs(TestPrefix, doctype, ids, ref))
+
+	for _, id := range []string{tagged.ID(), untagged.ID()} {
+		var doc JSONDoc
+		assert.NoError(t, GetDoc(TestPrefix, doctype, id, &doc))
+		assert.Equal(t, []string{"io.cozy.photos.albums/album1"}, doc.Fetch(SelectorReferencedBy))
+	}
+	var doc JSONDoc
+	assert.NoError(t, GetDoc(TestPrefix, doctype, tagged.ID(), &doc))
+	assert.Equal(t, tagged.Rev(), doc.Rev(), "the document with the reference is not updated")
+
+	referencing, err := FindReferencing(TestPrefix, doctype, ref)
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{tagged.ID(), untagged.ID()}, referencing)
+	referencing, err = FindReferencing(TestPrefix, doctype, DocReference{Type: ref.Type, ID: "album2"})
+	assert.NoError(t, err)
+	assert.Empty(t, referencing)
+}
+
+func TestSetValidationFunction(t *testing.T) {
+	doctype := "io.cozy.tests.validation"
+	defer func() { _ = DeleteDB(TestPrefix, doctype) }()
+	assert.NoError(t, ResetDB(TestPrefix, doctype))
+
+	fn := `function(newDoc, oldDoc, userCtx) {
+		if (newDoc._id.indexOf("_design/") !== 0 && !newDoc._deleted && !newDoc.name) {
+			throw({forbidden: "name is required"});
+		}
+	}`
+	assert.NoError(t, SetValidationFunction(TestPrefix, doctype, fn))
+
+	doc := &JSONDoc{Type: doctype, M: map[string]interface{}{"foo": "bar"}}
+	err := CreateDoc(TestPrefix, doc)
+	assert.True(t, IsForbiddenError(err))
+
+	doc = &JSONDoc{Type: doctype, M: map[string]interface{}{"name": "ok"}}
+	assert.NoError(t, CreateDoc(TestPrefix, doc))
+
+	assert.NoError(t, SetValidationFunction(TestPrefix, doctype, ""))
+	doc = &JSONDoc{Type: doctype, M: map[string]interface{}{"foo": "bar"}}
+	assert.NoError(t, CreateDoc(TestPrefix, doc))
+}
+
+func TestExecUpdate(t *testing.T) {
+	fn := `function(doc, req) {
+  if (!doc) { return [null, "missing"]; }
+  doc.counter = (doc.counter || 0) + parseInt(req.query.by || "1", 10);
+  return [doc, "incremented"];
+}`
+	assert.NoError(t, DefineUpdateFunction(TestPrefix, TestDoctype, "updates", "increment", fn))
+	assert.NoError(t, DefineUpdateFunction(TestPrefix, TestDoctype, "_design/updates", "increment", fn))
+
+	doc := &JSONDoc{Type: TestDoctype, M: map[string]interface{}{"counter": 1}}
+	assert.NoError(t, CreateDoc(TestPrefix, doc))
+	res, err := ExecUpdate(TestPrefix, TestDoctype, "updates", "increment", doc.ID(), map[string]string{"by": "2"})
+	assert.NoError(t, err)
+	assert.Equal(t, doc.ID(), res.ID)
+	assert.NotEqual(t, doc.Rev(), res.Rev)
+
+	var updated JSONDoc
+	assert.NoError(t, GetDoc(TestPrefix, TestDoctype, doc.ID(), &updated))
+	assert.Equal(t, float64(3), updated.M["counter"])
+	assert.Equal(t, res.Rev, updated.Rev())
+	evt := assertGotEvent(t, realtime.EventUpdate, doc.ID())
+	if assert.NotNil(t, evt) {
+		assert.Equal(t, float64(3), evt.Doc.(*JSONDoc).M["counter"])
+	}
+
+	// Nothing is written for a missing document
+	res, err = ExecUpdate(TestPrefix, TestDoctype, "updates", "increment", "missing", nil)
+	assert.NoError(t, err)
+	assert.False(t, res.Ok)
+	assert.Empty(t, res.Rev)
+}
+
+func TestDoctypeFromDBName(t *testing.T) {
+	knownDoctypesMu.Lock()
+	saved := knownDoctypes
+	knownDoctypes = nil
+	knownDoctypesMu.Unlock()
+	defer func() {
+		knownDoctypesMu.Lock()
+		knownDoctypes = saved
+		knownDoctypesMu.Unlock()
+	}()
+
+	db := newDatabase("alice.cozy.tools:8080")
+	doctype, ok := DoctypeFromDBName(db, "alice-cozy-tools-8080/io-cozy-files")
+	assert.True(t, ok)
+	assert.Equal(t, "io.cozy.files", doctype)
+
+	_, ok = DoctypeFromDBName(db, "bob-cozy-tools-8080/io-cozy-files")
+	assert.False(t, ok)
+
+	dbname := EscapeCouchdbName(db.DBPrefix() + "/com.example:Bills")
+	doctype, _ = DoctypeFromDBName(db, dbname)
+	assert.Equal(t, "com.example.bills", doctype)
+	RegisterDoctypes("com.example:Bills")
+	doctype, ok = DoctypeFromDBName(db, dbname)
+	assert.True(t, ok)
+	assert.Equal(t, "com.example:Bills", doctype)
+}
+
+func TestEncodeCouchdbName(t *testing.T) {
+	names := []string{"io.cozy.files", "io.cozy.foo:bar", "io.cozy.foo.bar", "com.Example-app/x_y"}
+	encoded := make(map[string]bool)
+	for _, name := range names {
+		enc := EncodeCouchdbName(name)
+		assert.False(t, encoded[enc])
+		encoded[enc] = true
+		dec, err := DecodeCouchdbName(enc)
+		assert.NoError(t, err)
+		assert.Equal(t, name, dec)
+	}
+	assert.Equal(t, "io-cozy-files", EncodeCouchdbName("io.cozy.files"))
+	assert.Equal(t, "io-cozy-foo(3a)bar", EncodeCouchdbName("io.cozy.foo:bar"))
+	_, err := DecodeCouchdbName("io-cozy-foo(3abar")
+	assert.Error(t, err)
+}
+
+func TestDetectDBNameCollisions(t *testing.T) {
+	collisions := DetectDBNameCollisions([]string{
+		"io.cozy.files",
+		"io.cozy.foo:bar",
+		"io.cozy.contacts",
+		"io.cozy.foo.bar",
+		"io.cozy.Files",
+	})
+	assert.Equal(t, [][]string{
+		{"io.cozy.files", "io.cozy.Files"},
+		{"io.cozy.foo:bar", "io.cozy.foo.bar"},
+	}, collisions)
+	assert.Empty(t, DetectDBNameCollisions([]string{"io.cozy.files", "io.cozy.apps"}))
+}
+
+func TestFindResponseWarnings(t *testing.T) {
+	res := &FindResponse{}
+	assert.Empty(t, res.Warnings())
+
+	res.Warning = "No matching index found, create an index to optimize query time.\n" +
+		"The number of documents examined is high in proportion to the number of results returned."
+	warnings := res.Warnings()
+	if assert.Len(t, warnings, 2) {
+		assert.True(t, warnings[0].IsNoMatchingIndex())
+		assert.False(t, warnings[1].IsNoMatchingIndex())
+	}
+
+	res.Warning = "no matching index found, create an index to optimize query time"
+	assert.True(t, res.Warnings()[0].IsNoMatchingIndex())
+}
+
+func TestSelfTest(t *testing.T) {
+	assert.NoError(t, SelfTest(TestPrefix))
+	assert.NoError(t, SelfTest(TestPrefix))
+}
+
+func TestDecodeStatsView(t *testing.T) {
+	body := `{"rows":[
+{"key":"image","value":{"sum":30,"count":3,"min":5,"max":15,"sumsqr":350}},
+{"key":["2020","01"],"value":{"sum":2.5,"count":1,"min":2.5,"max":2.5,"sumsqr":6.25}}
+]}`
+	var res statsViewResponse
+	assert.NoError(t, json.Unmarshal([]byte(body), &res))
+	stats, err := res.decode()
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]ReduceStatsValue{
+		"image":         {Sum: 30, Count: 3, Min: 5, Max: 15, SumSqr: 350},
+		`["2020","01"]`: {Sum: 2.5, Count: 1, Min: 2.5, Max: 2.5, SumSqr: 6.25},
+	}, stats)
+}
+
+func TestDBFragmentation(t *testing.T) {
+	var status DBStatusResponse
+	assert.Equal(t, 0.0, status.fragmentation())
+	status.Sizes.File = 1000
+	status.Sizes.Active = 250
+	assert.Equal(t, 0.75, status.fragmentation())
+	status.Sizes.Active = 1200
+	assert.Equal(t, 0.0, status.fragmentation())
+
+	frag, err := DBFragmentation(TestPrefix, TestDoctype)
+	assert.NoError(t, err)
+	assert.True(t, frag >= 0 && frag < 1)
+}
+
+func TestAutoCompact(t *testing.T) {
+	assert.NoError(t, CompactDB(TestPrefix, TestDoctype))
+
+	compacted, err := AutoCompact(TestPrefix, 1)
+	assert.NoError(t, err)
+	assert.Empty(t, compacted)
+}
+
+func TestCompactInstance(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := CompactInstanceCtx(ctx, TestPrefix)
+	assert.Equal(t, context.Canceled, err)
+
+	doctype := "io.cozy.tests.compact"
+	assert.NoError(t, ResetDB(TestPrefix, doctype))
+	defer func() { _ = DeleteDB(TestPrefix, doctype) }()
+	compacted, err := CompactInstance(TestPrefix)
+	assert.NoError(t, err)
+	assert.Contains(t, compacted, doctype)
+}
+
+func TestIsFullScan(t *testing.T) {
+	stats := &ExecutionStats{TotalDocsExamined: 50000, ResultsReturned: 10}
+	assert.True(t, isFullScan(stats, 100))
+	assert.False(t, isFullScan(stats, 0))
+	assert.False(t, isFullScan(stats, 10000))
+
+	stats = &ExecutionStats{TotalDocsExamined: 500, ResultsReturned: 0}
+	assert.False(t, isFullScan(stats, 100))
+	stats = &ExecutionStats{TotalDocsExamined: 5000, ResultsReturned: 0}
+	assert.True(t, isFullScan(stats, 100))
+}
+
+func TestViewOptions(t *testing.T) {
+	view := &View{
+		Name:    "by-key",
+		Doctype: TestDoctype,
+		Map:     `function(doc) { emit(doc.key); }`,
+		Options: map[string]interface{}{"collation": "raw"},
+	}
+	data, err := json.Marshal(view)
+	assert.NoError(t, err)
+	assert.Contains(t, string(data), `"options":{"collation":"raw"}`)
+
+	var fromCouch View
+	assert.NoError(t, json.Unmarshal(data, &fromCouch))
+	assert.True(t, equalView(view, &fromCouch))
+
+	fromCouch.Options = nil
+	assert.False(t, equalView(view, &fromCouch))
+	view.Options = map[string]interface{}{}
+	assert.True(t, equalView(view, &fromCouch))
+}
+
+func TestBrowseDocs(t *testing.T) {
+	doctype := "io.cozy.tests.browse"
+	assert.NoError(t, ResetDB(TestPrefix, doctype))
+	defer func() { _ = DeleteDB(TestPrefix, doctype) }()
+	for i := 0; i < 3; i++ {
+		doc := &JSONDoc{Type: doctype, M: map[string]interface{}{"n": i}}
+		assert.NoError(t, CreateDoc(TestPrefix, doc))
+	}
+
+	res, err := BrowseDocs(TestPrefix, doctype, "", 2)
+	assert.NoError(t, err)
+	assert.Len(t, res.Docs, 2)
+	assert.Equal(t, doctype, res.Docs[0].DocType())
+	assert.Equal(t, 3, res.Total)
+	assert.Equal(t, 2, res.TotalPages)
+	assert.NotEmpty(t, res.Bookmark)
+
+	first := res.Docs[0].ID()
+	res, err = BrowseDocs(TestPrefix, doctype, res.Bookmark, 2)
+	assert.NoError(t, err)
+	if assert.Len(t, res.Docs, 1) {
+		assert.NotEqual(t, first, res.Docs[0].ID())
+	}
+	assert.Empty(t, res.Bookmark)
+
+	_, err = BrowseDocs(TestPrefix, doctype, "", 0)
+	assert.Error(t, err)
+}
+
+func TestMigrateDoctype(t *testing.T) {
+	doctype := "io.cozy.tests.migrate"
+	assert.NoError(t, ResetDB(TestPrefix, doctype))
+	defer func() { _ = DeleteDB(TestPrefix, doctype) }()
+	for i := 0; i < 5; i++ {
+		doc := &JSONDoc{Type: doctype, M: map[string]interface{}{"version": 1, "n": i}}
+		assert.NoError(t, CreateDoc(TestPrefix, doc))
+	}
+
+	transform := func(doc *JSONDoc) (bool, error) {
+		if doc.M["version"] == float64(2) {
+			return false, nil
+		}
+		if doc.M["n"] == float64(3) {
+			return false, errors.New("invalid doc")
+		}
+		doc.M["version"] = 2
+		return true, nil
+	}
+	count, samples, err := DryRunMigrateDoctype(TestPrefix, doctype, transform, 2)
+	assert.Equal(t, 4, count)
+	if assert.Len(t, samples, 2) {
+		assert.Equal(t, float64(1), samples[0].Before.M["version"])
+		assert.Equal(t, 2, samples[0].After.M["version"])
+	}
+	assert.IsType(t, &MigrationError{}, err)
+
+	migrated, err := MigrateDoctype(TestPrefix, doctype, transform)
+	assert.Equal(t, 4, migrated)
+	if assert.IsType(t, &MigrationError{}, err) {
+		assert.Len(t, err.(*MigrationError).Errors, 1)
+	}
+
+	// The migrated documents are skipped on the second run
+	migrated, _ = MigrateDoctype(TestPrefix, doctype, transform)
+	assert.Equal(t, 0, migrated)
+}
+
+func TestReshardDoctypeResume(t *testing.T) {
+	doctype := "io.cozy.tests.reshard"
+	tmp := doctype + reshardSuffix
+	assert.NoError(t, ResetDB(TestPrefix, doctype))
+	defer func() { _ = DeleteDB(TestPrefix, doctype) }()
+	defer func() { _ = DeleteDB(TestPrefix, tmp) }()
+	doc := &JSONDoc{Type: doctype, M: map[string]interface{}{"n": 1}}
+	assert.NoError(t, CreateDoc(TestPrefix, doc))
+
+	// Simulate an interruption while the documents are replicated back
+	assert.NoError(t, copyDatabase(TestPrefix, doctype, tmp, DBCreateOptions{Q: 2}))
+	assert.NoError(t, setReshardStep(TestPrefix, tmp, reshardCopied))
+	assert.NoError(t, ResetDB(TestPrefix, doctype))
+
+	assert.NoError(t, ReshardDoctype(TestPrefix, doctype, 2))
+	var resharded JSONDoc
+	assert.NoError(t, GetDoc(TestPrefix, doctype, doc.ID(), &resharded))
+	assert.Equal(t, float64(1), resharded.M["n"])
+	_, err := DBStatus(TestPrefix, tmp)
+	assert.True(t, IsNoDatabaseError(err))
+}
+
+func TestRenameDoctype(t *testing.T) {
+	from := "io.cozy.tests.typo"
+	to := "io.cozy.tests.renamed"
+	assert.NoError(t, ResetDB(TestPrefix, from))
+	defer func() { _ = DeleteDB(TestPrefix, from) }()
+	defer func() { _ = DeleteDB(TestPrefix, to) }()
+	doc := &JSONDoc{Type: from, M: map[string]interface{}{"n": 1}}
+	assert.NoError(t, CreateDoc(TestPrefix, doc))
+
+	assert.NoError(t, RenameDoctype(TestPrefix, from, to))
+	_, err := DBStatus(TestPrefix, from)
+	assert.True(t, IsNoDatabaseError(err))
+	var moved JSONDoc
+	assert.NoError(t, GetDoc(TestPrefix, to, doc.ID(), &moved))
+	assert.Equal(t, float64(1), moved.M["n"])
+
+	// It can be called again after an interruption
+	assert.NoError(t, RenameDoctype(TestPrefix, from, to))
+}
+
+func TestMoveDocs(t *testing.T) {
+	from := "io.cozy.tests.movefrom"
+	to := "io.cozy.tests.moveto"
+	assert.NoError(t, ResetDB(TestPrefix, from))
+	defer func() {
+		_ = DeleteDB(TestPrefix, from)
+		_ = DeleteDB(TestPrefix, to)
+	}()
+	var ids []string
+	for i := 0; i < 3; i++ {
+		doc := &JSONDoc{Type: from, M: map[string]interface{}{"n": i}}
+		assert.NoError(t, CreateDoc(TestPrefix, doc))
+		ids = append(ids, doc.ID())
+	}
+
+	assert.NoError(t, MoveDocs(TestPrefix, from, to, ids[:2]))
+	n, err := CountAllDocs(TestPrefix, from)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, n)
+	n, err = CountAllDocs(TestPrefix, to)
+	assert.NoError(t, err)
+	assert.Equal(t, 2, n)
+
+	err = MoveDocs(TestPrefix, from, to, []string{ids[2], "missing"})
+	if assert.IsType(t, &MigrationError{}, err) {
+		assert.Contains(t, err.(*MigrationError).Errors, "missing")
+		assert.Len(t, err.(*MigrationError).Errors, 1)
+	}
+	n, err = CountAllDocs(TestPrefix, to)
+	assert.NoError(t, err)
+	assert.Equal(t, 3, n)
+
+	// The attachments are moved with the document
+	withAtt := &JSONDoc{Type: from, M: map[string]interface{}{
+		"_attachments": map[string]interface{}{
+			"note.txt": map[string]interface{}{
+				"content_type": "text/plain",
+				"data":         base64.StdEncoding.EncodeToString([]byte("hello")),
+			},
+		},
+	}}
+	assert.NoError(t, CreateDoc(TestPrefix, withAtt))
+	assert.NoError(t, MoveDocs(TestPrefix, from, to, []string{withAtt.ID()}))
+	var moved JSONDoc
+	atts := make(map[string]string)
+	assert.NoError(t, GetDocWithAttachments(TestPrefix, to, withAtt.ID(), &moved, collectAttachments(atts)))
+	assert.Equal(t, map[string]string{"note.txt": "hello"}, atts)
+
+	// A different document with the same ID in the target is a collision
+	source := &JSONDoc{Type: from, M: map[string]interface{}{"_id": "collision", "n": 1}}
+	assert.NoError(t, CreateNamedDoc(TestPrefix, source))
+	target := &JSONDoc{Type: to, M: map[string]interface{}{"_id": "collision", "n": 2}}
+	assert.NoError(t, CreateNamedDoc(TestPrefix, target))
+	err = MoveDocs(TestPrefix, from, to, []string{"collision"})
+	if assert.IsType(t, &MigrationError{}, err) {
+		assert.Contains(t, err.(*MigrationError).Errors, "collision")
+	}
+	var kept JSONDoc
+	assert.NoError(t, GetDoc(TestPrefix, from, "collision", &kept))
+}
+
+func TestOrphanDatabases(t *testing.T) {
+	db := newDatabase("alice.cozy.tools:8080")
+	dbs := []string{
+		"alice-cozy-tools-8080/io-cozy-files",
+		"alice-cozy-tools-8080/io-cozy-notes",
+		"alice-cozy-tools-8080/com-example-old",
+		"bob-cozy-tools-8080/com-example-old",
+	}
+	orphans := orphanDBNames(db, dbs, []string{"io.cozy.files", "io.cozy.notes"})
+	assert.Equal(t, []string{"alice-cozy-tools-8080/com-example-old"}, orphans)
+}
+
+func TestViewRequestReduceIsAlwaysSent(t *testing.T) {
+	req := &ViewRequest{Key: "foo"}
+	v, err := req.Values()
+	assert.NoError(t, err)
+	assert.Equal(t, "false", v.Get("reduce"))
+	assert.Equal(t, "false", v.Get("group"))
+	data, err := json.Marshal(req)
+	assert.NoError(t, err)
+	assert.Contains(t, string(data), `"reduce":false`)
+
+	req = &ViewRequest{Reduce: true, Group: true}
+	v, err = req.Values()
+	assert.NoError(t, err)
+	assert.Equal(t, "true", v.Get("reduce"))
+	assert.Equal(t, "true", v.Get("group"))
+}
+
+func TestViewRequestExtra(t *testing.T) {
+	req := &ViewRequest{Key: "foo", Extra: map[string]string{"stable": "true", "update": "lazy"}}
+	v, err := req.Values()
+	assert.NoError(t, err)
+	assert.Equal(t, "true", v.Get("stable"))
+	assert.Equal(t, "lazy", v.Get("update"))
+	assert.Equal(t, `"foo"`, v.Get("key"))
+
+	req = &ViewRequest{Key: "foo", Extra: map[string]string{"key": "bar"}}
+	_, err = req.Values()
+	assert.Error(t, err)
+}
+
+func TestCouchUsers(t *testing.T) {
+	_, err := GetCouchUser(GlobalDB, "no-such-user")
+	assert.True(t, IsNotFoundError(err))
+
+	users, err := ListCouchUsers(GlobalDB)
+	assert.NoError(t, err)
+	for _, user := range users {
+		assert.Equal(t, "user", user.Type)
+	}
+}
+
+func TestEnsureDBExistCtx(t *testing.T) {
+	done := make(chan struct{})
+	defer withFakeCouch(t, func(w http.ResponseWriter, r *http.Request) {
+		<-done
+	})()
+	defer close(done)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err := EnsureDBExistCtx(ctx, TestPrefix, TestDoctype)
+	assert.Equal(t, context.DeadlineExceeded, err)
+}
+
+func TestCreateNamedDocCtxOrigin(t *testing.T) {
+	defer withFakeCouch(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusCreated)
+		_, _ = w.Write([]byte(`{"ok":true,"id":"with-origin","rev":"1-abc"}`))
+	})()
+
+	ctx := realtime.WithOrigin(context.Background(), "drive")
+	doc := &testDoc{TestID: "with-origin", Test: "origin"}
+	assert.NoError(t, CreateNamedDocCtx(ctx, TestPrefix, doc))
+	evt := assertGotEvent(t, realtime.EventCreate, "with-origin")
+	if assert.NotNil(t, evt) {
+		assert.Equal(t, "drive", evt.Origin)
+	}
+}
+
+func TestNewRevFromHeader(t *testing.T) {
+	body := `{"ok":true,"id":"header-only"}`
+	defer withFakeCouch(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Couch-Update-NewRev", "2-abc")
+		w.WriteHeader(http.StatusCreated)
+		_, _ = w.Write([]byte(body))
+	})()
+
+	doc := &testDoc{TestID: "header-only", TestRev: "1-abc", Test: "new rev"}
+	assert.NoError(t, UpdateDocWithOld(TestPrefix, doc, nil))
+	assert.Equal(t, "2-abc", doc.Rev())
+
+	body = ""
+	doc = &testDoc{TestID: "header-only", TestRev: "1-abc", Test: "no body"}
+	assert.NoError(t, UpdateDocWithOld(TestPrefix, doc, nil))
+	assert.Equal(t, "2-abc", doc.Rev())
+}
+
+func TestReplicateDocsValidation(t *testing.T) {
+	source := DatabaseURL(TestPrefix, TestDoctype)
+	target := DatabaseURL(TestPrefix, TestDoctype+".copy")
+	_, err := ReplicateDocs(TestPrefix, source, target, nil)
+	assert.Error(t, err)
+	_, err = ReplicateDocs(TestPrefix, source, target, []string{"foo", ""})
+	assert.Error(t, err)
+	_, err = ReplicateDocs(TestPrefix, source, target, []string{"_design/foo"})
+	assert.Error(t, err)
+}
+
+func TestFindWithoutExecutionStats(t *testing.T) {
+	defer withFakeCouch(t, func(w http.ResponseWriter, r *http.Request) {
+		// An old CouchDB ignores the execution_stats parameter
+		_, _ = w.Write([]byte(`{"docs":[{"_id":"foo","test":"bar"}],"bookmark":"nil"}`))
+	})()
+	config.GetConfig().CouchDB.ExecutionStats = true
+	config.GetConfig().CouchDB.FullScanRatio = 10
+
+	var results []*testDoc
+	req := NewFind(mango.Equal("test", "bar")).ExecutionStats(true).Build()
+	res, err := FindDocsRaw(TestPrefix, TestDoctype, req, &results)
+	assert.NoError(t, err)
+	assert.Nil(t, res.ExecutionStats)
+	assert.Len(t, results, 1)
+	assert.False(t, isFullScan(nil, 10))
+}
+
+func TestFindExecutionStatsOverride(t *testing.T) {
+	var body []byte
+	defer withFakeCouch(t, func(w http.ResponseWriter, r *http.Request) {
+		body, _ = ioutil.ReadAll(r.Body)
+		_, _ = w.Write([]byte(`{"docs":[],"bookmark":"nil"}`))
+	})()
+	config.GetConfig().CouchDB.ExecutionStats = true
+
+	var results []*testDoc
+	req := &FindRequest{Selector: mango.Equal("test", "bar")}
+	assert.NoError(t, FindDocs(TestPrefix, TestDoctype, req, &results))
+	assert.Contains(t, string(body), `"execution_stats":true`)
+	assert.Nil(t, req.ExecutionStats)
+
+	req = NewFind(mango.Equal("test", "bar")).ExecutionStats(false).Build()
+	assert.NoError(t, FindDocs(TestPrefix, TestDoctype, req, &results))
+	assert.Contains(t, string(body), `"execution_stats":false`)
+}
+
+func TestActiveTasks(t *testing.T) {
+	defer withFakeCouch(t, func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/_active_tasks", r.URL.Path)
+		_, _ = w.Write([]byte(`[
+			{"type": "indexer", "pid": "<0.1.0>", "database": "shards/00000000-1fffffff/alice%2Fio-cozy-files.1234",
+			 "design_document": "_design/by-parent", "progress": 42, "changes_done": 420, "total_changes": 1000,
+			 "started_on": 1600000000, "updated_on": 1600000010},
+			{"type": "replication", "pid": "<0.2.0>", "replication_id": "abc+continuous",
+			 "source": "http://couch/alice%2Fio-cozy-files/", "target": "http://couch/bob%2Fio-cozy-files/",
+			 "continuous": true, "docs_read": 12, "docs_written": 12, "changes_pending": null,
+			 "started_on": 1600000000, "updated_on": 1600000010}
+		]`))
+	})()
+
+	tasks, err := ActiveTasks(GlobalDB)
+	assert.NoError(t, err)
+	if assert.Len(t, tasks, 2) {
+		assert.Equal(t, TaskIndexer, tasks[0].Type)
+		assert.Equal(t, 42, tasks[0].Progress)
+		assert.Equal(t, "_design/by-parent", tasks[0].DesignDocument)
+		assert.Equal(t, TaskReplication, tasks[1].Type)
+		assert.True(t, tasks[1].Continuous)
+		assert.Equal(t, 12, tasks[1].DocsWritten)
+	}
+}
+
+func TestMembership(t *testing.T) {
+	defer withFakeCouch(t, func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/_membership", r.URL.Path)
+		_, _ = w.Write([]byte(`{
+			"all_nodes": ["couchdb@node1", "couchdb@node2"],
+			"cluster_nodes": ["couchdb@node1", "couchdb@node2", "couchdb@node3"]
+		}`))
+	})()
+
+	info, err := Membership(GlobalDB)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"couchdb@node1", "couchdb@node2"}, info.AllNodes)
+	assert.Len(t, info.ClusterNodes, 3)
+	assert.False(t, info.FullyJoined())
+
+	info.AllNodes = []string{"couchdb@node3", "couchdb@node2", "couchdb@node1"}
+	assert.True(t, info.FullyJoined())
+}
+
+func TestSnapshotDocCounts(t *testing.T) {
+	var keys [][]string
+	defer withFakeCouch(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/_all_dbs" {
+			dbs := make([]string, 150)
+			for i := range dbs {
+				dbs[i] = fmt.Sprintf("alice-cozy-tools/io-cozy-tests-%03d", i)
+			}
+			_ = json.NewEncoder(w).Encode(dbs)
+			return
+		}
+		assert.Equal(t, "/_dbs_info", r.URL.Path)
+		var body struct {
+			Keys []string `json:"keys"`
+		}
+		_ = json.NewDecoder(r.Body).Decode(&body)
+		keys = append(keys, body.Keys)
+		var infos []map[string]interface{}
+		for i, key := range body.Keys {
+			if i == 0 {
+				infos = append(infos, map[string]interface{}{"key": key, "error": "not_found"})
+				continue
+			}
+			infos = append(infos, map[string]interface{}{"key": key, "info": map[string]interface{}{"doc_count": i}})
+		}
+		_ = json.NewEncoder(w).Encode(infos)
+	})()
+
+	counts, err := SnapshotDocCounts(newDatabase("alice.cozy.tools"))
+	assert.NoError(t, err)
+	if assert.Len(t, keys, 2) {
+		assert.Len(t, keys[0], 100)
+		assert.Len(t, keys[1], 50)
+	}
+	assert.Len(t, counts, 148)
+	assert.NotContains(t, counts, "io.cozy.tests.000")
+	assert.Equal(t, 3, counts["io.cozy.tests.003"])
+	assert.Equal(t, 49, counts["io.cozy.tests.149"])
+}
+
+func TestWaitTasksIdle(t *testing.T) {
+	db := newDatabase("alice.cozy.tools")
+	var calls int32
+	defer withFakeCouch(t, func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) < 3 {
+			_, _ = w.Write([]byte(`[{"type": "database_compaction", "database": "shards/00000000-1fffffff/alice-cozy-tools/io-cozy-files.1600000000"}]`))
+		} else {
+			_, _ = w.Write([]byte(`[{"type": "indexer", "database": "shards/00000000-1fffffff/bob-cozy-tools/io-cozy-files.1600000000"}]`))
+		}
+	})()
+	interval := tasksPollInterval
+	tasksPollInterval = time.Millisecond
+	defer func() { tasksPollInterval = interval }()
+
+	assert.NoError(t, WaitTasksIdle(context.Background(), db, "io.cozy.files"))
+	assert.EqualValues(t, 3, atomic.LoadInt32(&calls))
+
+	atomic.StoreInt32(&calls, 0)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err := WaitTasksIdle(ctx, db, "io.cozy.files")
+	assert.Equal(t, context.Canceled, err)
+}
+
+func TestCompactDBWait(t *testing.T) {
+	db := newDatabase("alice.cozy.tools")
+	var compacted, statuses, active int32 = 0, 0, 500
+	defer withFakeCouch(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			atomic.AddInt32(&compacted, 1)
+			_, _ = w.Write([]byte(`{"ok": true}`))
+			return
+		}
+		n := atomic.AddInt32(&statuses, 1)
+		running := atomic.LoadInt32(&compacted) > 0 && n < 4
+		_, _ = fmt.Fprintf(w, `{"sizes": {"file": 1000, "active": %d}, "compact_running": %t}`, atomic.LoadInt32(&active), running)
+	})()
+	interval := compactPollMinInterval
+	compactPollMinInterval = time.Millisecond
+	defer func() { compactPollMinInterval = interval }()
+
+	assert.NoError(t, CompactDBWait(context.Background(), db, "io.cozy.files"))
+	assert.EqualValues(t, 1, atomic.LoadInt32(&compacted))
+	assert.EqualValues(t, 4, atomic.LoadInt32(&statuses))
+
+	atomic.StoreInt32(&compacted, 0)
+	atomic.StoreInt32(&statuses, 0)
+	atomic.StoreInt32(&active, 1000)
+	assert.NoError(t, CompactDBWait(context.Background(), db, "io.cozy.files"))
+	assert.EqualValues(t, 0, atomic.LoadInt32(&compacted))
+	assert.EqualValues(t, 1, atomic.LoadInt32(&statuses))
+
+	atomic.StoreInt32(&active, 500)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	err := CompactDBWait(ctx, db, "io.cozy.files")
+	assert.Equal(t, context.Canceled, err)
+}
+
+func TestPurgeSeqString(t *testing.T) {
+	var status DBStatusResponse
+	assert.NoError(t, json.Unmarshal([]byte(`{"purge_seq": 12}`), &status))
+	assert.Equal(t, "12", status.PurgeSeqString())
+	status = DBStatusResponse{}
+	assert.NoError(t, json.Unmarshal([]byte(`{"purge_seq": "3-g1AAAAFTeJzLYWBg"}`), &status))
+	assert.Equal(t, "3-g1AAAAFTeJzLYWBg", status.PurgeSeqString())
+	status = DBStatusResponse{}
+	assert.NoError(t, json.Unmarshal([]byte(`{}`), &status))
+	assert.Equal(t, "", status.PurgeSeqString())
+}
+
+func TestDecodeViewDocs(t *testing.T) {
+	resp := &ViewResponse{Rows: []*ViewResponseRow{
+		{ID: "a", Doc: json.RawMessage(`{"_id":"a","test":"first"}`)},
+		{ID: "b", Doc: json.RawMessage(`null`)},
+		{ID: "c"},
+		{ID: "d", Doc: json.RawMessage(`{"_id":"d","test":"second"}`)},
+	}}
+
+	var docs []*testDoc
+	assert.NoError(t, DecodeViewDocs(resp, &docs))
+	if assert.Len(t, docs, 2) {
+		assert.Equal(t, "first", docs[0].Test)
+		assert.Equal(t, "d", docs[1].ID())
+	}
+
+	jsonDocs, err := DecodeViewJSONDocs(resp, TestDoctype)
+	assert.NoError(t, err)
+	if assert.Len(t, jsonDocs, 2) {
+		assert.Equal(t, TestDoctype, jsonDocs[0].DocType())
+		assert.Equal(t, "second", jsonDocs[1].Get("test"))
+	}
+}
+
+func TestDevCreateDBQuery(t *testing.T) {
+	conf := config.GetConfig().CouchDB
+	defer func() { config.GetConfig().CouchDB = conf }()
+	config.GetConfig().CouchDB.DevQ = 0
+	config.GetConfig().CouchDB.DevN = 0
+	assert.Equal(t, "?q=1&n=1", devCreateDBQuery())
+	config.GetConfig().CouchDB.DevQ = 2
+	config.GetConfig().CouchDB.DevN = 3
+	assert.Equal(t, "?q=2&n=3", devCreateDBQuery())
+}
+
+func TestEqualViewsFunctions(t *testing.T) {
+	v1 := &ViewDesignDoc{Lang: "javascript", Updates: map[string]string{}}
+	v2 := &ViewDesignDoc{Lang: "javascript"}
+	assert.True(t, equalViews(v1, v2))
+
+	v1.Filters = map[string]string{"by_type": "function(doc) { return true; }"}
+	assert.False(t, equalViews(v1, v2))
+	v2.Filters = map[string]string{"by_type": "function(doc) { return true; }"}
+	assert.True(t, equalViews(v1, v2))
+
+	v2.ValidateDocUpdate = "function(newDoc, oldDoc, userCtx) {}"
+	assert.False(t, equalViews(v1, v2))
+}
+
+func TestDefineDesignDoc(t *testing.T) {
+	doctype := "io.cozy.tests.designdoc"
+	defer func() { _ = DeleteDB(TestPrefix, doctype) }()
+	assert.NoError(t, ResetDB(TestPrefix, doctype))
+
+	err := DefineDesignDoc(TestPrefix, doctype, &ViewDesignDoc{ID: "filters"})
+	assert.Error(t, err)
+
+	filter := "function(doc, req) { return doc.type === req.query.type; }"
+	doc := &ViewDesignDoc{
+		ID:      "_design/filters",
+		Filters: map[string]string{"by_type": filter},
+	}
+	assert.NoError(t, DefineDesignDoc(TestPrefix, doctype, doc))
+	saved, err := GetDesignDoc(TestPrefix, doctype, "filters")
+	assert.NoError(t, err)
+	assert.Equal(t, "javascript", saved.Lang)
+	assert.Equal(t, filter, saved.Filters["by_type"])
+
+	// Defining it again doesn't create a new revision
+	assert.NoError(t, DefineDesignDoc(TestPrefix, doctype, &ViewDesignDoc{
+		ID:      "_design/filters",
+		Filters: map[string]string{"by_type": filter},
+	}))
+	again, err := GetDesignDoc(TestPrefix, doctype, "filters")
+	assert.NoError(t, err)
+	assert.Equal(t, saved.Rev, again.Rev)
+}
+
+func TestJSONDocsFromRaw(t *testing.T) {
+	rows := []json.RawMessage{
+		json.RawMessage(`{"_id": "one", "_rev": "1-a", "name": "foo"}`),
+		json.RawMessage(`{"_id": "two", "_rev": "1-b"}`),
+	}
+	docs, err := JSONDocsFromRaw("io.cozy.tests", rows)
+	assert.NoError(t, err)
+	if assert.Len(t, docs, 2) {
+		assert.Equal(t, "one", docs[0].ID())
+		assert.Equal(t, "io.cozy.tests", docs[0].DocType())
+		assert.Equal(t, "foo", docs[0].Get("name"))
+		assert.Equal(t, "1-b", docs[1].Rev())
+	}
+
+	rows = append(rows, json.RawMessage(`[1, 2]`))
+	_, err = JSONDocsFromRaw("io.cozy.tests", rows)
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "row 2")
+	}
+}
+
+func TestCreateDocWithUUID(t *testing.T) {
+	uuids, collisions, lost := 0, 2, false
+	defer withFakeCouch(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/_uuids" {
+			uuids++
+			_, _ = fmt.Fprintf(w, `{"uuids": ["uuid%d"]}`, uuids)
+			return
+		}
+		if lost {
+			w.WriteHeader(http.StatusInternalServerError)
+			_, _ = w.Write([]byte(`{"error": "unknown_error", "reason": "timeout"}`))
+			return
+		}
+		if collisions > 0 {
+			collisions--
+			w.WriteHeader(http.StatusConflict)
+			_, _ = w.Write([]byte(`{"error": "conflict", "reason": "Document update conflict."}`))
+			return
+		}
+		w.WriteHeader(http.StatusCreated)
+		_, _ = fmt.Fprintf(w, `{"ok": true, "id": "uuid%d", "rev": "1-abc"}`, uuids)
+	})()
+	db := newDatabase("alice.cozy.tools")
+
+	doc := &JSONDoc{Type: "io.cozy.tests", M: map[string]interface{}{"foo": "bar"}}
+	assert.NoError(t, CreateDocWithUUID(db, doc))
+	assert.Equal(t, "uuid3", doc.ID())
+	assert.Equal(t, "1-abc", doc.Rev())
+
+	uuids, collisions = 0, 10
+	doc = &JSONDoc{Type: "io.cozy.tests", M: map[string]interface{}{"foo": "bar"}}
+	err := CreateDocWithUUID(db, doc)
+	assert.True(t, IsIDCollisionError(err))
+	assert.Equal(t, UUIDCollisionRetries+1, uuids)
+	assert.Empty(t, doc.ID())
+
+	// The ID is kept when the result of the write is unknown
+	uuids, collisions, lost = 0, 0, true
+	doc = &JSONDoc{Type: "io.cozy.tests", M: map[string]interface{}{"foo": "bar"}}
+	assert.Error(t, CreateDocWithUUID(db, doc))
+	assert.Equal(t, "uuid1", doc.ID())
+
+	err = CreateDocWithUUID(db, &JSONDoc{Type: "io.cozy.tests", M: map[string]interface{}{"_id": "foo"}})
+	assert.Error(t, err)
+}
+
+func TestAllDoctypesSorted(t *testing.T) {
+	defer withFakeCouch(t, func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "/_all_dbs", r.URL.Path)
+		_, _ = w.Write([]byte(`[
+			"alice-cozy-tools/io-cozy-jobs",
+			"alice-cozy-tools/io-cozy-apps",
+			"alice-cozy-tools/io-cozy-files",
+			"alice-cozy-tools/com-bank-accounts"
+		]`))
+	})()
+
+	doctypes, err := AllDoctypes(newDatabase("alice.cozy.tools"))
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"com.bank.accounts", "io.cozy.apps", "io.cozy.files", "io.cozy.jobs"}, doctypes)
+}
+
+func TestStreamChangesForDocs(t *testing.T) {
+	var filter string
+	var body struct {
+		DocIDs []string `json:"doc_ids"`
+	}
+	defer withFakeCouch(t, func(w http.ResponseWriter, r *http.Request) {
+		filter = r.URL.Query().Get("filter")
+		_ = json.NewDecoder(r.Body).Decode(&body)
+		flusher := w.(http.Flusher)
+		_, _ = w.Write([]byte(`{"seq": "1-a", "id": "doc1", "changes": [{"rev": "1-x"}], "doc": {"_id": "doc1"}}` + "\n"))
+		flusher.Flush()
+		_, _ = w.Write([]byte("\n"))
+		_, _ = w.Write([]byte(`{"seq": "2-b", "id": "doc2", "deleted": true, "changes": [{"rev": "2-y"}]}` + "\n"))
+		flusher.Flush()
+		if r.URL.Query().Get("since") == "wait" {
+			<-r.Context().Done()
+			return
+		}
+		_, _ = w.Write([]byte(`{"last_seq": "2-b", "pending": 0}` + "\n"))
+	})()
+	db := newDatabase("alice.cozy.tools")
+
+	var rows []ChangeRow
+	err := StreamChangesForDocs(context.Background(), db, "io.cozy.files", []string{"doc1", "doc2"}, "", func(row ChangeRow) error {
+		rows = append(rows, row)
+		return nil
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, "_doc_ids", filter)
+	assert.Equal(t, []string{"doc1", "doc2"}, body.DocIDs)
+	if assert.Len(t, rows, 2) {
+		assert.Equal(t, "doc1", rows[0].ID)
+		assert.Equal(t, "1-x", rows[0].Changes[0].Rev)
+		assert.JSONEq(t, `{"_id": "doc1"}`, string(rows[0].Doc))
+		assert.True(t, rows[1].Deleted)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	count := 0
+	err = StreamChangesForDocs(ctx, db, "io.cozy.files", []string{"doc1"}, "wait", func(row ChangeRow) error {
+		count++
+		if count == 2 {
+			cancel()
+		}
+		return nil
+	})
+	assert.Equal(t, context.Canceled, err)
+
+	err = StreamChangesForDocs(context.Background(), db, "io.cozy.files", nil, "", func(row ChangeRow) error {
+		return nil
+	})
+	assert.Error(t, err)
+}
+
+func TestExecViewKeepsRequest(t *testing.T) {
+	var queries []url.Values
+	defer withFakeCouch(t, func(w http.ResponseWriter, r *http.Request) {
+		queries = append(queries, r.URL.Query())
+		_, _ = w.Write([]byte(`{"rows": [{"key": null, "value": 2}]}`))
+	})()
+
+	view := &View{Name: "by-test", Doctype: TestDoctype}
+	req := &ViewRequest{Key: "reduce"}
+	var count int
+	assert.NoError(t, ExecReduce(TestPrefix, view, req, &count))
+	assert.Equal(t, &ViewRequest{Key: "reduce"}, req)
+	var res ViewResponse
+	assert.NoError(t, ExecView(TestPrefix, view, req, &res))
+	if assert.Len(t, queries, 2) {
+		assert.Equal(t, "true", queries[0].Get("reduce"))
+		assert.Equal(t, "false", queries[1].Get("reduce"))
+	}
+
+	req = &ViewRequest{Reduce: true, GroupLimit: 10}
+	assert.NoError(t, ExecView(TestPrefix, view, req, &res))
+	assert.Equal(t, &ViewRequest{Reduce: true, GroupLimit: 10}, req)
+	if assert.Len(t, queries, 3) {
+		assert.Equal(t, "10", queries[2].Get("limit"))
+		assert.Equal(t, "true", queries[2].Get("group"))
+	}
+}
+
+func TestExecStatsViewKeepsRequest(t *testing.T) {
+	var query url.Values
+	defer withFakeCouch(t, func(w http.ResponseWriter, r *http.Request) {
+		query = r.URL.Query()
+		_, _ = w.Write([]byte(`{"rows": [{"key": "a", "value": {"sum": 3, "count": 2, "min": 1, "max": 2, "sumsqr": 5}}]}`))
+	})()
+
+	view := &View{Name: "stats-by-test", Doctype: TestDoctype}
+	req := &ViewRequest{StartKey: "a"}
+	stats, err := ExecStatsView(TestPrefix, view, req)
+	assert.NoError(t, err)
+	assert.Equal(t, 3.0, stats["a"].Sum)
+	assert.Equal(t, "true", query.Get("reduce"))
+	assert.Equal(t, "true", query.Get("group"))
+	assert.Equal(t, &ViewRequest{StartKey: "a"}, req)
+}
+
+func TestViewRequestValidate(t *testing.T) {
+	req := &ViewRequest{Reduce: true, GroupLimit: 10}
+	assert.NoError(t, req.validate())
+
+	req = &ViewRequest{GroupLimit: 10}
+	assert.Error(t, req.validate())
+
+	req = &ViewRequest{Reduce: true, GroupLimit: 10, Limit: 5}
+	assert.Error(t, req.validate())
+
+	req = &ViewRequest{Reduce: true, GroupLevel: 1, Skip: 5}
+	assert.Error(t, req.validate())
+
+	req = &ViewRequest{Reduce: true, Group: true, Skip: 5}
+	assert.NoError(t, req.validate())
+
+	keys := []interface{}{"a", "b"}
+	req = &ViewRequest{Keys: keys, Reduce: true}
+	assert.Error(t, req.validate())
+
+	req = &ViewRequest{Keys: keys, Reduce: true, Group: true}
+	assert.NoError(t, req.validate())
+
+	req = &ViewRequest{Keys: keys, Reduce: true, GroupLevel: 1}
+	assert.NoError(t, req.validate())
+
+	req = &ViewRequest{Keys: keys, Key: "a"}
+	assert.Error(t, req.validate())
+
+	req = &ViewRequest{Keys: keys, StartKey: "a"}
+	assert.Error(t, req.validate())
+
+	req = &ViewRequest{Keys: keys, EndKey: "b"}
+	assert.Error(t, req.validate())
+
+	req = &ViewRequest{Keys: keys, IncludeDocs: true}
+	assert.NoError(t, req.validate())
+}
+
+func TestMain(m *testing.M) {
+	config.UseTestFile()
+
+	if _, err := CheckStatus(); err != nil {
+		fmt.Println("This test need couchdb to run.")
+		os.Exit(1)
+	}
+
+	err := ResetDB(TestPrefix, TestDoctype)
+	if err != nil {
+		fmt.Printf("Cant reset db (%s, %s) %s\n", TestPrefix, TestDoctype, err.Error())
+		os.Exit(1)
+	}
+
+	receivedEvents = make(map[string]*realtime.Event)
+	eventChan := realtime.GetHub().Subscriber(TestPrefix)
+	_ = eventChan.Subscribe(TestDoctype)
+	go func() {
+		for ev := range eventChan.Channel {
+			receivedEventsMutex.Lock()
+			receivedEvents[ev.Verb+ev.Doc.ID()] = ev
+			receivedEventsMutex.Unlock()
+		}
+	}()
+
+	res := m.Run()
+
+	eventChan.Close()
+	_ = DeleteDB(TestPrefix, TestDoctype)
+
+	os.Exit(res)
+}
+
+func TestJSONDocClone(t *testing.T) {
+	var m map[string]interface{}
+	data := []byte(`{
+	"foo1": "bar",
+	"foo2": [0,1,2,3],
+	"foo3": ["abc", 1, 1.1],
+	"foo4": {
+		"bar1":"bar",
+		"bar2": [0,1,2,3],
+		"bar3": ["abc", 1, 1.1, { "key": "value", "key2": [{}, 1, 2, 3] }],
+		"bar4": {}
+	},
+	"foo5": 1,
+	"foo6": 0.001,
+	"foo7": "toto"
+}`)
+
+	err := json.Unmarshal(data, &m)
+	assert.NoError(t, err)
+	j1 := JSONDoc{
+		Type: "toto",
+		M:    m,
+	}
+	j2 := j1.Clone().(*JSONDoc)
+
+	assert.Equal(t, j1.Type, j2.Type)
+	assert.True(t, reflect.DeepEqual(j1.M, j2.M))
+
+	assert.False(t, reflect.ValueOf(j1.M["foo2"]).Pointer() == reflect.ValueOf(j2.M["foo2"]).Pointer())
+	assert.False(t, reflect.ValueOf(j1.M["foo3"]).Pointer() == reflect.ValueOf(j2.M["foo3"]).Pointer())
+	assert.False(t, reflect.ValueOf(j1.M["foo4"]).Pointer() == reflect.ValueOf(j2.M["foo4"]).Pointer())
+
+	s1 := j1.M["foo1"].(string)
+	s2 := j2.M["foo1"].(string)
+	s3 := j1.M["foo7"].(string)
+	s4 := j2.M["foo7"].(string)
+
+	hdr1 := (*reflect.StringHeader)(unsafe.Pointer(&s1))
+	hdr2 := (*reflect.StringHeader)(unsafe.Pointer(&s2))
+	hdr3 := (*reflect.StringHeader)(unsafe.Pointer(&s3))
+	hdr4 := (*reflect.StringHeader)(unsafe.Pointer(&s4))
+
+	assert.Equal(t, hdr1.Data, hdr2.Data)
+	assert.Equal(t, hdr1.Len, hdr2.Len)
+
+	assert.Equal(t, hdr3.Data, hdr4.Data)
+	assert.Equal(t, hdr3.Len, hdr4.Len)
+
+	assert.NotEqual(t, hdr1.Data, hdr4.Data)
+	assert.NotEqual(t, hdr1.Len, hdr4.Len)
+}
+
+func TestJSONDocCloneAttachments(t *testing.T) {
+	j1 := &JSONDoc{Type: "io.cozy.tests", M: map[string]interface{}{
+		"_id": "with-attachments",
+		"_attachments": map[string]interface{}{
+			"file.txt": map[string]interface{}{"content_type": "text/plain", "revpos": 1},
+		},
+	}}
+	j2 := j1.Clone().(*JSONDoc)
+	assert.True(t, reflect.DeepEqual(j1.M, j2.M))
+	delete(j2.M["_attachments"].(map[string]interface{}), "file.txt")
+	assert.Contains(t, j1.M["_attachments"], "file.txt")
+}
+
+func TestLocalDocuments(t *testing.T) {
+	id := "foo"
+	_, err := GetLocal(TestPrefix, TestDoctype, id)
+	assert.True(t, IsNotFoundError(err))
+
+	doc := map[string]interface{}{"bar": "baz"}
+	err = PutLocal(TestPrefix, TestDoctype, id, doc)
+	assert.NoError(t, err)
+	assert.NotEmpty(t, doc["_rev"])
+
+	out, err := GetLocal(TestPrefix, TestDoctype, id)
+	assert.NoError(t, err)
+	assert.Equal(t, "baz", out["bar"])
+
+	err = DeleteLocal(TestPrefix, TestDoctype, id)
+	assert.NoError(t, err)
+
+	_, err = GetLocal(TestPrefix, TestDoctype, id)
+	assert.True(t, IsNotFoundError(err))
+}
+
+func assertGotEvent(t *testing.T, eventType, id string) *realtime.Event {
+	t.Helper()
+
+	var event *realtime.Event
+	var ok bool
+
+	for i := 0; i < 200; i++ {
+		receivedEventsMutex.Lock()
+		event, ok = receivedEvents[eventType+id]
+		receivedEventsMutex.Unlock()
+		if ok {
+			delete(receivedEvents, eventType+id)
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	assert.True(t, ok, "Expected event %s:%s", eventType, id)
+	return event
+}
+
+// withFakeCouch starts an HTTP server with the given handler, and uses it as
+// the CouchDB server. The returned function stops the server and restores
+// the CouchDB config, including the changes made by the test after the call.
+func withFakeCouch(t *testing.T, handler http.HandlerFunc) func() {
+	t.Helper()
+	ts := httptest.NewServer(handler)
+	conf := config.GetConfig().CouchDB
+	u, _ := url.Parse(ts.URL + "/")
+	config.GetConfig().CouchDB.URL = u
+	return func() {
+		ts.Close()
+		config.GetConfig().CouchDB = conf
+	}
+}
+
+func TestBulkUpdateDocsTooLarge(t *testing.T) {
+	called := false
+	defer withFakeCouch(t, func(w http.ResponseWriter, r *http.Request) {
+		called = true
+		w.WriteHeader(http.StatusCreated)
+		_, _ = w.Write([]byte(`[]`))
+	})()
+	config.GetConfig().CouchDB.MaxDocumentSize = 100
+
+	small := &testDoc{TestID: "small", Test: "small"}
+	large := &testDoc{TestID: "large", Test: strings.Repeat("x", 200)}
+	err := BulkUpdateDocs(TestPrefix, TestDoctype, []interface{}{small, large}, []interface{}{nil, nil})
+	assert.True(t, IsDocumentTooLargeError(err))
+	assert.False(t, called)
+	assert.Empty(t, small.Rev())
+}
+
+func TestCheckDocumentSizeWarning(t *testing.T) {
+	conf := config.GetConfig().CouchDB
+	defer func() { config.GetConfig().CouchDB = conf }()
+	config.GetConfig().CouchDB.WarnDocumentSize = 10
+	config.GetConfig().CouchDB.MaxDocumentSize = 0
+
+	var buf bytes.Buffer
+	l := logrus.New()
+	l.Out = &buf
+	log := logrus.NewEntry(l)
+
+	assert.NoError(t, checkDocumentSize(log, TestDoctype, "small", 5))
+	assert.Empty(t, buf.String())
+	assert.NoError(t, checkDocumentSize(log, TestDoctype, "large", 20))
+	assert.Contains(t, buf.String(), "large document of 20 bytes")
 }
@@ -0,0 +1,83 @@
+package couchdb
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+var countViewsMu sync.Mutex
+var countViews = make(map[string]*View)
+
+// CountByField returns the number of documents of the doctype for each value
+// of the given field (a path like "metadata.status" can be used for a nested
+// field). The documents without this field are not counted. A view is created
+// the first time for each field, and the first call can be slow as CouchDB
+// must build the index.
+func CountByField(db Database, doctype, field string) (map[string]int, error) {
+	view, err := countByFieldView(doctype, field)
+	if err != nil {
+		return nil, err
+	}
+
+	var res ViewResponse
+	err = ExecView(db, view, &ViewRequest{Reduce: true, Group: true}, &res)
+	if IsNoDatabaseError(err) {
+		return map[string]int{}, nil
+	}
+	if IsNotFoundError(err) {
+		if err = DefineViews(db, []*View{view}); err != nil {
+			return nil, err
+		}
+		res = ViewResponse{}
+		err = ExecView(db, view, &ViewRequest{Reduce: true, Group: true}, &res)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	counts := make(map[string]int, len(res.Rows))
+	for _, row := range res.Rows {
+		key, err := rowKeyString(row.Key)
+		if err != nil {
+			return nil, err
+		}
+		n, _ := row.Value.(float64)
+		counts[key] += int(n)
+	}
+	return counts, nil
+}
+
+// countByFieldView returns the view used by CountByField for the field. The
+// views are cached to avoid generating them again for each call.
+func countByFieldView(doctype, field string) (*View, error) {
+	countViewsMu.Lock()
+	defer countViewsMu.Unlock()
+	cacheKey := doctype + "/" + field
+	if view, ok := countViews[cacheKey]; ok {
+		return view, nil
+	}
+
+	path, err := json.Marshal(strings.Split(field, "."))
+	if err != nil {
+		return nil, err
+	}
+	view := &View{
+		Name:    "count-by-" + strings.Replace(field, ".", "-", -1),
+		Doctype: doctype,
+		Map: fmt.Sprintf(`
+function(doc) {
+  var path = %s;
+  var value = doc;
+  for (var i = 0; i < path.length; i++) {
+    if (value === null || typeof value !== "object") return;
+    value = value[path[i]];
+  }
+  if (value !== undefined) emit(value);
+}`, path),
+		Reduce: "_count",
+	}
+	countViews[cacheKey] = view
+	return view, nil
+}
@@ -0,0 +1,428 @@
+package couchdb
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/logger"
+	"github.com/cozy/cozy-stack/pkg/realtime"
+)
+
+// reindexPollInterval is the delay between two checks of the progress of the
+// build of a design doc.
+const reindexPollInterval = 1 * time.Second
+
+// DesignDocInfo is the response from CouchDB for the _info of a design doc
+type DesignDocInfo struct {
+	Name      string `json:"name"`
+	ViewIndex struct {
+		Signature      string      `json:"signature"`
+		Language       string      `json:"language"`
+		UpdaterRunning bool        `json:"updater_running"`
+		CompactRunning bool        `json:"compact_running"`
+		WaitingClients int         `json:"waiting_clients"`
+		UpdateSeq      interface{} `json:"update_seq"`
+		PurgeSeq       interface{} `json:"purge_seq"`
+		Sizes          struct {
+			File     int `json:"file"`
+			External int `json:"external"`
+			Active   int `json:"active"`
+		} `json:"sizes"`
+	} `json:"view_index"`
+}
+
+// GetDesignDoc fetches the design doc with the given name (without the
+// _design/ prefix) in the database of the doctype.
+func GetDesignDoc(db Database, doctype, name string) (*ViewDesignDoc, error) {
+	name = strings.TrimPrefix(name, "_design/")
+	if name == "" {
+		return nil, newBadIDError("_design/")
+	}
+	var doc ViewDesignDoc
+	u := "_design/" + url.PathEscape(name)
+	if err := makeRequest(db, doctype, http.MethodGet, u, nil, &doc); err != nil {
+		return nil, err
+	}
+	return &doc, nil
+}
+
+// ListDesignDocs returns all the design docs of the database of the doctype.
+func ListDesignDocs(db Database, doctype string) ([]*ViewDesignDoc, error) {
+	req := &AllDocsRequest{
+		StartKey: "_design/",
+		EndKey:   "_design0",
+	}
+	v, err := req.Values()
+	if err != nil {
+		return nil, err
+	}
+	v.Add("include_docs", "true")
+	var res AllDocsResponse
+	if err := makeRequest(db, doctype, http.MethodGet, "_all_docs?"+v.Encode(), nil, &res); err != nil {
+		return nil, err
+	}
+	docs := make([]*ViewDesignDoc, 0, len(res.Rows))
+	for _, row := range res.Rows {
+		var doc ViewDesignDoc
+		if err := json.Unmarshal(row.Doc, &doc); err != nil {
+			return nil, err
+		}
+		docs = append(docs, &doc)
+	}
+	return docs, nil
+}
+
+// AllDesignDocs returns the design docs of all the databases of an instance,
+// indexed by doctype.
+func AllDesignDocs(db Database) (map[string][]*ViewDesignDoc, error) {
+	doctypes, err := AllDoctypes(db)
+	if err != nil {
+		return nil, err
+	}
+
+	var mu sync.Mutex
+	results := make(map[string][]*ViewDesignDoc, len(doctypes))
+	err = runConcurrently(context.Background(), len(doctypes), func(i int) error {
+		docs, err := ListDesignDocs(db, doctypes[i])
+		if err != nil {
+			return err
+		}
+		mu.Lock()
+		results[doctypes[i]] = docs
+		mu.Unlock()
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// VerifyViews checks that the views are defined in CouchDB, and returns the
+// views that are missing or stale (with a different map or reduce function,
+// or different options). The views of a design doc created by DefineViews are
+// also stale if the design doc has other views, as DefineViews would remove
+// them.
+func VerifyViews(db Database, expected []*View) ([]*View, error) {
+	invalid := make([]bool, len(expected))
+	err := runConcurrently(context.Background(), len(expected), func(i int) error {
+		exists, upToDate, err := checkView(db, expected[i])
+		invalid[i] = !exists || !upToDate
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	var views []*View
+	for i, v := range expected {
+		if invalid[i] {
+			views = append(views, v)
+		}
+	}
+	return views, nil
+}
+
+// checkView tells if the view exists in CouchDB, and if it is up-to-date.
+func checkView(db Database, v *View) (exists bool, upToDate bool, err error) {
+	doc, err := GetDesignDoc(db, v.Doctype, v.designDocName())
+	if IsNotFoundError(err) {
+		return false, false, nil
+	}
+	if err != nil {
+		return false, false, err
+	}
+	if v.DesignDoc != "" {
+		existing, ok := doc.Views[v.Name]
+		return ok, ok && equalView(existing, v), nil
+	}
+	want := &ViewDesignDoc{
+		Lang:  "javascript",
+		Views: map[string]*View{v.Name: v},
+	}
+	return true, equalViews(doc, want), nil
+}
+
+// RepairViews defines the views that are missing or stale (see VerifyViews),
+// and returns them. The other views are not touched, which avoids the
+// rebuilds of their indexes. When a view of a group is repaired, the design
+// doc is redefined with all the views of the group that are in expected.
+func RepairViews(db Database, expected []*View) ([]*View, error) {
+	invalid, err := VerifyViews(db, expected)
+	if err != nil {
+		return nil, err
+	}
+
+	var singles []*View
+	var groups []string
+	seen := make(map[string]bool)
+	for _, v := range invalid {
+		if v.DesignDoc == "" {
+			singles = append(singles, v)
+			continue
+		}
+		key := v.Doctype + "/" + v.DesignDoc
+		if !seen[key] {
+			seen[key] = true
+			groups = append(groups, key)
+		}
+	}
+
+	if err = DefineViews(db, singles); err != nil {
+		return nil, err
+	}
+	for _, key := range groups {
+		var group []*View
+		for _, v := range expected {
+			if v.Doctype+"/"+v.DesignDoc == key {
+				group = append(group, v)
+			}
+		}
+		if _, err = DefineViewGroup(db, group[0].DesignDoc, group); err != nil {
+			return nil, err
+		}
+	}
+	return invalid, nil
+}
+
+// GetDesignDocInfo returns the informations about the index of a design doc,
+// like whether it is currently being built.
+func GetDesignDocInfo(db Database, doctype, name string) (*DesignDocInfo, error) {
+	name = strings.TrimPrefix(name, "_design/")
+	var info DesignDocInfo
+	u := "_design/" + url.PathEscape(name) + "/_info"
+	if err := makeRequest(db, doctype, http.MethodGet, u, nil, &info); err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+// CancelViewBuild stops the build of the indexes of a design doc, as an
+// emergency measure when it overloads CouchDB. CouchDB has no API for that, so
+// the design doc is deleted (which stops the indexer) and then created again
+// with the same content. The views of this design doc are unavailable until
+// they are rebuilt, and the next query on them will start a new build. As
+// this is a destructive operation, confirm must be true.
+func CancelViewBuild(db Database, doctype, designDoc string, confirm bool) error {
+	if !confirm {
+		return fmt.Errorf("CancelViewBuild must be confirmed")
+	}
+	name := strings.TrimPrefix(designDoc, "_design/")
+	if name == "" {
+		return newBadIDError("_design/")
+	}
+	u := "_design/" + url.PathEscape(name)
+	var doc map[string]interface{}
+	if err := makeRequest(db, doctype, http.MethodGet, u, nil, &doc); err != nil {
+		return err
+	}
+	rev, _ := doc["_rev"].(string)
+	logger.WithDomain(db.DomainName()).WithField("nspace", "couchdb").
+		Warnf("Cancel the build of the design doc %s for %s", name, doctype)
+	if err := makeRequest(db, doctype, http.MethodDelete, u+"?rev="+url.QueryEscape(rev), nil, nil); err != nil {
+		return err
+	}
+	delete(doc, "_rev")
+	return makeRequest(db, doctype, http.MethodPut, u, doc, nil)
+}
+
+// ReindexDoctype forces CouchDB to build the indexes of all the design docs
+// with javascript views of the doctype, and waits until they are up-to-date.
+// A limited number of design docs are built concurrently (see
+// SetMaxConcurrency). The views already built are skipped quickly, so the
+// function can be called again after a cancellation to finish the job.
+func ReindexDoctype(ctx context.Context, db Database, doctype string) error {
+	docs, err := ListDesignDocs(db, doctype)
+	if err != nil {
+		return err
+	}
+
+	var toBuild []*ViewDesignDoc
+	for _, doc := range docs {
+		if doc.Lang == "javascript" && len(doc.Views) > 0 {
+			toBuild = append(toBuild, doc)
+		}
+	}
+	return runConcurrently(ctx, len(toBuild), func(i int) error {
+		return reindexDesignDoc(ctx, db, doctype, toBuild[i])
+	})
+}
+
+func reindexDesignDoc(ctx context.Context, db Database, doctype string, doc *ViewDesignDoc) error {
+	log := logger.WithDomain(db.DomainName()).WithField("nspace", "couchdb")
+	name := strings.TrimPrefix(doc.ID, "_design/")
+	var viewName string
+	for viewName = range doc.Views {
+		break
+	}
+	viewurl := "_design/" + url.PathEscape(name) + "/_view/" + url.PathEscape(viewName)
+
+	// The views of a design doc are built together, so querying one of them
+	// is enough. With update=lazy, CouchDB starts the build in background and
+	// responds immediately.
+	err := makeRequest(db, doctype, http.MethodGet, viewurl+"?limit=0&update=lazy", nil, nil)
+	if err != nil {
+		return err
+	}
+
+	ticker := time.NewTicker(reindexPollInterval)
+	defer ticker.Stop()
+	for {
+		info, err := GetDesignDocInfo(db, doctype, name)
+		if err != nil {
+			return err
+		}
+		if !info.ViewIndex.UpdaterRunning {
+			break
+		}
+		log.Infof("Reindexing %s of %s: seq %v", doc.ID, doctype, info.ViewIndex.UpdateSeq)
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+
+	// The updater may not have started yet when _info was requested, so a
+	// last request without update=lazy ensures that the index is up-to-date.
+	err = makeRequest(db, doctype, http.MethodGet, viewurl+"?limit=0", nil, nil)
+	if err == nil {
+		log.Infof("Reindexing %s of %s: done", doc.ID, doctype)
+	}
+	return err
+}
+
+// DefineUpdateFunction adds an update function to a design doc (the name is
+// without the _design/ prefix), creating it if needed. The update functions
+// are executed by CouchDB with ExecUpdate, for the partial updates without a
+// read-modify-write cycle. A design doc dedicated to the update functions
+// should be used, as DefineViews replaces the design docs of the views.
+func DefineUpdateFunction(db Database, doctype, designDoc, name, fn string) error {
+	designDoc = strings.TrimPrefix(designDoc, "_design/")
+	if designDoc == "" || name == "" {
+		return fmt.Errorf("DefineUpdateFunction should have a design doc and a name")
+	}
+	doc, err := GetDesignDoc(db, doctype, designDoc)
+	if IsNotFoundError(err) && !IsNoDatabaseError(err) {
+		doc, err = &ViewDesignDoc{ID: "_design/" + designDoc}, nil
+	}
+	if err != nil {
+		return err
+	}
+	if doc.Updates[name] == fn {
+		return nil
+	}
+	if doc.Updates == nil {
+		doc.Updates = make(map[string]string)
+	}
+	doc.Updates[name] = fn
+	return DefineDesignDoc(db, doctype, doc)
+}
+
+// ValidationDesignDoc is the name of the design doc where the validation
+// function of a doctype is installed by SetValidationFunction.
+const ValidationDesignDoc = "validation"
+
+// SetValidationFunction installs the validate_doc_update function of a
+// doctype, to reject the malformed writes at the CouchDB level, even when they
+// don't go through the stack. The function must throw {forbidden: "reason"}
+// to reject a write, and the error can be checked with IsForbiddenError. An
+// empty source removes the validation.
+//
+// The function is called by CouchDB for every write on the database,
+// including the replications and the bulk requests, which makes them slower:
+// it should be kept short. The design docs are also validated by it, so the
+// function should let the documents with a _design/ ID pass. Note that the
+// writes of a server admin are validated too.
+func SetValidationFunction(db Database, doctype, jsSource string) error {
+	doc, err := GetDesignDoc(db, doctype, ValidationDesignDoc)
+	if IsNotFoundError(err) && !IsNoDatabaseError(err) {
+		if jsSource == "" {
+			return nil
+		}
+		doc, err = &ViewDesignDoc{ID: "_design/" + ValidationDesignDoc}, nil
+	}
+	if err != nil {
+		return err
+	}
+	if doc.ValidateDocUpdate == jsSource {
+		return nil
+	}
+	doc.ValidateDocUpdate = jsSource
+	return DefineDesignDoc(db, doctype, doc)
+}
+
+// ExecUpdate calls an update function of a design doc on the document with
+// the given ID, or without document if docID is empty. The params are sent
+// in the query string, and are available in req.query for the function. The
+// new revision of the document is read from the X-Couch-Update-NewRev header,
+// as the body of the response is chosen by the function.
+//
+// If the function has not written a document, the response has Ok set to
+// false and no Rev. Else, the written document is fetched to emit the
+// realtime event (without the old document) and to send it to the write sink.
+func ExecUpdate(db Database, doctype, designDoc, updateName, docID string, params map[string]string) (*UpdateResponse, error) {
+	designDoc = strings.TrimPrefix(designDoc, "_design/")
+	if designDoc == "" || updateName == "" {
+		return nil, fmt.Errorf("ExecUpdate should have a design doc and an update name")
+	}
+	path := "_design/" + url.PathEscape(designDoc) + "/_update/" + url.PathEscape(updateName)
+	method := http.MethodPost
+	if docID != "" {
+		if _, err := validateDocID(docID); err != nil {
+			return nil, err
+		}
+		path += "/" + url.PathEscape(docID)
+		method = http.MethodPut
+	}
+	if len(params) > 0 {
+		v := make(url.Values, len(params))
+		for key, value := range params {
+			v.Set(key, value)
+		}
+		path += "?" + v.Encode()
+	}
+
+	resp, err := makeRawRequest(db, doctype, method, path, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	res := &UpdateResponse{
+		ID:  resp.Header.Get("X-Couch-Id"),
+		Rev: resp.Header.Get("X-Couch-Update-NewRev"),
+	}
+	if res.ID == "" {
+		res.ID = docID
+	}
+	if res.Rev == "" {
+		return res, nil
+	}
+	res.Ok = true
+	publishUpdate(db, doctype, res)
+	return res, nil
+}
+
+// publishUpdate fetches the document written by an update function, and emits
+// the realtime event for it.
+func publishUpdate(db Database, doctype string, res *UpdateResponse) {
+	doc := &JSONDoc{Type: doctype}
+	if err := GetDocRev(db, doctype, res.ID, res.Rev, doc); err != nil {
+		logger.WithDomain(db.DomainName()).WithField("nspace", "couchdb").
+			Warnf("cannot fetch %s %s after its update: %s", doctype, res.ID, err)
+		return
+	}
+	verb := realtime.EventUpdate
+	if doc.Get("_deleted") == true {
+		verb = realtime.EventDelete
+	} else if strings.HasPrefix(res.Rev, "1-") {
+		verb = realtime.EventCreate
+	}
+	RTEvent(db, verb, doc, nil)
+	teeWrite(db, verb, doc)
+}
@@ -46,6 +46,13 @@ func (vr *ViewRequest) Values() (url.Values, error) {
 		return nil, err
 	}
 
+	for key, value := range vr.Extra {
+		if _, ok := v[key]; ok {
+			return nil, newInvalidViewRequestError("the extra parameter " + key + " is already set")
+		}
+		v.Set(key, value)
+	}
+
 	return v, nil
 }
 
@@ -3,6 +3,7 @@ package couchdb
 import (
 	"encoding/json"
 	"fmt"
+	"net"
 	"net/http"
 	"net/url"
 	"strconv"
@@ -43,6 +44,12 @@ import (
 // 		{"error":"conflict","reason":"Document update conflict."}
 // 412 Precondition Failed : The request headers from the client and the
 // 		capabilities of the server do not match.
+// 413 Request Entity Too Large : The document is larger than the
+// 		couchdb/max_document_size configuration of CouchDB.
+// 		{"error":"document_too_large","reason":"..."}
+// 429 Too Many Requests : CouchDB, or a proxy in front of it, asks the stack
+// 		to slow down. The GET requests are retried after the delay of the
+// 		Retry-After header.
 // 415 Bad Content Type : The content types supported, and the content type of
 // 		the information being requested or submitted indicate that the content
 // 		type is not supported.
@@ -53,6 +60,11 @@ import (
 // 500 Internal Server Error : The request was invalid, either because the
 // 		supplied JSON was invalid, or invalid information was supplied as part
 // 		of the request.
+// 		It is also used when a request, like a _find or a view query, has not
+// 		been processed in time:
+// 		{"error":"timeout","reason":"The request could not be processed in a reasonable amount of time."}
+// 		Or when the view server has crashed:
+// 		{"error":"os_process_error","reason":"..."}
 
 // Error represent an error from couchdb
 type Error struct {
@@ -145,6 +157,116 @@ func IsConflictError(err error) bool {
 	return couchErr.StatusCode == http.StatusConflict
 }
 
+// IsTooManyRequestsError checks if the given error is a 429 Too Many Requests
+// error, from CouchDB or a proxy in front of it.
+func IsTooManyRequestsError(err error) bool {
+	couchErr, isCouchErr := IsCouchError(err)
+	if !isCouchErr {
+		return false
+	}
+	return couchErr.StatusCode == http.StatusTooManyRequests
+}
+
+// IsTimeoutError checks if the given error is a timeout, either from CouchDB
+// for a request that was too long to process, or from the HTTP client of the
+// stack. A missing index is often the cause of such timeouts.
+func IsTimeoutError(err error) bool {
+	couchErr, isCouchErr := IsCouchError(err)
+	if !isCouchErr {
+		return false
+	}
+	if couchErr.Name == "timeout" {
+		return true
+	}
+	if netErr, ok := couchErr.Original.(net.Error); ok {
+		return netErr.Timeout()
+	}
+	return false
+}
+
+// IsRangeNotSatisfiableError checks if the given error is for a range of an
+// attachment that is outside of its content.
+func IsRangeNotSatisfiableError(err error) bool {
+	couchErr, isCouchErr := IsCouchError(err)
+	if !isCouchErr {
+		return false
+	}
+	return couchErr.StatusCode == http.StatusRequestedRangeNotSatisfiable
+}
+
+// IsViewProcessError checks if the given error is for a crash of the view
+// server of CouchDB (os_process_error). It can happen on a view query, and the
+// view server needs some time to recover.
+func IsViewProcessError(err error) bool {
+	couchErr, isCouchErr := IsCouchError(err)
+	if !isCouchErr {
+		return false
+	}
+	return couchErr.Name == "os_process_error"
+}
+
+// IsDocumentTooLargeError checks if the given error is for a document that was
+// too large, either for the stack or for CouchDB.
+func IsDocumentTooLargeError(err error) bool {
+	couchErr, isCouchErr := IsCouchError(err)
+	if !isCouchErr {
+		return false
+	}
+	return couchErr.Name == "document_too_large" ||
+		couchErr.StatusCode == http.StatusRequestEntityTooLarge
+}
+
+// IsForbiddenError checks if the given error is a write rejected by CouchDB,
+// for example by the validate_doc_update function of a design doc.
+func IsForbiddenError(err error) bool {
+	couchErr, isCouchErr := IsCouchError(err)
+	if !isCouchErr {
+		return false
+	}
+	return couchErr.StatusCode == http.StatusForbidden
+}
+
+// IsMaintenanceLockedError checks if the given error is for a maintenance
+// lock held by another owner.
+func IsMaintenanceLockedError(err error) bool {
+	couchErr, isCouchErr := IsCouchError(err)
+	if !isCouchErr {
+		return false
+	}
+	return couchErr.Name == "maintenance_locked"
+}
+
+// IsStaleBookmarkError checks if the given error is for a bookmark that has
+// been ignored by CouchDB, probably because the index has been rebuilt. The
+// pagination must be restarted from the beginning.
+func IsStaleBookmarkError(err error) bool {
+	couchErr, isCouchErr := IsCouchError(err)
+	if !isCouchErr {
+		return false
+	}
+	return couchErr.Name == "stale_bookmark"
+}
+
+// IsIDCollisionError checks if the given error is for a document that could
+// not be created with a new UUID, as the UUIDs were already used.
+func IsIDCollisionError(err error) bool {
+	couchErr, isCouchErr := IsCouchError(err)
+	if !isCouchErr {
+		return false
+	}
+	return couchErr.Name == "id_collision"
+}
+
+// IsDrainingError checks if the given error is for a request rejected
+// because the stack is shutting down (see Drain).
+func IsDrainingError(err error) bool {
+	couchErr, isCouchErr := IsCouchError(err)
+	if !isCouchErr {
+		return false
+	}
+	return couchErr.Name == "draining"
+}
+
 // IsNoUsableIndexError checks if the given error is an error form couch, for
 // an invalid request on an index that is not usable.
 func IsNoUsableIndexError(err error) bool {
@@ -155,6 +277,46 @@ func IsNoUsableIndexError(err error) bool {
 	return couchErr.Name == "no_usable_index"
 }
 
+// StreamInterruptedError is returned when a response from CouchDB has been
+// truncated mid-stream, for example by a restart of CouchDB. Position is the
+// last position (seq or document ID) that has been processed, and can be used
+// to resume the stream. The request can be retried.
+type StreamInterruptedError struct {
+	Position string
+	Original error
+}
+
+func (e *StreamInterruptedError) Error() string {
+	return fmt.Sprintf("CouchDB stream interrupted after %q: %s", e.Position, e.Original)
+}
+
+// IsStreamInterruptedError checks if the given error is for a stream from
+// CouchDB that has been interrupted, and returns it.
+func IsStreamInterruptedError(err error) (*StreamInterruptedError, bool) {
+	streamErr, ok := err.(*StreamInterruptedError)
+	return streamErr, ok
+}
+
+// MigrationError is returned by MigrateDoctype when some documents have not
+// been migrated. Errors has the error for each of them, by document ID.
+type MigrationError struct {
+	Errors map[string]error
+}
+
+func (e *MigrationError) Error() string {
+	return fmt.Sprintf("%d documents have not been migrated", len(e.Errors))
+}
+
+// isTruncatedResponseError checks if the given error is for a response from
+// CouchDB that has been truncated.
+func isTruncatedResponseError(err error) bool {
+	couchErr, isCouchErr := IsCouchError(err)
+	if !isCouchErr {
+		return false
+	}
+	return couchErr.Name == "truncated_response"
+}
+
 func isIndexError(err error) bool {
 	couchErr, isCouchErr := IsCouchError(err)
 	if !isCouchErr {
@@ -190,6 +352,50 @@ func newIOReadError(originalError error) error {
 	}
 }
 
+func newTruncatedResponseError(originalError error) error {
+	return &Error{
+		StatusCode: http.StatusServiceUnavailable,
+		Name:       "truncated_response",
+		Reason:     "the response from the server has been interrupted",
+		Original:   cleanURLError(originalError),
+	}
+}
+
+func newStreamInterruptedError(position string, originalError error) error {
+	return &StreamInterruptedError{
+		Position: position,
+		Original: originalError,
+	}
+}
+
+func newRangeNotSatisfiableError(size int64) error {
+	reason := "the range is not satisfiable"
+	if size >= 0 {
+		reason = fmt.Sprintf("the range is not satisfiable for %d bytes", size)
+	}
+	return &Error{
+		StatusCode: http.StatusRequestedRangeNotSatisfiable,
+		Name:       "range_not_satisfiable",
+		Reason:     reason,
+	}
+}
+
+func newMaintenanceLockedError(owner string) error {
+	return &Error{
+		StatusCode: http.StatusConflict,
+		Name:       "maintenance_locked",
+		Reason:     fmt.Sprintf("a maintenance is already running for %s", owner),
+	}
+}
+
+func newStaleBookmarkError() error {
+	return &Error{
+		StatusCode: http.StatusPreconditionFailed,
+		Name:       "stale_bookmark",
+		Reason:     "the bookmark has been reset, the index may have been rebuilt",
+	}
+}
+
 func newDefinedIDError() error {
 	return &Error{
 		StatusCode: http.StatusBadRequest,
@@ -198,6 +404,14 @@ func newDefinedIDError() error {
 	}
 }
 
+func newDocumentTooLargeError(size, max int) error {
+	return &Error{
+		StatusCode: http.StatusRequestEntityTooLarge,
+		Name:       "document_too_large",
+		Reason:     fmt.Sprintf("the document size (%d bytes) exceeds the maximum of %d bytes", size, max),
+	}
+}
+
 func newBadIDError(id string) error {
 	return &Error{
 		StatusCode: http.StatusBadRequest,
@@ -206,6 +420,54 @@ func newBadIDError(id string) error {
 	}
 }
 
+func newConflictError() error {
+	return &Error{
+		StatusCode: http.StatusConflict,
+		Name:       "conflict",
+		Reason:     "Document update conflict.",
+	}
+}
+
+func newIDCollisionError(attempts int) error {
+	return &Error{
+		StatusCode: http.StatusConflict,
+		Name:       "id_collision",
+		Reason:     fmt.Sprintf("the document could not be created with a new UUID after %d attempts", attempts),
+	}
+}
+
+func newDrainingError() error {
+	return &Error{
+		StatusCode: http.StatusServiceUnavailable,
+		Name:       "draining",
+		Reason:     "the stack is shutting down, no new request to CouchDB is accepted",
+	}
+}
+
+func newInvalidPatchError(reason string) error {
+	return &Error{
+		StatusCode: http.StatusBadRequest,
+		Name:       "bad_request",
+		Reason:     reason,
+	}
+}
+
+func newInvalidViewRequestError(reason string) error {
+	return &Error{
+		StatusCode: http.StatusBadRequest,
+		Name:       "query_parse_error",
+		Reason:     reason,
+	}
+}
+
+func newUnexpectedRowsError(view string, nb int) error {
+	return &Error{
+		StatusCode: http.StatusInternalServerError,
+		Name:       "unexpected_rows",
+		Reason:     fmt.Sprintf("expected a single reduced row for view %s, got %d", view, nb),
+	}
+}
+
 func unoptimalError() error {
 	return &Error{
 		StatusCode: http.StatusBadRequest,
@@ -1,8 +1,14 @@
 package couchdb
 
 import (
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"net/http"
+	"net/url"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -30,3 +36,101 @@ func TestError_JSON(t *testing.T) {
 
 	assert.EqualValues(t, expectedMap, asJSON)
 }
+
+func TestIsTimeoutError(t *testing.T) {
+	body := []byte(`{"error":"timeout","reason":"The request could not be processed in a reasonable amount of time."}`)
+	err := newCouchdbError(500, body)
+	assert.True(t, IsTimeoutError(err))
+	assert.True(t, IsInternalServerError(err))
+	assert.Contains(t, err.Error(), "reasonable amount of time")
+
+	err = newCouchdbError(500, []byte(`{"error":"unknown_error","reason":"function_clause"}`))
+	assert.False(t, IsTimeoutError(err))
+
+	err = newConnectionError(&url.Error{Op: "Get", URL: "http://localhost:5984/", Err: timeoutError{}})
+	assert.True(t, IsTimeoutError(err))
+
+	assert.False(t, IsTimeoutError(nil))
+}
+
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestIsDocumentTooLargeError(t *testing.T) {
+	assert.True(t, IsDocumentTooLargeError(newDocumentTooLargeError(2000, 1000)))
+	body := []byte(`{"error":"document_too_large","reason":"d4e5a3"}`)
+	assert.True(t, IsDocumentTooLargeError(newCouchdbError(413, body)))
+	assert.False(t, IsDocumentTooLargeError(newDefinedIDError()))
+}
+
+func TestIsTooManyRequestsError(t *testing.T) {
+	err := newCouchdbError(http.StatusTooManyRequests, []byte("Too Many Requests"))
+	assert.True(t, IsTooManyRequestsError(err))
+	assert.False(t, IsTooManyRequestsError(newConflictError()))
+	assert.False(t, IsTooManyRequestsError(errors.New("other")))
+}
+
+func TestIsViewProcessError(t *testing.T) {
+	body := []byte(`{"error":"os_process_error","reason":"{exit_status,1}"}`)
+	err := newCouchdbError(500, body)
+	assert.True(t, IsViewProcessError(err))
+	assert.True(t, IsInternalServerError(err))
+	assert.False(t, IsViewProcessError(newCouchdbError(500, []byte(`{"error":"timeout"}`))))
+	assert.False(t, IsViewProcessError(errors.New("other")))
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	wait, ok := parseRetryAfter("2")
+	assert.True(t, ok)
+	assert.Equal(t, 2*time.Second, wait)
+
+	wait, ok = parseRetryAfter("")
+	assert.True(t, ok)
+	assert.Equal(t, 1*time.Second, wait)
+
+	date := time.Now().Add(-time.Minute).UTC().Format(http.TimeFormat)
+	wait, ok = parseRetryAfter(date)
+	assert.True(t, ok)
+	assert.Equal(t, time.Duration(0), wait)
+
+	_, ok = parseRetryAfter("3600")
+	assert.False(t, ok)
+	_, ok = parseRetryAfter("soon")
+	assert.False(t, ok)
+}
+
+func TestStreamInterrupted(t *testing.T) {
+	defer withFakeCouch(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", "1000")
+		_, _ = w.Write([]byte(`{"results":[{"id":"foo","seq":"2-abc"},`))
+		// Simulate a restart of CouchDB mid-stream
+		conn, _, _ := w.(http.Hijacker).Hijack()
+		_ = conn.Close()
+	})()
+
+	_, err := GetChanges(TestPrefix, &ChangesRequest{DocType: TestDoctype, Since: "1-abc"})
+	streamErr, ok := IsStreamInterruptedError(err)
+	if assert.True(t, ok) {
+		assert.Equal(t, "1-abc", streamErr.Position)
+	}
+}
+
+func TestEmptyBodyIsNotTruncated(t *testing.T) {
+	defer withFakeCouch(t, func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})()
+
+	_, err := GetChanges(TestPrefix, &ChangesRequest{DocType: TestDoctype, Since: "1-abc"})
+	assert.Error(t, err)
+	_, ok := IsStreamInterruptedError(err)
+	assert.False(t, ok)
+	assert.False(t, isTruncatedResponseError(err))
+
+	assert.False(t, isTruncatedBodyError(io.EOF, 0))
+	assert.True(t, isTruncatedBodyError(io.EOF, 3))
+	assert.True(t, isTruncatedBodyError(io.ErrUnexpectedEOF, 0))
+	assert.False(t, isTruncatedBodyError(&json.SyntaxError{}, 10))
+}
@@ -0,0 +1,249 @@
+package couchdb
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+
+	"github.com/cozy/cozy-stack/pkg/couchdb/mango"
+	"github.com/cozy/cozy-stack/pkg/logger"
+)
+
+// FindBuilder is a helper to build a FindRequest with chained calls, like
+// NewFind(selector).Sort(mango.AscBy("name")).Limit(10).Build().
+type FindBuilder struct {
+	req FindRequest
+}
+
+// NewFind returns a FindBuilder for a request with the given selector.
+func NewFind(selector mango.Filter) *FindBuilder {
+	return &FindBuilder{req: FindRequest{Selector: selector}}
+}
+
+// Sort sets the sort rules of the request.
+func (b *FindBuilder) Sort(rules ...mango.SortByField) *FindBuilder {
+	b.req.Sort = mango.SortBy(rules)
+	return b
+}
+
+// Fields sets the fields of the documents that are returned.
+func (b *FindBuilder) Fields(fields ...string) *FindBuilder {
+	b.req.Fields = fields
+	return b
+}
+
+// Limit sets the maximal number of documents that are returned. A limit of 0
+// is sent to CouchDB.
+func (b *FindBuilder) Limit(limit int) *FindBuilder {
+	b.req.Limit = &limit
+	return b
+}
+
+// Skip sets the number of documents to skip.
+func (b *FindBuilder) Skip(skip int) *FindBuilder {
+	b.req.Skip = &skip
+	return b
+}
+
+// Bookmark sets the bookmark, to fetch the next page of results. A bookmark
+// is only valid for the generation of the index that has produced it: if the
+// index is rebuilt, CouchDB restarts from the first page.
+func (b *FindBuilder) Bookmark(bookmark string) *FindBuilder {
+	b.req.Bookmark = bookmark
+	return b
+}
+
+// UseIndex sets the index that CouchDB must use for the request.
+func (b *FindBuilder) UseIndex(index string) *FindBuilder {
+	b.req.UseIndex = index
+	return b
+}
+
+// ExecutionStats asks CouchDB to send, or not, some statistics about the
+// query, whatever the config.
+func (b *FindBuilder) ExecutionStats(enabled bool) *FindBuilder {
+	b.req.ExecutionStats = &enabled
+	return b
+}
+
+// Build returns the FindRequest. A warning is logged if the request sorts on
+// a field that is not in the selector, as CouchDB won't find an index for it.
+func (b *FindBuilder) Build() *FindRequest {
+	req := b.req
+	if len(req.Sort) > 0 && req.Selector != nil {
+		fields := selectorFields(req.Selector)
+		for _, rule := range req.Sort {
+			if _, ok := fields[rule.Field]; !ok {
+				logger.WithNamespace("couchdb").
+					Warnf("The sort field %s is not in the selector of the find request", rule.Field)
+			}
+		}
+	}
+	return &req
+}
+
+// selectorFields returns the set of the fields used in a selector.
+func selectorFields(selector mango.Filter) map[string]struct{} {
+	var normalized interface{}
+	if data, err := json.Marshal(selector); err == nil {
+		_ = json.Unmarshal(data, &normalized)
+	}
+	fields := make(map[string]struct{})
+	collectSelectorFields("", normalized, fields)
+	return fields
+}
+
+func collectSelectorFields(prefix string, value interface{}, fields map[string]struct{}) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		for k, sub := range v {
+			if strings.HasPrefix(k, "$") {
+				collectSelectorFields(prefix, sub, fields)
+				continue
+			}
+			field := k
+			if prefix != "" {
+				field = prefix + "." + k
+			}
+			fields[field] = struct{}{}
+			collectSelectorFields(field, sub, fields)
+		}
+	case []interface{}:
+		for _, sub := range v {
+			collectSelectorFields(prefix, sub, fields)
+		}
+	}
+}
+
+// StabilizeSort adds _id as the last sort rule of the request, if it is not
+// already sorted by _id. Without it, the documents with the same values for
+// the sort fields can be returned in any order, and the pagination with a
+// bookmark can skip or duplicate some of them. The _id rule uses the
+// direction of the other rules, as CouchDB doesn't allow to mix them, and the
+// index used for the request must also have _id as its last field.
+func StabilizeSort(req *FindRequest) {
+	direction := mango.Asc
+	for _, rule := range req.Sort {
+		if rule.Field == "_id" {
+			return
+		}
+		direction = rule.Direction
+	}
+	req.Sort = append(req.Sort, mango.SortByField{Field: "_id", Direction: direction})
+}
+
+// FindDocsAny returns the documents that match at least one of the selectors.
+// Each selector is sent as a separate _find request, concurrently, so that
+// each one can use its own index, which is faster than a single $or that
+// CouchDB can't optimize. The documents are deduplicated, and returned in the
+// order of the selectors, then in the order of the results for each one.
+//
+// At most limit documents are returned (BulkBatchSize if limit is not
+// positive), and each selector fetches no more than limit documents, to
+// bound the memory used by the request.
+func FindDocsAny(db Database, doctype string, selectors []mango.Filter, limit int, results interface{}) error {
+	if limit <= 0 {
+		limit = BulkBatchSize
+	}
+	docs := make([][]json.RawMessage, len(selectors))
+	err := runConcurrently(context.Background(), len(selectors), func(i int) error {
+		var pages bookmarkTracker
+		bookmark := ""
+		for {
+			pageSize := limit - len(docs[i])
+			if pageSize > BulkBatchSize {
+				pageSize = BulkBatchSize
+			}
+			req := &FindRequest{
+				Selector: selectors[i],
+				Bookmark: bookmark,
+				Limit:    &pageSize,
+			}
+			var page []json.RawMessage
+			res, err := FindDocsRaw(db, doctype, req, &page)
+			if err != nil {
+				return err
+			}
+			if len(page) > 0 {
+				if err = pages.check(rawDocID(page[0])); err != nil {
+					return err
+				}
+			}
+			docs[i] = append(docs[i], page...)
+			if len(page) < pageSize || len(docs[i]) >= limit || res.Bookmark == "" {
+				return nil
+			}
+			bookmark = res.Bookmark
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	merged := mergeDocsByID(docs)
+	if len(merged) > limit {
+		merged = merged[:limit]
+	}
+	data, err := json.Marshal(merged)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, results)
+}
+
+// mergeDocsByID concatenates the lists of documents, without the duplicates
+// (same _id).
+func mergeDocsByID(lists [][]json.RawMessage) []json.RawMessage {
+	seen := make(map[string]struct{})
+	merged := make([]json.RawMessage, 0)
+	for _, list := range lists {
+		for _, doc := range list {
+			if id := rawDocID(doc); id != "" {
+				if _, ok := seen[id]; ok {
+					continue
+				}
+				seen[id] = struct{}{}
+			}
+			merged = append(merged, doc)
+		}
+	}
+	return merged
+}
+
+// bookmarkTracker detects the stale bookmarks while paginating the results of
+// a _find request. A bookmark is valid only for the generation of the index
+// that has been used to produce it: if the index is rebuilt, CouchDB ignores
+// it silently and returns the results from the start, which would produce
+// duplicates. It is detected when a page starts with the same document as the
+// first or the previous page.
+type bookmarkTracker struct {
+	first    string
+	previous string
+}
+
+func (t *bookmarkTracker) check(firstID string) error {
+	if firstID == "" {
+		return nil
+	}
+	if t.first == "" {
+		t.first = firstID
+		t.previous = firstID
+		return nil
+	}
+	if firstID == t.first || firstID == t.previous {
+		return newStaleBookmarkError()
+	}
+	t.previous = firstID
+	return nil
+}
+
+// rawDocID returns the _id of a JSON document, or an empty string.
+func rawDocID(doc json.RawMessage) string {
+	var ref struct {
+		ID string `json:"_id"`
+	}
+	if err := json.Unmarshal(doc, &ref); err != nil {
+		return ""
+	}
+	return ref.ID
+}
@@ -0,0 +1,162 @@
+package couchdb
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/cozy/cozy-stack/pkg/couchdb/mango"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestFindBuilder(t *testing.T) {
+	selector := mango.And(mango.Equal("dir_id", "123"), mango.Exists("name"))
+	req := NewFind(selector).
+		Sort(mango.AscBy("dir_id"), mango.AscBy("name")).
+		Fields("_id", "name").
+		Limit(10).
+		Bookmark("abc").
+		Build()
+	limit := 10
+	assert.Equal(t, &FindRequest{
+		Selector: selector,
+		Sort:     mango.SortBy{mango.AscBy("dir_id"), mango.AscBy("name")},
+		Fields:   []string{"_id", "name"},
+		Limit:    &limit,
+		Bookmark: "abc",
+	}, req)
+}
+
+func TestStabilizeSort(t *testing.T) {
+	req := &FindRequest{Selector: mango.Equal("dir_id", "123")}
+	StabilizeSort(req)
+	assert.Equal(t, mango.SortBy{mango.AscBy("_id")}, req.Sort)
+
+	req = &FindRequest{Sort: mango.SortBy{mango.DescBy("dir_id"), mango.DescBy("name")}}
+	StabilizeSort(req)
+	assert.Equal(t, mango.SortBy{mango.DescBy("dir_id"), mango.DescBy("name"), mango.DescBy("_id")}, req.Sort)
+
+	StabilizeSort(req)
+	assert.Len(t, req.Sort, 3)
+}
+
+func TestSelectorFields(t *testing.T) {
+	selector := mango.And(
+		mango.Equal("dir_id", "123"),
+		mango.Or(mango.Gt("metadata.size", 10), mango.Map{"metadata": mango.Map{"type": "image"}}),
+	)
+	fields := selectorFields(selector)
+	assert.Contains(t, fields, "dir_id")
+	assert.Contains(t, fields, "metadata.size")
+	assert.Contains(t, fields, "metadata.type")
+	assert.NotContains(t, fields, "$and")
+}
+
+func TestMergeDocsByID(t *testing.T) {
+	lists := [][]json.RawMessage{
+		{json.RawMessage(`{"_id":"b"}`), json.RawMessage(`{"_id":"a"}`)},
+		{json.RawMessage(`{"_id":"c"}`), json.RawMessage(`{"_id":"b"}`)},
+		{},
+	}
+	merged := mergeDocsByID(lists)
+	data, err := json.Marshal(merged)
+	assert.NoError(t, err)
+	assert.JSONEq(t, `[{"_id":"b"},{"_id":"a"},{"_id":"c"}]`, string(data))
+}
+
+func TestFindDocsAnyLimit(t *testing.T) {
+	var mu sync.Mutex
+	var limits []int
+	defer withFakeCouch(t, func(w http.ResponseWriter, r *http.Request) {
+		var req struct {
+			Selector map[string]string `json:"selector"`
+			Limit    int               `json:"limit"`
+			Bookmark string            `json:"bookmark"`
+		}
+		assert.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+		mu.Lock()
+		limits = append(limits, req.Limit)
+		mu.Unlock()
+		// Each selector matches an infinite number of documents
+		var docs []string
+		for i := 0; i < req.Limit; i++ {
+			docs = append(docs, fmt.Sprintf(`{"_id":"%s-%s-%d"}`, req.Selector["k"], req.Bookmark, i))
+		}
+		_, _ = fmt.Fprintf(w, `{"docs":[%s],"bookmark":"next%s"}`, strings.Join(docs, ","), req.Bookmark)
+	})()
+	batchSize := BulkBatchSize
+	defer func() { BulkBatchSize = batchSize }()
+	BulkBatchSize = 2
+
+	var out []map[string]interface{}
+	selectors := []mango.Filter{mango.Equal("k", "a"), mango.Equal("k", "b")}
+	assert.NoError(t, FindDocsAny(TestPrefix, TestDoctype, selectors, 3, &out))
+	if assert.Len(t, out, 3) {
+		assert.Equal(t, "a--0", out[0]["_id"])
+		assert.Equal(t, "a-next-0", out[2]["_id"])
+	}
+	// Each selector stops after 3 documents, with pages of 2 then 1 documents
+	assert.ElementsMatch(t, []int{2, 1, 2, 1}, limits)
+}
+
+func TestBookmarkTracker(t *testing.T) {
+	var pages bookmarkTracker
+	assert.NoError(t, pages.check("a"))
+	assert.NoError(t, pages.check("m"))
+	assert.NoError(t, pages.check("t"))
+	err := pages.check("a")
+	assert.True(t, IsStaleBookmarkError(err))
+
+	pages = bookmarkTracker{}
+	assert.NoError(t, pages.check("a"))
+	assert.NoError(t, pages.check("m"))
+	assert.True(t, IsStaleBookmarkError(pages.check("m")))
+}
+
+func TestFindRequestCountOnly(t *testing.T) {
+	req := &FindRequest{Selector: mango.Equal("dir_id", "123")}
+	data, err := json.Marshal(req)
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"selector":{"dir_id":"123"}}`, string(data))
+
+	req = NewFind(mango.Equal("dir_id", "123")).ExecutionStats(true).Build()
+	req.CountOnly = true
+	data, err = json.Marshal(req)
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"selector":{"dir_id":"123"},"limit":0,"execution_stats":true}`, string(data))
+}
+
+func TestFindRequestZeroLimitAndSkip(t *testing.T) {
+	// An unset limit or skip is not sent
+	req := &FindRequest{Selector: mango.Equal("dir_id", "123")}
+	data, err := json.Marshal(req)
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"selector":{"dir_id":"123"}}`, string(data))
+
+	// A literal 0 is sent
+	zero := 0
+	req = &FindRequest{Selector: mango.Equal("dir_id", "123"), Limit: &zero, Skip: &zero}
+	data, err = json.Marshal(req)
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"selector":{"dir_id":"123"},"limit":0,"skip":0}`, string(data))
+
+	ten := 10
+	req = &FindRequest{Selector: mango.Equal("dir_id", "123"), Limit: &ten, CountOnly: true}
+	data, err = json.Marshal(req)
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"selector":{"dir_id":"123"},"limit":0}`, string(data))
+	assert.Equal(t, 10, *req.Limit)
+
+	req = NewFind(mango.Equal("dir_id", "123")).Limit(0).Skip(0).Build()
+	data, err = json.Marshal(req)
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"selector":{"dir_id":"123"},"limit":0,"skip":0}`, string(data))
+
+	req = NewFind(mango.Equal("dir_id", "123")).Limit(0).Limit(10).Build()
+	data, err = json.Marshal(req)
+	assert.NoError(t, err)
+	assert.JSONEq(t, `{"selector":{"dir_id":"123"},"limit":10}`, string(data))
+}
@@ -0,0 +1,193 @@
+package couchdb
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+
+	"github.com/cozy/cozy-stack/pkg/couchdb/mango"
+	"github.com/cozy/cozy-stack/pkg/logger"
+)
+
+var queryIndexesMu sync.RWMutex
+var queryIndexes = make(map[string]map[string]string)
+
+// RegisterQueryIndex registers the index that should be used for the _find
+// requests on the doctype with a selector that has the given fingerprint (see
+// mango.Fingerprint). The use_index parameter of those requests is then
+// filled automatically, unless the request already has one. It avoids
+// CouchDB picking a worse index for those queries.
+func RegisterQueryIndex(doctype, selectorFingerprint, useIndex string) {
+	queryIndexesMu.Lock()
+	defer queryIndexesMu.Unlock()
+	if queryIndexes[doctype] == nil {
+		queryIndexes[doctype] = make(map[string]string)
+	}
+	queryIndexes[doctype][selectorFingerprint] = useIndex
+}
+
+// registeredQueryIndex returns the index registered for the selector of the
+// request, or an empty string.
+func registeredQueryIndex(doctype string, selector mango.Filter) string {
+	if selector == nil {
+		return ""
+	}
+	queryIndexesMu.RLock()
+	byFingerprint := queryIndexes[doctype]
+	queryIndexesMu.RUnlock()
+	if len(byFingerprint) == 0 {
+		return ""
+	}
+	fingerprint := mango.Fingerprint(selector)
+	queryIndexesMu.RLock()
+	defer queryIndexesMu.RUnlock()
+	return byFingerprint[fingerprint]
+}
+
+var indexUsageMu sync.Mutex
+var indexUsageEnabled bool
+var indexUsage = make(map[string]map[string]int)
+
+// TrackIndexUsage enables or disables the tracking of the indexes used by the
+// _find requests, for IndexUsageStats. It is disabled by default, as each
+// _find request is then followed by an _explain request, made in the
+// background.
+func TrackIndexUsage(enabled bool) {
+	indexUsageMu.Lock()
+	defer indexUsageMu.Unlock()
+	indexUsageEnabled = enabled
+}
+
+// IndexUsageStats returns, for the doctype, the number of _find requests that
+// have used each index since the tracking has been enabled. The indexes are
+// identified by their design doc, and "_all_docs" is used for the requests
+// without an index. It can be used to find the indexes that are never used.
+func IndexUsageStats(doctype string) map[string]int {
+	indexUsageMu.Lock()
+	defer indexUsageMu.Unlock()
+	stats := make(map[string]int, len(indexUsage[doctype]))
+	for index, count := range indexUsage[doctype] {
+		stats[index] = count
+	}
+	return stats
+}
+
+func isIndexUsageTracked() bool {
+	indexUsageMu.Lock()
+	defer indexUsageMu.Unlock()
+	return indexUsageEnabled
+}
+
+// explainIndex asks CouchDB which index is used by the _find request. The
+// indexes are identified by their design doc, and "_all_docs" is used for the
+// requests without an index.
+func explainIndex(db Database, doctype string, req interface{}) (string, error) {
+	var explain explainResponse
+	if err := makeRequest(db, doctype, http.MethodPost, "_explain", req, &explain); err != nil {
+		return "", err
+	}
+	if explain.Index.DesignDoc != nil {
+		return *explain.Index.DesignDoc, nil
+	}
+	return explain.Index.Name, nil
+}
+
+// trackIndexUsage asks CouchDB, in a goroutine, which index is used by the
+// _find request, and increments the counter for it. Like logIndexSelection,
+// it doesn't slow down the request, and the request is serialized before.
+func trackIndexUsage(db Database, doctype string, req interface{}) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return
+	}
+	go func() {
+		index, err := explainIndex(db, doctype, json.RawMessage(body))
+		if err != nil {
+			return
+		}
+		indexUsageMu.Lock()
+		defer indexUsageMu.Unlock()
+		if indexUsage[doctype] == nil {
+			indexUsage[doctype] = make(map[string]int)
+		}
+		indexUsage[doctype][index]++
+	}()
+}
+
+// logIndexSelection asks CouchDB, in a goroutine, which index it has chosen
+// for the _find request, and logs it. It is made to find the requests where
+// use_index should be pinned, and doesn't slow down the request. The request
+// is serialized before, as the caller may reuse it.
+func logIndexSelection(db Database, doctype string, req *FindRequest) {
+	body, err := json.Marshal(req)
+	if err != nil {
+		return
+	}
+	selector, _ := json.Marshal(req.Selector)
+	go func() {
+		index, err := explainIndex(db, doctype, json.RawMessage(body))
+		if err != nil {
+			return
+		}
+		logger.WithDomain(db.DomainName()).WithField("nspace", "couchdb").
+			Infof("Index selected by CouchDB for %s: %s (selector: %s)", doctype, index, selector)
+	}()
+}
+
+// SelectBestIndex returns the design doc of the mango index that should be
+// used for the _find request, to be set as its use_index, instead of letting
+// CouchDB guess. The candidates are the indexes with all their fields in the
+// selector or in the sort, and with all the sort fields. The index that
+// covers the most fields of the selector is chosen, and then the one with
+// the fewest fields. An empty string is returned if no index can be used.
+func SelectBestIndex(db Database, doctype string, req *FindRequest) (string, error) {
+	indexes, err := ListIndexes(db, doctype)
+	if err != nil {
+		return "", err
+	}
+	return bestIndex(indexes, req), nil
+}
+
+func bestIndex(indexes []*IndexInfo, req *FindRequest) string {
+	var selected map[string]struct{}
+	if req.Selector != nil {
+		selected = selectorFields(req.Selector)
+	}
+	best, bestCovered, bestSize := "", 0, 0
+	for _, index := range indexes {
+		fields := make(map[string]struct{})
+		covered, usable := 0, true
+		for _, name := range index.FieldNames() {
+			fields[name] = struct{}{}
+			if _, ok := selected[name]; ok {
+				covered++
+			} else if !isSortField(req.Sort, name) {
+				usable = false
+			}
+		}
+		for _, rule := range req.Sort {
+			if _, ok := fields[rule.Field]; !ok {
+				usable = false
+			}
+		}
+		if !usable || covered == 0 {
+			continue
+		}
+		size := len(fields)
+		if best == "" || covered > bestCovered ||
+			(covered == bestCovered && size < bestSize) ||
+			(covered == bestCovered && size == bestSize && index.DesignDoc < best) {
+			best, bestCovered, bestSize = index.DesignDoc, covered, size
+		}
+	}
+	return best
+}
+
+func isSortField(sort mango.SortBy, field string) bool {
+	for _, rule := range sort {
+		if rule.Field == field {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,141 @@
+package couchdb
+
+import (
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/config/config"
+	"github.com/cozy/cozy-stack/pkg/couchdb/mango"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRegisteredQueryIndex(t *testing.T) {
+	selector := mango.Equal("worker", "sendmail")
+	assert.Empty(t, registeredQueryIndex("io.cozy.hints", selector))
+	RegisterQueryIndex("io.cozy.hints", mango.Fingerprint(selector), "_design/by-worker")
+	assert.Equal(t, "_design/by-worker", registeredQueryIndex("io.cozy.hints", mango.Equal("worker", "push")))
+	assert.Empty(t, registeredQueryIndex("io.cozy.hints", mango.Equal("state", "done")))
+	assert.Empty(t, registeredQueryIndex("io.cozy.other", selector))
+}
+
+func TestIndexUsageStats(t *testing.T) {
+	err := DefineIndex(TestPrefix, mango.IndexOnFields(TestDoctype, "index-usage", []string{"fieldB"}))
+	assert.NoError(t, err)
+	TrackIndexUsage(true)
+	defer TrackIndexUsage(false)
+
+	var results []*testDoc
+	req := &FindRequest{Selector: mango.Equal("fieldB", 42)}
+	assert.NoError(t, FindDocs(TestPrefix, TestDoctype, req, &results))
+	assert.NoError(t, FindDocs(TestPrefix, TestDoctype, req, &results))
+	// The indexes are explained in the background
+	for i := 0; i < 500 && IndexUsageStats(TestDoctype)["_design/index-usage"] < 2; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	stats := IndexUsageStats(TestDoctype)
+	assert.Equal(t, 2, stats["_design/index-usage"])
+}
+
+func TestTrackIndexUsageInBackground(t *testing.T) {
+	release := make(chan struct{})
+	defer withFakeCouch(t, func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/_explain") {
+			<-release
+			_, _ = w.Write([]byte(`{"index": {"ddoc": "_design/by-state", "name": "by-state", "type": "json"}}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"docs": []}`))
+	})()
+	TrackIndexUsage(true)
+	defer TrackIndexUsage(false)
+
+	// The _find request doesn't wait for the _explain one
+	db := newDatabase("alice.cozy.tools")
+	var results []*testDoc
+	req := &FindRequest{Selector: mango.Equal("state", "queued")}
+	assert.NoError(t, FindDocs(db, "io.cozy.hints.usage", req, &results))
+	assert.Empty(t, IndexUsageStats("io.cozy.hints.usage"))
+
+	close(release)
+	for i := 0; i < 500 && len(IndexUsageStats("io.cozy.hints.usage")) == 0; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	assert.Equal(t, map[string]int{"_design/by-state": 1}, IndexUsageStats("io.cozy.hints.usage"))
+}
+
+func TestLogIndexSelection(t *testing.T) {
+	explained := make(chan string, 2)
+	defer withFakeCouch(t, func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/_explain") {
+			body, _ := ioutil.ReadAll(r.Body)
+			explained <- string(body)
+			_, _ = w.Write([]byte(`{"index": {"ddoc": "_design/by-worker", "name": "by-worker", "type": "json"}}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"docs": []}`))
+	})()
+	config.GetConfig().CouchDB.LogIndexSelection = true
+
+	db := newDatabase("alice.cozy.tools")
+	var results []*testDoc
+	req := &FindRequest{Selector: mango.Equal("state", "queued")}
+	assert.NoError(t, FindDocs(db, "io.cozy.hints", req, &results))
+	// The request can be reused by the caller while it is explained
+	req.Selector = mango.Equal("state", "done")
+	select {
+	case body := <-explained:
+		assert.Contains(t, body, "queued")
+	case <-time.After(5 * time.Second):
+		t.Fatal("the index selection has not been explained")
+	}
+
+	req = &FindRequest{Selector: mango.Equal("state", "queued"), UseIndex: "by-state"}
+	assert.NoError(t, FindDocs(db, "io.cozy.hints", req, &results))
+	select {
+	case <-explained:
+		t.Fatal("a request with use_index should not be explained")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestSelectBestIndex(t *testing.T) {
+	defer withFakeCouch(t, func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"indexes": [
+			{"ddoc": null, "name": "_all_docs", "type": "special", "def": {"fields": [{"_id": "asc"}]}},
+			{"ddoc": "_design/by-worker", "name": "by-worker", "type": "json", "def": {"fields": [{"worker": "asc"}]}},
+			{"ddoc": "_design/by-worker-state-date", "name": "a", "type": "json", "def": {"fields": [{"worker": "asc"}, {"state": "asc"}, {"date": "asc"}]}},
+			{"ddoc": "_design/by-worker-state", "name": "b", "type": "json", "def": {"fields": [{"worker": "asc"}, {"state": "asc"}]}},
+			{"ddoc": "_design/by-state-date", "name": "c", "type": "json", "def": {"fields": [{"state": "asc"}, {"date": "asc"}]}},
+			{"ddoc": "_design/by-meta", "name": "d", "type": "json", "def": {"fields": [{"metadata.status": "asc"}]}}
+		]}`))
+	})()
+	db := newDatabase("alice.cozy.tools")
+
+	req := &FindRequest{Selector: mango.And(mango.Equal("worker", "push"), mango.Equal("state", "done"))}
+	index, err := SelectBestIndex(db, "io.cozy.hints", req)
+	assert.NoError(t, err)
+	assert.Equal(t, "_design/by-worker-state", index)
+
+	req.Sort = mango.SortBy{{Field: "date", Direction: mango.Asc}}
+	index, err = SelectBestIndex(db, "io.cozy.hints", req)
+	assert.NoError(t, err)
+	assert.Equal(t, "_design/by-worker-state-date", index)
+
+	req = &FindRequest{Selector: mango.Equal("worker", "push")}
+	index, err = SelectBestIndex(db, "io.cozy.hints", req)
+	assert.NoError(t, err)
+	assert.Equal(t, "_design/by-worker", index)
+
+	req = &FindRequest{Selector: mango.Map{"metadata": map[string]interface{}{"status": "ok"}}}
+	index, err = SelectBestIndex(db, "io.cozy.hints", req)
+	assert.NoError(t, err)
+	assert.Equal(t, "_design/by-meta", index)
+
+	req = &FindRequest{Selector: mango.Equal("name", "foo")}
+	index, err = SelectBestIndex(db, "io.cozy.hints", req)
+	assert.NoError(t, err)
+	assert.Empty(t, index)
+}
@@ -1,6 +1,8 @@
 package couchdb
 
 import (
+	"sync"
+
 	"github.com/cozy/cozy-stack/pkg/prefixer"
 	"github.com/cozy/cozy-stack/pkg/realtime"
 )
@@ -49,3 +51,75 @@ func AddHook(doctype, event string, hook listener) {
 	}
 	hooks[k] = append(hs, hook)
 }
+
+// Observer is a function called synchronously by RTEvent, just before the
+// event is published on the realtime hub. Contrary to the hooks, it cannot
+// block the event, and it must not modify the documents.
+type Observer func(db prefixer.Prefixer, verb string, doc Doc, old Doc)
+
+var observersMu sync.RWMutex
+var observers map[string]Observer
+
+// OnEvent registers an observer for the events on the given doctype. It
+// replaces the previous observer of this doctype, and a nil observer removes
+// it. It is mostly useful for tests, to check that a write has produced the
+// expected event without subscribing to the realtime hub.
+func OnEvent(doctype string, fn Observer) {
+	observersMu.Lock()
+	defer observersMu.Unlock()
+	if fn == nil {
+		delete(observers, doctype)
+		return
+	}
+	if observers == nil {
+		observers = make(map[string]Observer)
+	}
+	observers[doctype] = fn
+}
+
+func observeEvent(db Database, verb string, doc Doc, old Doc) {
+	observersMu.RLock()
+	fn, ok := observers[doc.DocType()]
+	observersMu.RUnlock()
+	if ok {
+		fn(db, verb, doc, old)
+	}
+}
+
+// WriteSink receives a copy of all the writes made on CouchDB, after they
+// have succeeded. It can be used to feed a search index or an audit log. The
+// sink is called synchronously, so a slow sink slows down the writes: it
+// should push the write in a queue if it has some heavy work to do.
+type WriteSink interface {
+	OnWrite(db prefixer.Prefixer, verb string, doctype string, doc Doc)
+}
+
+type noopWriteSink struct{}
+
+func (noopWriteSink) OnWrite(db prefixer.Prefixer, verb string, doctype string, doc Doc) {}
+
+var writeSinkMu sync.RWMutex
+var writeSink WriteSink = noopWriteSink{}
+
+// SetWriteSink configures the sink that will receive the writes made by the
+// functions of this package: CreateDoc, UpdateDoc, DeleteDoc and their
+// variants, the bulk writes (BulkUpdateDocs, DeleteBySelector, etc.), the
+// maintenance operations (MigrateDoctype, MoveDocs), ExecUpdate and the
+// _bulk_docs requests of the proxy. The writes made by CouchDB itself, like
+// the replications, are not seen. A nil sink restores the default one, that
+// does nothing.
+func SetWriteSink(sink WriteSink) {
+	writeSinkMu.Lock()
+	defer writeSinkMu.Unlock()
+	if sink == nil {
+		sink = noopWriteSink{}
+	}
+	writeSink = sink
+}
+
+func teeWrite(db Database, verb string, doc Doc) {
+	writeSinkMu.RLock()
+	sink := writeSink
+	writeSinkMu.RUnlock()
+	sink.OnWrite(db, verb, doc.DocType(), doc)
+}
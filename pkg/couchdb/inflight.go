@@ -0,0 +1,76 @@
+package couchdb
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// inFlight is the number of requests to CouchDB in progress, by prefix. The
+// counters are never removed, as the number of prefixes is bounded by the
+// number of instances.
+var inFlight sync.Map // prefix -> *int64
+
+// inFlightTotal is the number of requests to CouchDB in progress, for all the
+// prefixes.
+var inFlightTotal int64
+
+// draining is set to 1 when Drain has been called, and back to 0 by Undrain.
+var draining int32
+
+// drainPollInterval is the delay between two checks of the requests in
+// progress in Drain.
+var drainPollInterval = 10 * time.Millisecond
+
+// InFlightRequests returns the number of requests to CouchDB that are in
+// progress for the given prefix. It can be used by the metrics to find the
+// instances that saturate the connection pool.
+func InFlightRequests(prefix string) int {
+	if counter, ok := inFlight.Load(prefix); ok {
+		return int(atomic.LoadInt64(counter.(*int64)))
+	}
+	return 0
+}
+
+// trackInFlight increments the counter of requests in progress for the
+// prefix, and returns a function to decrement it when the request is done.
+func trackInFlight(prefix string) func() {
+	counter, ok := inFlight.Load(prefix)
+	if !ok {
+		counter, _ = inFlight.LoadOrStore(prefix, new(int64))
+	}
+	atomic.AddInt64(counter.(*int64), 1)
+	atomic.AddInt64(&inFlightTotal, 1)
+	return func() {
+		atomic.AddInt64(counter.(*int64), -1)
+		atomic.AddInt64(&inFlightTotal, -1)
+	}
+}
+
+// Drain is called on the shutdown of the stack: the new requests to CouchDB
+// are rejected with an error (see IsDrainingError), and it waits until the
+// requests in progress have finished, or until the context is done. It
+// avoids cutting the writes in the middle, where their result is unknown.
+// Undrain can be called to accept the new requests again.
+func Drain(ctx context.Context) error {
+	atomic.StoreInt32(&draining, 1)
+	for atomic.LoadInt64(&inFlightTotal) > 0 {
+		select {
+		case <-time.After(drainPollInterval):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return nil
+}
+
+// Undrain accepts again the new requests to CouchDB after a call to Drain,
+// for example when the shutdown has been aborted.
+func Undrain() {
+	atomic.StoreInt32(&draining, 0)
+}
+
+func isDraining() bool {
+	return atomic.LoadInt32(&draining) == 1
+}
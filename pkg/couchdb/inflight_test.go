@@ -0,0 +1,102 @@
+package couchdb
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInFlightRequests(t *testing.T) {
+	assert.Equal(t, 0, InFlightRequests("inflight-test"))
+	done1 := trackInFlight("inflight-test")
+	done2 := trackInFlight("inflight-test")
+	assert.Equal(t, 2, InFlightRequests("inflight-test"))
+	assert.Equal(t, 0, InFlightRequests("other-prefix"))
+	done1()
+	assert.Equal(t, 1, InFlightRequests("inflight-test"))
+	done2()
+	assert.Equal(t, 0, InFlightRequests("inflight-test"))
+}
+
+func TestDrain(t *testing.T) {
+	defer Undrain()
+	interval := drainPollInterval
+	drainPollInterval = time.Millisecond
+	defer func() { drainPollInterval = interval }()
+
+	done := trackInFlight("drain-test")
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		done()
+	}()
+	assert.NoError(t, Drain(context.Background()))
+	assert.Equal(t, 0, InFlightRequests("drain-test"))
+
+	err := makeRequest(newDatabase("drain-test"), "io.cozy.tests", http.MethodGet, "doc", nil, nil)
+	assert.True(t, IsDrainingError(err))
+	_, err = makeRawRequest(newDatabase("drain-test"), "io.cozy.tests", http.MethodGet, "doc", nil)
+	assert.True(t, IsDrainingError(err))
+
+	done = trackInFlight("drain-test")
+	defer done()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, Drain(ctx))
+}
+
+func TestUndrain(t *testing.T) {
+	defer Undrain()
+	defer withFakeCouch(t, func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte(`{"_id": "doc", "_rev": "1-abc"}`))
+	})()
+
+	db := newDatabase("undrain-test")
+	assert.NoError(t, Drain(context.Background()))
+	err := makeRequest(db, "io.cozy.tests", http.MethodGet, "doc", nil, nil)
+	assert.True(t, IsDrainingError(err))
+
+	Undrain()
+	var doc JSONDoc
+	assert.NoError(t, makeRequest(db, "io.cozy.tests", http.MethodGet, "doc", nil, &doc))
+	assert.Equal(t, "1-abc", doc.Rev())
+	res, err := makeRawRequest(db, "io.cozy.tests", http.MethodGet, "doc", nil)
+	if assert.NoError(t, err) {
+		res.Body.Close()
+	}
+}
+
+func TestDrainWaitsForExecUpdate(t *testing.T) {
+	defer Undrain()
+	interval := drainPollInterval
+	drainPollInterval = time.Millisecond
+	defer func() { drainPollInterval = interval }()
+
+	release := make(chan struct{})
+	defer withFakeCouch(t, func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		w.Header().Set("X-Couch-Update-NewRev", "1-abc")
+		w.WriteHeader(http.StatusCreated)
+	})()
+
+	db := newDatabase("drain-update-test")
+	errc := make(chan error)
+	go func() {
+		_, err := ExecUpdate(db, "io.cozy.tests", "counters", "incr", "doc", nil)
+		errc <- err
+	}()
+	for InFlightRequests("drain-update-test") == 0 {
+		time.Sleep(time.Millisecond)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	assert.Equal(t, context.DeadlineExceeded, Drain(ctx))
+
+	close(release)
+	assert.NoError(t, Drain(context.Background()))
+	assert.NoError(t, <-errc)
+	assert.Equal(t, 0, InFlightRequests("drain-update-test"))
+}
@@ -0,0 +1,705 @@
+package couchdb
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/logger"
+	"github.com/cozy/cozy-stack/pkg/realtime"
+)
+
+// reshardSuffix is added to the doctype for the name of the temporary
+// database used while resharding.
+const reshardSuffix = ".reshard"
+
+// reshardStateID is the ID of the local document, in the temporary database,
+// where ReshardDoctype records its progress to be resumed after an
+// interruption.
+const reshardStateID = "reshard-state"
+
+// The steps of ReshardDoctype recorded in its state document.
+const (
+	reshardCopied  = "copied"
+	reshardDeleted = "deleted"
+)
+
+// ReshardDoctype moves the documents of a doctype to a database with
+// newShards shards. As CouchDB cannot change the number of shards of an
+// existing database, the documents are replicated to a temporary database,
+// then the database of the doctype is recreated and the documents are
+// replicated back. The number of documents is verified before each deletion.
+//
+// The writes on the doctype must be blocked by the caller during the
+// operation, for example by putting the instance in maintenance. A write
+// during the first copy is detected, and the operation fails before deleting
+// anything. But a write after the deletion of the database of the doctype
+// would recreate it with the default number of shards, and mix with the
+// documents replicated back.
+//
+// The progress is recorded in the temporary database, so that an interrupted
+// operation can be resumed by calling it again.
+func ReshardDoctype(db Database, doctype string, newShards int) error {
+	if newShards <= 0 {
+		return errors.New("ReshardDoctype: the number of shards must be positive")
+	}
+	tmp := doctype + reshardSuffix
+	opts := DBCreateOptions{Q: newShards}
+
+	step, err := reshardStep(db, tmp)
+	if err != nil {
+		return err
+	}
+	if step == "" {
+		before, err := DBStatus(db, doctype)
+		if err != nil {
+			return err
+		}
+		if err = copyDatabase(db, doctype, tmp, opts); err != nil {
+			return err
+		}
+		after, err := DBStatus(db, doctype)
+		if err != nil {
+			return err
+		}
+		if after.UpdateSeq != before.UpdateSeq {
+			return fmt.Errorf("ReshardDoctype: %s has been written during the copy", doctype)
+		}
+		if err = setReshardStep(db, tmp, reshardCopied); err != nil {
+			return err
+		}
+		step = reshardCopied
+	}
+	if step == reshardCopied {
+		if err = DeleteDB(db, doctype); err != nil && !IsNoDatabaseError(err) {
+			return err
+		}
+		if err = setReshardStep(db, tmp, reshardDeleted); err != nil {
+			return err
+		}
+	}
+
+	if err = copyDatabase(db, tmp, doctype, opts); err != nil {
+		return err
+	}
+	return DeleteDB(db, tmp)
+}
+
+// reshardStep returns the last step of ReshardDoctype recorded in the
+// temporary database, or an empty string if the operation has not started.
+func reshardStep(db Database, tmp string) (string, error) {
+	state, err := GetLocal(db, tmp, reshardStateID)
+	if IsNotFoundError(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	step, _ := state["step"].(string)
+	return step, nil
+}
+
+func setReshardStep(db Database, tmp, step string) error {
+	state, err := GetLocal(db, tmp, reshardStateID)
+	if err != nil && !IsNotFoundError(err) {
+		return err
+	}
+	if state == nil {
+		state = make(map[string]interface{})
+	}
+	state["step"] = step
+	return PutLocal(db, tmp, reshardStateID, state)
+}
+
+// copyDatabase replicates all the documents of a database to another one,
+// created with the given options if it doesn't exist, and checks that they
+// have the same number of documents.
+func copyDatabase(db Database, from, to string, opts DBCreateOptions) error {
+	if err := CreateDBWithOptions(db, to, opts); err != nil && !IsFileExists(err) {
+		return err
+	}
+	if _, err := Replicate(db, DatabaseURL(db, from), DatabaseURL(db, to)); err != nil {
+		return err
+	}
+	source, err := DBStatus(db, from)
+	if err != nil {
+		return err
+	}
+	target, err := DBStatus(db, to)
+	if err != nil {
+		return err
+	}
+	if source.DocCount != target.DocCount {
+		return fmt.Errorf("Documents count mismatch between %s (%d) and %s (%d)",
+			from, source.DocCount, to, target.DocCount)
+	}
+	return nil
+}
+
+// RenameDoctype moves all the documents of a doctype, including the design
+// docs with the views and indexes, to the database of a new doctype, and
+// deletes the old database. The documents are replicated, and the number of
+// documents is verified before the deletion.
+//
+// The references to the old doctype inside the documents (referenced_by,
+// relationships, permissions, etc.) are not updated: MigrateDoctype can be
+// used for that. The writes on the old doctype must be blocked during the
+// operation, as they may be lost. If it is interrupted, it can be resumed by
+// calling it again.
+func RenameDoctype(db Database, oldDoctype, newDoctype string) error {
+	if oldDoctype == "" || newDoctype == "" || oldDoctype == newDoctype {
+		return errors.New("RenameDoctype: the doctypes must be different and not empty")
+	}
+	_, err := DBStatus(db, oldDoctype)
+	if IsNoDatabaseError(err) {
+		// A previous run has been interrupted after the deletion of the old
+		// database, or it has never existed.
+		_, err = DBStatus(db, newDoctype)
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	if err = copyDatabase(db, oldDoctype, newDoctype, DBCreateOptions{}); err != nil {
+		return err
+	}
+	return DeleteDB(db, oldDoctype)
+}
+
+// CompactDB starts the compaction of the database of the doctype. CouchDB
+// runs it in the background, and DBStatus can be used to know when it has
+// finished (CompactRunning).
+func CompactDB(db Database, doctype string) error {
+	return makeRequest(db, doctype, http.MethodPost, "_compact", struct{}{}, nil)
+}
+
+// compactPollMinInterval and compactPollMaxInterval are the bounds of the
+// delay between two checks of the compaction in CompactDBWait.
+var (
+	compactPollMinInterval = 200 * time.Millisecond
+	compactPollMaxInterval = 10 * time.Second
+)
+
+// CompactDBWait starts the compaction of the database of the doctype, and
+// waits until it has finished, or until the context is done. It returns
+// immediately if the database has nothing to reclaim. If a compaction is
+// already running, it waits for it without starting a new one.
+//
+// The status of the database is polled with an exponential backoff.
+func CompactDBWait(ctx context.Context, db Database, doctype string) error {
+	status, err := DBStatus(db, doctype)
+	if err != nil {
+		return err
+	}
+	if !status.CompactRunning {
+		if status.fragmentation() == 0 {
+			return nil
+		}
+		if err = CompactDB(db, doctype); err != nil {
+			return err
+		}
+	}
+
+	interval := compactPollMinInterval
+	for {
+		select {
+		case <-time.After(interval):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		status, err = DBStatus(db, doctype)
+		if err != nil {
+			return err
+		}
+		if !status.CompactRunning {
+			return nil
+		}
+		interval *= 2
+		if interval > compactPollMaxInterval {
+			interval = compactPollMaxInterval
+		}
+	}
+}
+
+// AutoCompact starts the compaction of the databases of the instance with a
+// fragmentation above the threshold (see DBFragmentation), and returns the
+// doctypes of the compacted databases. The databases that are already being
+// compacted are skipped.
+func AutoCompact(db Database, threshold float64) ([]string, error) {
+	return compactDatabases(context.Background(), db, threshold)
+}
+
+// CompactInstance starts the compaction of all the databases of the instance,
+// except those that are already being compacted, and returns their doctypes.
+// It can be used to reclaim the disk space after a lot of deletions.
+func CompactInstance(db Database) ([]string, error) {
+	return CompactInstanceCtx(context.Background(), db)
+}
+
+// CompactInstanceCtx is like CompactInstance, but no more compaction is
+// started once the context is done.
+func CompactInstanceCtx(ctx context.Context, db Database) ([]string, error) {
+	return compactDatabases(ctx, db, -1)
+}
+
+// compactDatabases starts the compaction of the databases of the instance
+// with a fragmentation above the threshold, concurrently within the limit of
+// SetMaxConcurrency.
+func compactDatabases(ctx context.Context, db Database, threshold float64) ([]string, error) {
+	doctypes, err := AllDoctypes(db)
+	if err != nil {
+		return nil, err
+	}
+
+	var mu sync.Mutex
+	var compacted []string
+	err = runConcurrently(ctx, len(doctypes), func(i int) error {
+		status, err := DBStatus(db, doctypes[i])
+		if IsNoDatabaseError(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if status.CompactRunning || status.fragmentation() <= threshold {
+			return nil
+		}
+		if err := CompactDB(db, doctypes[i]); err != nil {
+			return err
+		}
+		mu.Lock()
+		compacted = append(compacted, doctypes[i])
+		mu.Unlock()
+		return nil
+	})
+	sort.Strings(compacted)
+	return compacted, err
+}
+
+// MigrateDoctype calls the transform function on all the documents of the
+// doctype, and saves the documents that it has changed, by batches of
+// BulkBatchSize. It returns the number of migrated documents. The errors on
+// the individual documents (from the transform function or a conflict) don't
+// stop the migration: they are returned at the end in a MigrationError.
+//
+// The transform function must skip the documents that have already been
+// migrated, so that the migration can be run again. If it is interrupted by a
+// restart of CouchDB, a StreamInterruptedError is returned and the migration
+// can be resumed with MigrateDoctypeFrom.
+func MigrateDoctype(db Database, doctype string, transform func(*JSONDoc) (bool, error)) (int, error) {
+	return MigrateDoctypeFrom(db, doctype, "", transform)
+}
+
+// MigrateDoctypeFrom is like MigrateDoctype, but it starts after the document
+// with the given ID.
+func MigrateDoctypeFrom(db Database, doctype, startKey string, transform func(*JSONDoc) (bool, error)) (int, error) {
+	log := logger.WithDomain(db.DomainName()).WithField("nspace", "couchdb")
+	migrated := 0
+	failed := make(map[string]error)
+	var docs, olds []*JSONDoc
+
+	flush := func() error {
+		if len(docs) == 0 {
+			return nil
+		}
+		encoded := make([]json.RawMessage, len(docs))
+		for i, doc := range docs {
+			data, err := json.Marshal(doc)
+			if err != nil {
+				return err
+			}
+			encoded[i] = data
+		}
+		err := bulkDocs(db, doctype, encoded, BulkBatchSize, func(offset int, res []UpdateResponse) error {
+			for j := range res {
+				doc := docs[offset+j]
+				if res[j].Error != "" {
+					failed[doc.ID()] = fmt.Errorf("%s: %s", res[j].Error, res[j].Reason)
+					continue
+				}
+				doc.SetRev(res[j].Rev)
+				RTEvent(db, realtime.EventUpdate, doc, olds[offset+j])
+				teeWrite(db, realtime.EventUpdate, doc)
+				migrated++
+			}
+			return nil
+		})
+		docs, olds = docs[:0], olds[:0]
+		log.Infof("migration of %s: %d documents migrated, %d errors", doctype, migrated, len(failed))
+		return err
+	}
+
+	err := transformDocs(db, doctype, startKey, failed, transform, func(doc, old *JSONDoc) error {
+		docs = append(docs, doc)
+		olds = append(olds, old)
+		if len(docs) >= BulkBatchSize {
+			return flush()
+		}
+		return nil
+	})
+	if _, ok := IsStreamInterruptedError(err); ok {
+		if errf := flush(); errf != nil {
+			return migrated, errf
+		}
+		return migrated, err
+	}
+	if err == nil {
+		err = flush()
+	}
+	if err != nil {
+		return migrated, err
+	}
+	if len(failed) > 0 {
+		return migrated, &MigrationError{Errors: failed}
+	}
+	return migrated, nil
+}
+
+// MigrationSample is a document before and after the transform function of a
+// migration.
+type MigrationSample struct {
+	Before *JSONDoc `json:"before"`
+	After  *JSONDoc `json:"after"`
+}
+
+// DryRunMigrateDoctype runs the transform function on all the documents of
+// the doctype, like MigrateDoctype, but without saving them. It returns the
+// number of documents that would be migrated, and up to maxSamples examples
+// of the changes.
+func DryRunMigrateDoctype(db Database, doctype string, transform func(*JSONDoc) (bool, error), maxSamples int) (int, []MigrationSample, error) {
+	count := 0
+	failed := make(map[string]error)
+	var samples []MigrationSample
+	err := transformDocs(db, doctype, "", failed, transform, func(doc, old *JSONDoc) error {
+		count++
+		if len(samples) < maxSamples {
+			samples = append(samples, MigrationSample{Before: old, After: doc})
+		}
+		return nil
+	})
+	if err != nil {
+		return count, samples, err
+	}
+	if len(failed) > 0 {
+		return count, samples, &MigrationError{Errors: failed}
+	}
+	return count, samples, nil
+}
+
+// transformDocs calls the transform function on the documents of the doctype,
+// after startKey, and fn with the documents that have been changed and their
+// original version. The errors for the individual documents are added to
+// failed.
+func transformDocs(db Database, doctype, startKey string, failed map[string]error, transform func(*JSONDoc) (bool, error), fn func(doc, old *JSONDoc) error) error {
+	return StreamAllDocsFrom(db, doctype, startKey, false, func(id, rev string, raw json.RawMessage) error {
+		doc := &JSONDoc{Type: doctype}
+		if err := json.Unmarshal(raw, &doc.M); err != nil {
+			failed[id] = err
+			return nil
+		}
+		old := doc.Clone().(*JSONDoc)
+		changed, err := transform(doc)
+		if err != nil {
+			failed[id] = err
+			return nil
+		}
+		if !changed {
+			return nil
+		}
+		return fn(doc, old)
+	})
+}
+
+// MoveDocs moves the documents with the given IDs from a doctype to another
+// one: they are created in the database of toDoctype, with the same IDs and
+// attachments, and deleted from the database of fromDoctype. A document is
+// deleted only if it can be read in the target database with the same
+// content, and the failures are returned in a MigrationError. If the target
+// database already has a different document with the same ID, it is reported
+// as a collision and the source document is kept. It can be called again
+// after an interruption: the documents already created in the target database
+// are just deleted from the source.
+func MoveDocs(db Database, fromDoctype, toDoctype string, ids []string) error {
+	if len(ids) == 0 {
+		return nil
+	}
+	var sources []*JSONDoc
+	if err := GetAllDocs(db, fromDoctype, &AllDocsRequest{Keys: ids}, &sources); err != nil {
+		return err
+	}
+	if err := CreateDB(db, toDoctype); err != nil && !IsFileExists(err) {
+		return err
+	}
+	targets, err := existingDocs(db, toDoctype, ids)
+	if err != nil {
+		return err
+	}
+
+	failed := make(map[string]error)
+	var encoded []json.RawMessage
+	var created []*JSONDoc
+	for _, doc := range sources {
+		if doc == nil || targets[doc.ID()] != nil {
+			continue
+		}
+		copied, err := copyForMove(db, fromDoctype, toDoctype, doc)
+		if err != nil {
+			failed[doc.ID()] = err
+			continue
+		}
+		data, err := json.Marshal(copied)
+		if err != nil {
+			failed[doc.ID()] = err
+			continue
+		}
+		encoded = append(encoded, data)
+		created = append(created, copied)
+	}
+	err = bulkDocs(db, toDoctype, encoded, BulkBatchSize, func(offset int, res []UpdateResponse) error {
+		for j := range res {
+			doc := created[offset+j]
+			if res[j].Error != "" {
+				failed[doc.ID()] = fmt.Errorf("%s: %s", res[j].Error, res[j].Reason)
+				continue
+			}
+			doc.SetRev(res[j].Rev)
+			RTEvent(db, realtime.EventCreate, doc, nil)
+			teeWrite(db, realtime.EventCreate, doc)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// Check that the documents are in the target database, with the same
+	// content, before deleting them from the source one.
+	targets, err = existingDocs(db, toDoctype, ids)
+	if err != nil {
+		return err
+	}
+	var toDelete []*JSONDoc
+	var deletions []json.RawMessage
+	for _, doc := range sources {
+		if doc == nil || targets[doc.ID()] == nil {
+			continue
+		}
+		if !sameContent(doc, targets[doc.ID()]) {
+			failed[doc.ID()] = errors.New("a different document with the same ID exists in the target doctype")
+			continue
+		}
+		data, err := json.Marshal(map[string]interface{}{
+			"_id":      doc.ID(),
+			"_rev":     doc.Rev(),
+			"_deleted": true,
+		})
+		if err != nil {
+			return err
+		}
+		toDelete = append(toDelete, doc)
+		deletions = append(deletions, data)
+	}
+	err = bulkDocs(db, fromDoctype, deletions, BulkBatchSize, func(offset int, res []UpdateResponse) error {
+		for j := range res {
+			doc := toDelete[offset+j]
+			if res[j].Error != "" {
+				failed[doc.ID()] = fmt.Errorf("%s: %s", res[j].Error, res[j].Reason)
+				continue
+			}
+			doc.SetRev(res[j].Rev)
+			RTEvent(db, realtime.EventDelete, doc, nil)
+			teeWrite(db, realtime.EventDelete, doc)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, id := range ids {
+		if targets[id] == nil {
+			if _, ok := failed[id]; !ok {
+				failed[id] = errors.New("document not found")
+			}
+		}
+	}
+	if len(failed) > 0 {
+		return &MigrationError{Errors: failed}
+	}
+	return nil
+}
+
+// copyForMove returns a copy of the document for the target doctype of
+// MoveDocs, without its revision. The attachments of the document are stubs,
+// so they are fetched from CouchDB to be sent inline.
+func copyForMove(db Database, fromDoctype, toDoctype string, doc *JSONDoc) (*JSONDoc, error) {
+	copied := doc.Clone().(*JSONDoc)
+	if _, ok := doc.M["_attachments"]; ok {
+		copied.M = nil
+		u := url.PathEscape(doc.ID()) + "?attachments=true&rev=" + url.QueryEscape(doc.Rev())
+		if err := makeRequest(db, fromDoctype, http.MethodGet, u, nil, &copied.M); err != nil {
+			return nil, err
+		}
+		atts, _ := copied.M["_attachments"].(map[string]interface{})
+		for name, att := range atts {
+			att, _ := att.(map[string]interface{})
+			atts[name] = map[string]interface{}{
+				"content_type": att["content_type"],
+				"data":         att["data"],
+			}
+		}
+	}
+	copied.Type = toDoctype
+	delete(copied.M, "_rev")
+	return copied, nil
+}
+
+// sameContent returns true if the two documents have the same fields and
+// attachments, whatever their revisions.
+func sameContent(a, b *JSONDoc) bool {
+	if len(a.M) != len(b.M) {
+		return false
+	}
+	for k, v := range a.M {
+		switch k {
+		case "_rev":
+		case "_attachments":
+			if !sameAttachments(v, b.M[k]) {
+				return false
+			}
+		default:
+			if !reflect.DeepEqual(v, b.M[k]) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// sameAttachments compares the attachment stubs of two documents by their
+// names and digests.
+func sameAttachments(a, b interface{}) bool {
+	atts, _ := a.(map[string]interface{})
+	others, _ := b.(map[string]interface{})
+	if len(atts) != len(others) {
+		return false
+	}
+	for name, att := range atts {
+		att, _ := att.(map[string]interface{})
+		other, _ := others[name].(map[string]interface{})
+		if att == nil || other == nil || att["digest"] != other["digest"] {
+			return false
+		}
+	}
+	return true
+}
+
+// existingDocs returns the documents of the doctype with the given IDs, by
+// ID.
+func existingDocs(db Database, doctype string, ids []string) (map[string]*JSONDoc, error) {
+	var docs []*JSONDoc
+	if err := GetAllDocs(db, doctype, &AllDocsRequest{Keys: ids}, &docs); err != nil {
+		return nil, err
+	}
+	existing := make(map[string]*JSONDoc, len(docs))
+	for _, doc := range docs {
+		if doc != nil {
+			existing[doc.ID()] = doc
+		}
+	}
+	return existing, nil
+}
+
+// OrphanDatabases returns the names of the databases of the instance that
+// are not for one of the known doctypes, like the databases left by an
+// uninstalled app. They can be reviewed before being deleted.
+func OrphanDatabases(db Database, knownDoctypes []string) ([]string, error) {
+	dbs, err := allDbs(db)
+	if err != nil {
+		return nil, err
+	}
+	return orphanDBNames(db, dbs, knownDoctypes), nil
+}
+
+func orphanDBNames(db Database, dbs, knownDoctypes []string) []string {
+	known := make(map[string]struct{}, len(knownDoctypes))
+	for _, doctype := range knownDoctypes {
+		known[EscapeCouchdbName(db.DBPrefix()+"/"+doctype)] = struct{}{}
+	}
+	var orphans []string
+	for _, dbname := range dbs {
+		if _, ok := DoctypeFromDBName(db, dbname); !ok {
+			continue
+		}
+		if _, ok := known[dbname]; !ok {
+			orphans = append(orphans, dbname)
+		}
+	}
+	return orphans
+}
+
+// maintenanceLockID is the ID of the local document used as an advisory lock
+// by the maintenance operations.
+const maintenanceLockID = "maintenance-lock"
+
+// AcquireMaintenanceLock takes an advisory lock on the database of the
+// doctype, to avoid running several maintenance operations (reshard,
+// migration, etc.) on it at the same time. The lock is a local document,
+// written with a compare-and-swap on its revision, and it expires after ttl
+// to avoid a deadlock if the owner crashes. The same owner can take the lock
+// again to extend it.
+//
+// If the lock is held by another owner, an error checked by
+// IsMaintenanceLockedError is returned. Else, the release function must be
+// called at the end of the maintenance.
+func AcquireMaintenanceLock(db Database, doctype, owner string, ttl time.Duration) (func(), error) {
+	if owner == "" {
+		return nil, errors.New("AcquireMaintenanceLock: the owner is required")
+	}
+	lock := map[string]interface{}{}
+	current, err := GetLocal(db, doctype, maintenanceLockID)
+	if err != nil && (IsNoDatabaseError(err) || !IsNotFoundError(err)) {
+		return nil, err
+	}
+	if current != nil {
+		holder, _ := current["owner"].(string)
+		expires, _ := current["expires_at"].(string)
+		at, errp := time.Parse(time.RFC3339Nano, expires)
+		if holder != owner && errp == nil && time.Now().Before(at) {
+			return nil, newMaintenanceLockedError(holder)
+		}
+		lock["_rev"] = current["_rev"]
+	}
+
+	lock["owner"] = owner
+	lock["expires_at"] = time.Now().Add(ttl).UTC().Format(time.RFC3339Nano)
+	if err = PutLocal(db, doctype, maintenanceLockID, lock); err != nil {
+		if IsConflictError(err) {
+			// Another owner has taken the lock between our read and write
+			return nil, newMaintenanceLockedError("another owner")
+		}
+		return nil, err
+	}
+
+	release := func() {
+		current, err := GetLocal(db, doctype, maintenanceLockID)
+		if err != nil || current["owner"] != owner {
+			// The lock has expired and has been taken by someone else
+			return
+		}
+		rev, _ := current["_rev"].(string)
+		u := "_local/" + url.PathEscape(maintenanceLockID) + "?rev=" + url.QueryEscape(rev)
+		if err = makeRequest(db, doctype, http.MethodDelete, u, nil, nil); err != nil {
+			logger.WithDomain(db.DomainName()).WithField("nspace", "couchdb").
+				Warnf("cannot release the maintenance lock on %s: %s", doctype, err)
+		}
+	}
+	return release, nil
+}
@@ -0,0 +1,65 @@
+package mango
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"sort"
+	"strings"
+)
+
+// Fingerprint returns a stable hash of the structure of a filter: the field
+// names and the operators are used, but not the values. It can be used to
+// group the queries by shape, for example in metrics and logs.
+//
+// The order of the filters inside an $and, $or or $nor doesn't change the
+// fingerprint.
+func Fingerprint(f Filter) string {
+	// The filter is normalized via JSON, as it can mix several types of
+	// filters, maps and slices.
+	var normalized interface{}
+	if data, err := json.Marshal(f); err == nil {
+		_ = json.Unmarshal(data, &normalized)
+	}
+	sum := sha256.Sum256([]byte(shape(normalized)))
+	return hex.EncodeToString(sum[:16])
+}
+
+// shape returns a canonical representation of a normalized selector, where
+// the values are replaced by a "?".
+func shape(value interface{}) string {
+	m, ok := value.(map[string]interface{})
+	if !ok {
+		return "?"
+	}
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var sb strings.Builder
+	sb.WriteByte('{')
+	for i, k := range keys {
+		if i > 0 {
+			sb.WriteByte(',')
+		}
+		sb.WriteString(k)
+		sb.WriteByte(':')
+		switch LogicOperator(k) {
+		case and, or, nor:
+			if list, ok := m[k].([]interface{}); ok {
+				children := make([]string, len(list))
+				for j, child := range list {
+					children[j] = shape(child)
+				}
+				sort.Strings(children)
+				sb.WriteString("[" + strings.Join(children, ",") + "]")
+				continue
+			}
+		}
+		sb.WriteString(shape(m[k]))
+	}
+	sb.WriteByte('}')
+	return sb.String()
+}
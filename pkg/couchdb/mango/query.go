@@ -32,6 +32,17 @@ const lte ValueOperator = "$lte"
 // exists ($exists) checks that the field exists (or is missing)
 const exists ValueOperator = "$exists"
 
+// elemMatch ($elemMatch) checks that at least one element of an array field
+// matches the sub-filter
+const elemMatch ValueOperator = "$elemMatch"
+
+// allMatch ($allMatch) checks that all the elements of an array field match
+// the sub-filter
+const allMatch ValueOperator = "$allMatch"
+
+// size ($size) checks the length of an array field
+const size ValueOperator = "$size"
+
 // LogicOperator is an operator between two filters
 type LogicOperator string
 
@@ -156,6 +167,26 @@ func Lt(field string, value interface{}) Filter { return &valueFilter{field, lt,
 // Lte returns a filter that check if a field <= value
 func Lte(field string, value interface{}) Filter { return &valueFilter{field, lte, value} }
 
+// ElemMatch returns a filter that check if at least one element of the array
+// field matches all the conditions of sub. The fields of sub are relative to
+// the elements of the array.
+//
+// CouchDB cannot use an index for the conditions inside $elemMatch, so the
+// selector should also include a condition on an indexed field to avoid a
+// full scan of the database.
+func ElemMatch(field string, sub Filter) Filter {
+	return &valueFilter{field, elemMatch, sub.ToMango()}
+}
+
+// AllMatch returns a filter that check if all the elements of the array field
+// match all the conditions of sub. Like ElemMatch, it cannot use an index.
+func AllMatch(field string, sub Filter) Filter {
+	return &valueFilter{field, allMatch, sub.ToMango()}
+}
+
+// Size returns a filter that check if the array field has n elements
+func Size(field string, n int) Filter { return &valueFilter{field, size, n} }
+
 // Between returns a filter that check if v1 <= field < v2
 func Between(field string, v1 interface{}, v2 interface{}) Filter {
 	return &logicFilter{op: and, filters: []Filter{
@@ -173,6 +204,17 @@ func StartWith(field string, prefix string) Filter {
 	return Between(field, prefix, prefix+MaxString)
 }
 
+// BeginsWith returns a filter that check if field's string value starts with
+// prefix. Contrary to StartWith, the two bounds are on the same field object,
+// {"$gte": prefix, "$lt": prefix+MaxString}, which is the range that CouchDB
+// can use with an index on the field.
+func BeginsWith(field string, prefix string) Filter {
+	return makeMap(field, map[string]interface{}{
+		string(gte): prefix,
+		string(lt):  prefix + MaxString,
+	})
+}
+
 ////////////////////////////////////////////////////////////////
 // Sort
 ///////////////////////////////////////////////////////////////
@@ -197,6 +239,18 @@ type SortByField struct {
 	Direction SortDirection
 }
 
+// AscBy returns a rule for sorting on the field in ascending order. It can't
+// be named Asc as this name is already used by the direction.
+func AscBy(field string) SortByField { return SortByField{field, Asc} }
+
+// DescBy returns a rule for sorting on the field in descending order.
+func DescBy(field string) SortByField { return SortByField{field, Desc} }
+
+// Sort returns a SortBy with the given rules, in order. For example:
+//
+//	mango.Sort(mango.AscBy("dir_id"), mango.DescBy("updated_at"))
+func Sort(rules ...SortByField) SortBy { return SortBy(rules) }
+
 // MarshalJSON implements json.Marshaller on SortBy
 // it will returns a json array [field, direction]
 func (s SortBy) MarshalJSON() ([]byte, error) {
@@ -35,6 +35,52 @@ func TestQueryMarshaling(t *testing.T) {
 	DeepEqual(t, q4.ToMango(), M{"$not": M{"DirID": "ab123"}})
 }
 
+func TestBeginsWithMarshaling(t *testing.T) {
+	q := BeginsWith("path", "/Photos/")
+	DeepEqual(t, q.ToMango(), M{"path": M{"$gte": "/Photos/", "$lt": "/Photos/" + MaxString}})
+
+	j, err := json.Marshal(And(Equal("type", "file"), BeginsWith("path", "/a")))
+	if assert.NoError(t, err) {
+		expected := `{"$and":[{"type":"file"},{"path":{"$gte":"/a","$lt":"/a` + MaxString + `"}}]}`
+		assert.Equal(t, expected, string(j))
+	}
+}
+
+func TestElemMatchMarshaling(t *testing.T) {
+	q := ElemMatch("permissions", And(
+		Equal("type", "io.cozy.files"),
+		Exists("verbs"),
+	))
+	j, err := json.Marshal(q)
+	if assert.NoError(t, err) {
+		expected := `{"permissions":{"$elemMatch":{"$and":[{"type":"io.cozy.files"},{"verbs":{"$exists":true}}]}}}`
+		assert.Equal(t, expected, string(j))
+	}
+
+	q2 := And(Equal("type", "share"), ElemMatch("codes", Equal("code", "abc")))
+	j, err = json.Marshal(q2)
+	if assert.NoError(t, err) {
+		expected := `{"$and":[{"type":"share"},{"codes":{"$elemMatch":{"code":"abc"}}}]}`
+		assert.Equal(t, expected, string(j))
+	}
+}
+
+func TestArrayOperatorsMarshaling(t *testing.T) {
+	q1 := AllMatch("referenced_by", Equal("type", "io.cozy.photos.albums"))
+	DeepEqual(t, q1.ToMango(),
+		M{"referenced_by": M{"$allMatch": M{"type": "io.cozy.photos.albums"}}})
+
+	q2 := Size("tags", 3)
+	DeepEqual(t, q2.ToMango(), M{"tags": M{"$size": 3}})
+
+	q3 := And(Size("tags", 0), Not(AllMatch("tags", Gt("length", 3))))
+	j, err := json.Marshal(q3)
+	if assert.NoError(t, err) {
+		expected := `{"$and":[{"tags":{"$size":0}},{"$not":{"tags":{"$allMatch":{"length":{"$gt":3}}}}}]}`
+		assert.Equal(t, expected, string(j))
+	}
+}
+
 func TestSortMarshaling(t *testing.T) {
 	s1 := SortBy{
 		{"dir_id", Asc},
@@ -45,3 +91,44 @@ func TestSortMarshaling(t *testing.T) {
 		assert.Equal(t, j1, []byte(`[{"dir_id":"asc"},{"foo_bar":"desc"}]`))
 	}
 }
+
+func TestSortBuilderMarshaling(t *testing.T) {
+	s1 := Sort(AscBy("dir_id"))
+	j1, err := json.Marshal(s1)
+	if assert.NoError(t, err) {
+		assert.Equal(t, `[{"dir_id":"asc"}]`, string(j1))
+	}
+
+	s2 := Sort(AscBy("dir_id"), DescBy("foo_bar"))
+	j2, err := json.Marshal(s2)
+	if assert.NoError(t, err) {
+		assert.Equal(t, `[{"dir_id":"asc"},{"foo_bar":"desc"}]`, string(j2))
+	}
+	assert.Equal(t, SortBy{{"dir_id", Asc}, {"foo_bar", Desc}}, s2)
+}
+
+func TestFingerprint(t *testing.T) {
+	f1 := Fingerprint(And(Equal("worker", "sendmail"), Gt("queued_at", 1)))
+	f2 := Fingerprint(And(Gt("queued_at", 42), Equal("worker", "thumbnail")))
+	assert.Equal(t, f1, f2)
+	assert.NotEqual(t, f1, Fingerprint(And(Equal("worker", "sendmail"), Lt("queued_at", 1))))
+	assert.NotEqual(t, f1, Fingerprint(Or(Equal("worker", "sendmail"), Gt("queued_at", 1))))
+
+	nested1 := Fingerprint(And(
+		Or(Equal("state", "queued"), Equal("state", "running")),
+		Map{"worker": Map{"$in": []interface{}{"sendmail", "push"}}},
+	))
+	nested2 := Fingerprint(And(
+		Map{"worker": Map{"$in": []interface{}{"thumbnail"}}},
+		Or(Equal("state", "done"), Equal("state", "errored")),
+	))
+	assert.Equal(t, nested1, nested2)
+	assert.NotEqual(t, nested1, Fingerprint(And(
+		Or(Equal("state", "done"), Equal("trigger_id", "123")),
+		Map{"worker": Map{"$in": []interface{}{"thumbnail"}}},
+	)))
+
+	assert.Equal(t,
+		Fingerprint(Map{"metadata": Map{"status": "ok"}}),
+		Fingerprint(Map{"metadata": Map{"status": "ko"}}))
+}
@@ -0,0 +1,96 @@
+package couchdb
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// maxPatchAttempts is the maximal number of times that PatchDoc tries to
+// apply a patch when there are some conflicts with concurrent updates.
+const maxPatchAttempts = 3
+
+// PatchDoc applies a JSON Merge Patch (RFC 7386) to the current version of a
+// document: the fields of the patch replace the existing ones, the nested
+// objects are merged recursively, and the fields with a null value are
+// removed. The _id and _rev of the document can't be changed by the patch.
+// If the document is modified concurrently, the patch is applied again on
+// the new version.
+func PatchDoc(db Database, doctype, id string, patch json.RawMessage) error {
+	p, err := parsePatch(patch)
+	if err != nil {
+		return err
+	}
+	for i := 0; ; i++ {
+		var old JSONDoc
+		if err = GetDoc(db, doctype, id, &old); err != nil {
+			return err
+		}
+		old.Type = doctype
+		err = UpdateDocWithOld(db, applyPatch(&old, p), &old)
+		if !IsConflictError(err) || i+1 >= maxPatchAttempts {
+			return err
+		}
+	}
+}
+
+// PatchDocIfMatch applies a JSON Merge Patch to a document, like PatchDoc,
+// but only if the current revision of the document is rev. Else, a conflict
+// error is returned, and the caller can fetch the new version to decide what
+// to do. The check is done by CouchDB when the patched document is saved, so
+// a concurrent update can't be overwritten.
+func PatchDocIfMatch(db Database, doctype, id, rev string, patch json.RawMessage) error {
+	p, err := parsePatch(patch)
+	if err != nil {
+		return err
+	}
+	var old JSONDoc
+	if err = GetDoc(db, doctype, id, &old); err != nil {
+		return err
+	}
+	if old.Rev() != rev {
+		return newConflictError()
+	}
+	old.Type = doctype
+	return UpdateDocWithOld(db, applyPatch(&old, p), &old)
+}
+
+func parsePatch(patch json.RawMessage) (map[string]interface{}, error) {
+	var p map[string]interface{}
+	if err := json.Unmarshal(patch, &p); err != nil {
+		return nil, newInvalidPatchError(fmt.Sprintf("invalid patch: %s", err))
+	}
+	if p == nil {
+		return nil, newInvalidPatchError("the patch must be a JSON object")
+	}
+	delete(p, "_id")
+	delete(p, "_rev")
+	return p, nil
+}
+
+// applyPatch returns a new document, with the patch applied to the given
+// document.
+func applyPatch(doc *JSONDoc, patch map[string]interface{}) *JSONDoc {
+	patched := doc.Clone().(*JSONDoc)
+	patched.M = mergePatch(patched.M, patch).(map[string]interface{})
+	return patched
+}
+
+// mergePatch is the MergePatch function of the RFC 7386.
+func mergePatch(target, patch interface{}) interface{} {
+	p, ok := patch.(map[string]interface{})
+	if !ok {
+		return patch
+	}
+	t, ok := target.(map[string]interface{})
+	if !ok {
+		t = make(map[string]interface{})
+	}
+	for k, v := range p {
+		if v == nil {
+			delete(t, k)
+		} else {
+			t[k] = mergePatch(t[k], v)
+		}
+	}
+	return t
+}
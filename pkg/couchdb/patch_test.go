@@ -0,0 +1,75 @@
+package couchdb
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMergePatch(t *testing.T) {
+	var target, patch interface{}
+	assert.NoError(t, json.Unmarshal([]byte(`{
+		"title": "Goodbye!",
+		"author": {"givenName": "John", "familyName": "Doe"},
+		"tags": ["example", "sample"],
+		"content": "This will be unchanged"
+	}`), &target))
+	assert.NoError(t, json.Unmarshal([]byte(`{
+		"title": "Hello!",
+		"phoneNumber": "+01-123-456-7890",
+		"author": {"familyName": null, "address": {"city": "Paris"}},
+		"tags": ["example"]
+	}`), &patch))
+
+	var expected interface{}
+	assert.NoError(t, json.Unmarshal([]byte(`{
+		"title": "Hello!",
+		"author": {"givenName": "John", "address": {"city": "Paris"}},
+		"tags": ["example"],
+		"content": "This will be unchanged",
+		"phoneNumber": "+01-123-456-7890"
+	}`), &expected))
+	assert.Equal(t, expected, mergePatch(target, patch))
+
+	assert.Equal(t, "bar", mergePatch(map[string]interface{}{"a": "b"}, "bar"))
+	assert.Equal(t, map[string]interface{}{"a": "b"},
+		mergePatch("foo", map[string]interface{}{"a": "b", "c": nil}))
+}
+
+func TestPatchDoc(t *testing.T) {
+	doc := &JSONDoc{Type: TestDoctype, M: map[string]interface{}{
+		"fieldA": "a",
+		"nested": map[string]interface{}{"b": "b", "c": "c"},
+	}}
+	assert.NoError(t, CreateDoc(TestPrefix, doc))
+
+	patch := json.RawMessage(`{"_rev": "1-123", "fieldA": null, "nested": {"c": "C"}}`)
+	assert.NoError(t, PatchDoc(TestPrefix, TestDoctype, doc.ID(), patch))
+
+	var fetched JSONDoc
+	assert.NoError(t, GetDoc(TestPrefix, TestDoctype, doc.ID(), &fetched))
+	assert.NotEqual(t, doc.Rev(), fetched.Rev())
+	assert.NotContains(t, fetched.M, "fieldA")
+	assert.Equal(t, map[string]interface{}{"b": "b", "c": "C"}, fetched.Get("nested"))
+
+	err := PatchDoc(TestPrefix, TestDoctype, doc.ID(), json.RawMessage(`[1, 2]`))
+	assert.Error(t, err)
+	err = PatchDoc(TestPrefix, TestDoctype, "no-such-doc", json.RawMessage(`{}`))
+	assert.True(t, IsNotFoundError(err))
+}
+
+func TestPatchDocIfMatch(t *testing.T) {
+	doc := &JSONDoc{Type: TestDoctype, M: map[string]interface{}{"fieldA": "a"}}
+	assert.NoError(t, CreateDoc(TestPrefix, doc))
+	rev := doc.Rev()
+
+	patch := json.RawMessage(`{"fieldA": "A"}`)
+	assert.NoError(t, PatchDocIfMatch(TestPrefix, TestDoctype, doc.ID(), rev, patch))
+	err := PatchDocIfMatch(TestPrefix, TestDoctype, doc.ID(), rev, json.RawMessage(`{"fieldA": "B"}`))
+	assert.True(t, IsConflictError(err))
+
+	var fetched JSONDoc
+	assert.NoError(t, GetDoc(TestPrefix, TestDoctype, doc.ID(), &fetched))
+	assert.Equal(t, "A", fetched.Get("fieldA"))
+}
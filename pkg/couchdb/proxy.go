@@ -18,7 +18,6 @@ import (
 // correct route.
 func Proxy(db Database, doctype, path string) *httputil.ReverseProxy {
 	couchURL := config.CouchURL()
-	couchAuth := config.GetConfig().CouchDB.Auth
 
 	director := func(req *http.Request) {
 		req.URL.Scheme = couchURL.Scheme
@@ -27,11 +26,8 @@ func Proxy(db Database, doctype, path string) *httputil.ReverseProxy {
 		req.Header.Del(echo.HeaderCookie)
 		req.URL.RawPath = "/" + makeDBName(db, doctype) + "/" + path
 		req.URL.Path, _ = url.PathUnescape(req.URL.RawPath)
-		if couchAuth != nil {
-			if p, ok := couchAuth.Password(); ok {
-				req.SetBasicAuth(couchAuth.Username(), p)
-			}
-		}
+		// An error is not fatal here: CouchDB will respond with a 401
+		_ = authenticateRequest(req)
 	}
 
 	var transport http.RoundTripper
@@ -107,6 +103,7 @@ func ProxyBulkDocs(db Database, doctype string, req *http.Request) (*httputil.Re
 						event = realtime.EventUpdate
 					}
 					RTEvent(db, event, &doc, nil)
+					teeWrite(db, event, &doc)
 				}
 			} else {
 				var respValues []*respValue
@@ -137,6 +134,7 @@ func ProxyBulkDocs(db Database, doctype string, req *http.Request) (*httputil.Re
 					}
 					doc.SetRev(r.Rev)
 					RTEvent(db, event, &doc, nil)
+					teeWrite(db, event, &doc)
 				}
 			}
 		},
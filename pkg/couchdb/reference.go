@@ -1,7 +1,163 @@
 package couchdb
 
+import (
+	"context"
+	"encoding/json"
+	"sync"
+)
+
 // DocReference is a reference to a document
 type DocReference struct {
 	ID   string `json:"id"`
 	Type string `json:"type"`
 }
+
+// addReferenceRetries is the number of attempts made by AddReferenceToDocs
+// for the documents that are updated concurrently.
+const addReferenceRetries = 3
+
+// AddReferenceToDocs adds the reference to the referenced_by field of the
+// documents, if they don't already have it. The documents are fetched and
+// updated in bulk, and those that are updated concurrently are fetched again
+// and retried a few times before returning a conflict error. The missing
+// documents are ignored.
+func AddReferenceToDocs(db Database, doctype string, docIDs []string, ref DocReference) error {
+	ids := docIDs
+	for attempt := 0; len(ids) > 0; attempt++ {
+		if attempt >= addReferenceRetries {
+			return newConflictError()
+		}
+		var docs []*JSONDoc
+		if err := GetAllDocs(db, doctype, &AllDocsRequest{Keys: ids}, &docs); err != nil {
+			return err
+		}
+		var changed []Doc
+		for _, doc := range docs {
+			if doc == nil {
+				continue
+			}
+			doc.Type = doctype
+			if addReference(doc, ref) {
+				changed = append(changed, doc)
+			}
+		}
+		if len(changed) == 0 {
+			return nil
+		}
+		stale, err := BulkUpdateConditional(db, doctype, changed)
+		if err != nil {
+			return err
+		}
+		ids = stale
+	}
+	return nil
+}
+
+// addReference adds the reference to the referenced_by field of the document,
+// and returns false if the document already has it.
+func addReference(doc *JSONDoc, ref DocReference) bool {
+	refs, _ := doc.M[SelectorReferencedBy].([]interface{})
+	for _, r := range refs {
+		if m, ok := r.(map[string]interface{}); ok && m["type"] == ref.Type && m["id"] == ref.ID {
+			return false
+		}
+	}
+	doc.M[SelectorReferencedBy] = append(refs, map[string]interface{}{
+		"type": ref.Type,
+		"id":   ref.ID,
+	})
+	return true
+}
+
+// referencingView returns the view used by FindReferencing for the doctype.
+// The key is "type/id" for each reference of the documents.
+func referencingView(doctype string) *View {
+	return &View{
+		Name:    "referencing",
+		Doctype: doctype,
+		Map: `
+function(doc) {
+  if (isArray(doc.referenced_by)) {
+    for (var i = 0; i < doc.referenced_by.length; i++) {
+      emit(doc.referenced_by[i].type + "/" + doc.referenced_by[i].id);
+    }
+  }
+}`,
+	}
+}
+
+// FindReferencing returns the IDs of the documents of the doctype that have
+// the given reference in their referenced_by field. A view is defined for
+// that if it doesn't exist yet.
+func FindReferencing(db Database, doctype string, ref DocReference) ([]string, error) {
+	view := referencingView(doctype)
+	if err := DefineViews(db, []*View{view}); err != nil {
+		return nil, err
+	}
+	var res ViewResponse
+	req := &ViewRequest{Key: ref.Type + "/" + ref.ID}
+	if err := ExecView(db, view, req, &res); err != nil {
+		return nil, err
+	}
+	ids := make([]string, 0, len(res.Rows))
+	for _, row := range res.Rows {
+		// A document can have the same reference several times
+		if len(ids) > 0 && ids[len(ids)-1] == row.ID {
+			continue
+		}
+		ids = append(ids, row.ID)
+	}
+	return ids, nil
+}
+
+// BulkGetMixed fetches the referenced documents, that can be of several
+// doctypes. The references are grouped by doctype, and the documents of each
+// doctype are fetched with a single request, concurrently within the limit
+// of SetMaxConcurrency. The documents are added to out, by doctype, and the
+// references that couldn't be resolved (missing or deleted documents) are
+// returned.
+func BulkGetMixed(db Database, refs []DocReference, out map[string][]json.RawMessage) ([]DocReference, error) {
+	var doctypes []string
+	idsByDoctype := make(map[string][]string)
+	for _, ref := range refs {
+		if _, ok := idsByDoctype[ref.Type]; !ok {
+			doctypes = append(doctypes, ref.Type)
+		}
+		idsByDoctype[ref.Type] = append(idsByDoctype[ref.Type], ref.ID)
+	}
+
+	var mu sync.Mutex
+	found := make(map[DocReference]bool, len(refs))
+	err := runConcurrently(context.Background(), len(doctypes), func(i int) error {
+		doctype := doctypes[i]
+		var docs []json.RawMessage
+		req := &AllDocsRequest{Keys: idsByDoctype[doctype]}
+		err := GetAllDocs(db, doctype, req, &docs)
+		if IsNoDatabaseError(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		mu.Lock()
+		defer mu.Unlock()
+		for _, doc := range docs {
+			if id := rawDocID(doc); id != "" {
+				found[DocReference{ID: id, Type: doctype}] = true
+				out[doctype] = append(out[doctype], doc)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	missing := []DocReference{}
+	for _, ref := range refs {
+		if !found[ref] {
+			missing = append(missing, ref)
+		}
+	}
+	return missing, nil
+}
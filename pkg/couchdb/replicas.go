@@ -0,0 +1,78 @@
+package couchdb
+
+import (
+	"hash/fnv"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/cozy/cozy-stack/pkg/config/config"
+)
+
+// ReplicaSelector chooses the read replica of CouchDB used for a GET request.
+// The key identifies the requested resource: the database name, and the
+// document ID for the requests on a document.
+type ReplicaSelector func(key string, replicas []*url.URL) *url.URL
+
+var replicaSelectorMu sync.RWMutex
+var replicaSelector ReplicaSelector = ConsistentHashSelector
+
+// SetReplicaSelector changes how the read replicas are chosen for the
+// databases from WithReadReplica. The default is ConsistentHashSelector. It
+// has no effect if no read replicas are configured (couchdb.read_urls).
+func SetReplicaSelector(selector ReplicaSelector) {
+	replicaSelectorMu.Lock()
+	defer replicaSelectorMu.Unlock()
+	replicaSelector = selector
+}
+
+var roundRobinCounter uint32
+
+// RoundRobinSelector is a ReplicaSelector that spreads the requests evenly
+// over the read replicas.
+func RoundRobinSelector(key string, replicas []*url.URL) *url.URL {
+	n := atomic.AddUint32(&roundRobinCounter, 1)
+	return replicas[int(n%uint32(len(replicas)))]
+}
+
+// ConsistentHashSelector is a ReplicaSelector that always sends the requests
+// for the same key to the same read replica, for a better use of the caches
+// of CouchDB. Adding a replica moves only a small part of the keys.
+func ConsistentHashSelector(key string, replicas []*url.URL) *url.URL {
+	h := fnv.New64a()
+	_, _ = h.Write([]byte(key))
+	return replicas[jumpHash(h.Sum64(), len(replicas))]
+}
+
+// jumpHash is the jump consistent hash algorithm from "A Fast, Minimal
+// Memory, Consistent Hash Algorithm" (Lamping and Veach).
+func jumpHash(key uint64, buckets int) int {
+	var b, j int64 = -1, 0
+	for j < int64(buckets) {
+		b = j
+		key = key*2862933555777941757 + 1
+		j = int64(float64(b+1) * (float64(int64(1)<<31) / float64((key>>33)+1)))
+	}
+	return int(b)
+}
+
+// couchURLFor returns the URL of CouchDB to use for a request: a read replica
+// for the GET requests of a database from WithReadReplica, if some are
+// configured, or the primary one.
+func couchURLFor(db Database, method, path string) string {
+	replicas := config.GetConfig().CouchDB.ReadURLs
+	if len(replicas) == 0 || !usesReadReplica(db) ||
+		(method != http.MethodGet && method != http.MethodHead) {
+		return config.CouchURL().String()
+	}
+	key := path
+	if i := strings.IndexByte(key, '?'); i >= 0 {
+		key = key[:i]
+	}
+	replicaSelectorMu.RLock()
+	selector := replicaSelector
+	replicaSelectorMu.RUnlock()
+	return selector(key, replicas).String()
+}
@@ -0,0 +1,57 @@
+package couchdb
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/cozy/cozy-stack/pkg/config/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConsistentHashSelector(t *testing.T) {
+	var replicas []*url.URL
+	for i := 0; i < 4; i++ {
+		u, _ := url.Parse(fmt.Sprintf("http://replica-%d:5984/", i))
+		replicas = append(replicas, u)
+	}
+
+	used := make(map[string]bool)
+	moved := 0
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("prefix%%2Fio-cozy-files/%d", i)
+		u := ConsistentHashSelector(key, replicas)
+		assert.Equal(t, u, ConsistentHashSelector(key, replicas))
+		used[u.Host] = true
+		if ConsistentHashSelector(key, replicas[:3]) != u {
+			moved++
+		}
+	}
+	assert.Len(t, used, 4)
+	// Only the keys of the removed replica should move
+	assert.InDelta(t, 250, moved, 75)
+}
+
+func TestCouchURLFor(t *testing.T) {
+	conf := config.GetConfig().CouchDB
+	defer func() { config.GetConfig().CouchDB = conf }()
+	primary := config.CouchURL().String()
+	db := newDatabase("alice.cozy.tools")
+	replicaDB := WithReadReplica(db)
+	assert.Equal(t, primary, couchURLFor(replicaDB, http.MethodGet, "db/doc"))
+
+	replica, _ := url.Parse("http://replica:5984/")
+	config.GetConfig().CouchDB.ReadURLs = []*url.URL{replica}
+	assert.Equal(t, "http://replica:5984/", couchURLFor(replicaDB, http.MethodGet, "db/doc?rev=1-abc"))
+	assert.Equal(t, primary, couchURLFor(replicaDB, http.MethodPut, "db/doc"))
+	assert.Equal(t, primary, couchURLFor(replicaDB, http.MethodPost, "db/_find"))
+	assert.Equal(t, primary, couchURLFor(db, http.MethodGet, "db/doc"))
+
+	// The options can be combined
+	client := &http.Client{}
+	both := WithClient(replicaDB, client)
+	assert.Equal(t, "http://replica:5984/", couchURLFor(both, http.MethodGet, "db/doc"))
+	assert.Equal(t, client, clientFor(both))
+	assert.Equal(t, "alice.cozy.tools", both.DBPrefix())
+}
@@ -0,0 +1,92 @@
+package couchdb
+
+import (
+	"fmt"
+	"net/http"
+
+	"github.com/cozy/cozy-stack/pkg/config/config"
+)
+
+// ReplicationRequest is the body of a _replicate request
+type ReplicationRequest struct {
+	Source string `json:"source"`
+	Target string `json:"target"`
+	// DocIDs restricts the replication to the documents with those IDs
+	DocIDs []string `json:"doc_ids,omitempty"`
+}
+
+// ReplicationHistory is an entry of the history of a replication
+type ReplicationHistory struct {
+	SessionID        string `json:"session_id"`
+	DocsRead         int    `json:"docs_read"`
+	DocsWritten      int    `json:"docs_written"`
+	DocWriteFailures int    `json:"doc_write_failures"`
+	MissingChecked   int    `json:"missing_checked"`
+	MissingFound     int    `json:"missing_found"`
+}
+
+// ReplicationResult is the response from CouchDB for a _replicate request
+type ReplicationResult struct {
+	Ok            bool                 `json:"ok"`
+	NoChanges     bool                 `json:"no_changes"`
+	SessionID     string               `json:"session_id"`
+	History       []ReplicationHistory `json:"history"`
+	SourceLastSeq interface{}          `json:"source_last_seq"`
+}
+
+// Replicate runs a one-shot replication from the source to the target
+// databases, and waits for its completion. The source and target are the
+// URLs of the databases, see DatabaseURL.
+func Replicate(db Database, source, target string) (*ReplicationResult, error) {
+	return replicate(db, &ReplicationRequest{
+		Source: source,
+		Target: target,
+	})
+}
+
+// ReplicateDocs is like Replicate, but only the documents with the given IDs
+// are replicated. The list of IDs must not be empty, as it would replicate
+// all the documents.
+func ReplicateDocs(db Database, source, target string, docIDs []string) (*ReplicationResult, error) {
+	if len(docIDs) == 0 {
+		return nil, fmt.Errorf("ReplicateDocs needs at least one document ID")
+	}
+	for _, id := range docIDs {
+		if _, err := validateDocID(id); err != nil {
+			return nil, err
+		}
+		if id == "" {
+			return nil, fmt.Errorf("Missing ID for ReplicateDocs")
+		}
+	}
+	return replicate(db, &ReplicationRequest{
+		Source: source,
+		Target: target,
+		DocIDs: docIDs,
+	})
+}
+
+func replicate(db Database, req *ReplicationRequest) (*ReplicationResult, error) {
+	var res ReplicationResult
+	if err := makeRequest(db, "", http.MethodPost, "_replicate", req, &res); err != nil {
+		return nil, err
+	}
+	if !res.Ok {
+		return nil, fmt.Errorf("CouchDB replied with ok=false for the replication")
+	}
+	for _, h := range res.History {
+		if h.SessionID == res.SessionID && h.DocWriteFailures > 0 {
+			return &res, fmt.Errorf("Replication failed for %d documents", h.DocWriteFailures)
+		}
+	}
+	return &res, nil
+}
+
+// DatabaseURL returns the URL of the database for the given doctype, with
+// the credentials of the stack. It can be used as source or target of a
+// replication.
+func DatabaseURL(db Database, doctype string) string {
+	u := *config.CouchURL()
+	u.User = config.GetConfig().CouchDB.Auth
+	return u.String() + makeDBName(db, doctype)
+}
@@ -0,0 +1,159 @@
+package couchdb
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"github.com/cozy/cozy-stack/pkg/couchdb/mango"
+)
+
+// IndexInfo is a mango index, as listed by CouchDB on _index.
+type IndexInfo struct {
+	DesignDoc string `json:"ddoc"`
+	Name      string `json:"name"`
+	Type      string `json:"type"`
+	Def       struct {
+		Fields []map[string]string `json:"fields"`
+	} `json:"def"`
+}
+
+// FieldNames returns the fields of the index, in order.
+func (i *IndexInfo) FieldNames() []string {
+	names := make([]string, 0, len(i.Def.Fields))
+	for _, field := range i.Def.Fields {
+		for name := range field {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// ListIndexes returns the mango indexes of the database of the doctype. The
+// special index on _id (_all_docs) is not included.
+func ListIndexes(db Database, doctype string) ([]*IndexInfo, error) {
+	var res struct {
+		Indexes []*IndexInfo `json:"indexes"`
+	}
+	if err := makeRequest(db, doctype, http.MethodGet, "_index", nil, &res); err != nil {
+		return nil, err
+	}
+	indexes := make([]*IndexInfo, 0, len(res.Indexes))
+	for _, index := range res.Indexes {
+		if index.Type != "special" {
+			indexes = append(indexes, index)
+		}
+	}
+	return indexes, nil
+}
+
+// SchemaDiffResult is the difference between the views and indexes expected
+// for a doctype, and the ones in CouchDB.
+type SchemaDiffResult struct {
+	MissingViews []*View `json:"missing_views"`
+	// StaleViews are the views with a different definition in CouchDB
+	StaleViews     []*View        `json:"stale_views"`
+	MissingIndexes []*mango.Index `json:"missing_indexes"`
+	// StaleIndexes are the indexes with a design doc that indexes other
+	// fields in CouchDB
+	StaleIndexes []*mango.Index `json:"stale_indexes"`
+	// RedundantIndexes are the design docs of the indexes in CouchDB that are
+	// not expected
+	RedundantIndexes []string `json:"redundant_indexes"`
+}
+
+// Empty returns true if there is no difference.
+func (r *SchemaDiffResult) Empty() bool {
+	return len(r.MissingViews) == 0 && len(r.StaleViews) == 0 &&
+		len(r.MissingIndexes) == 0 && len(r.StaleIndexes) == 0 &&
+		len(r.RedundantIndexes) == 0
+}
+
+// SchemaDiff compares the views and the mango indexes expected for the
+// doctype with the ones in CouchDB, and reports the differences. Nothing is
+// changed: RepairViews and DefineIndexes can be used to apply them. It can be
+// used before a deploy to know which indexes will have to be built.
+//
+// The indexes with a design doc name are matched by it, and the others by
+// their fields.
+func SchemaDiff(db Database, doctype string, views []*View, indexes []*mango.Index) (*SchemaDiffResult, error) {
+	for _, v := range views {
+		if v.Doctype != doctype {
+			return nil, fmt.Errorf("SchemaDiff: view %s is not for the doctype %s", v.Name, doctype)
+		}
+	}
+	for _, index := range indexes {
+		if index.Doctype != doctype {
+			return nil, fmt.Errorf("SchemaDiff: index %s is not for the doctype %s", index.Request.DDoc, doctype)
+		}
+	}
+
+	result := &SchemaDiffResult{}
+	missing := make([]bool, len(views))
+	stale := make([]bool, len(views))
+	err := runConcurrently(context.Background(), len(views), func(i int) error {
+		exists, upToDate, err := checkView(db, views[i])
+		missing[i] = !exists
+		stale[i] = exists && !upToDate
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	for i, v := range views {
+		if missing[i] {
+			result.MissingViews = append(result.MissingViews, v)
+		} else if stale[i] {
+			result.StaleViews = append(result.StaleViews, v)
+		}
+	}
+
+	existing, err := ListIndexes(db, doctype)
+	if err != nil && !IsNoDatabaseError(err) {
+		return nil, err
+	}
+	used := make(map[*IndexInfo]bool)
+	for _, index := range indexes {
+		fields := []string(index.Request.Index)
+		found := false
+		for _, info := range existing {
+			if index.Request.DDoc != "" {
+				if info.DesignDoc != "_design/"+index.Request.DDoc {
+					continue
+				}
+				found = true
+				used[info] = true
+				if !equalFields(info.FieldNames(), fields) {
+					result.StaleIndexes = append(result.StaleIndexes, index)
+				}
+				break
+			}
+			if equalFields(info.FieldNames(), fields) {
+				found = true
+				used[info] = true
+				break
+			}
+		}
+		if !found {
+			result.MissingIndexes = append(result.MissingIndexes, index)
+		}
+	}
+	for _, info := range existing {
+		if !used[info] {
+			result.RedundantIndexes = append(result.RedundantIndexes, info.DesignDoc)
+		}
+	}
+	return result, nil
+}
+
+func equalFields(f1, f2 []string) bool {
+	if len(f1) != len(f2) {
+		return false
+	}
+	for i := range f1 {
+		if f1[i] != f2[i] {
+			return false
+		}
+	}
+	return true
+}
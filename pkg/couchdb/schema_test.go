@@ -0,0 +1,60 @@
+package couchdb
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/cozy/cozy-stack/pkg/couchdb/mango"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSchemaDiff(t *testing.T) {
+	defer withFakeCouch(t, func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case strings.HasSuffix(r.URL.Path, "/_index"):
+			_, _ = w.Write([]byte(`{"total_rows": 4, "indexes": [
+				{"ddoc": null, "name": "_all_docs", "type": "special", "def": {"fields": [{"_id": "asc"}]}},
+				{"ddoc": "_design/by-name", "name": "by-name", "type": "json", "def": {"fields": [{"name": "asc"}]}},
+				{"ddoc": "_design/by-date", "name": "by-date", "type": "json", "def": {"fields": [{"date": "asc"}]}},
+				{"ddoc": "_design/abc123", "name": "abc123", "type": "json", "def": {"fields": [{"dir_id": "asc"}, {"name": "asc"}]}},
+				{"ddoc": "_design/old", "name": "old", "type": "json", "def": {"fields": [{"old": "asc"}]}}
+			]}`))
+		case strings.HasSuffix(r.URL.Path, "/_design/by-ok"):
+			_, _ = w.Write([]byte(`{"_id": "_design/by-ok", "_rev": "1-a", "language": "javascript",
+				"views": {"by-ok": {"map": "function(doc) { emit(doc.ok); }"}}}`))
+		case strings.HasSuffix(r.URL.Path, "/_design/by-stale"):
+			_, _ = w.Write([]byte(`{"_id": "_design/by-stale", "_rev": "1-b", "language": "javascript",
+				"views": {"by-stale": {"map": "function(doc) { emit(doc.old); }"}}}`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+			_, _ = w.Write([]byte(`{"error": "not_found", "reason": "missing"}`))
+		}
+	})()
+
+	doctype := "io.cozy.tests.schema"
+	ok := &View{Name: "by-ok", Doctype: doctype, Map: "function(doc) { emit(doc.ok); }"}
+	stale := &View{Name: "by-stale", Doctype: doctype, Map: "function(doc) { emit(doc.new); }"}
+	missing := &View{Name: "by-missing", Doctype: doctype, Map: "function(doc) { emit(doc.missing); }"}
+	byName := mango.IndexOnFields(doctype, "by-name", []string{"name"})
+	byDate := mango.IndexOnFields(doctype, "by-date", []string{"date", "name"})
+	byDir := &mango.Index{Doctype: doctype, Request: &mango.IndexRequest{Index: mango.IndexFields{"dir_id", "name"}}}
+	bySize := mango.IndexOnFields(doctype, "by-size", []string{"size"})
+
+	db := newDatabase("alice.cozy.tools")
+	diff, err := SchemaDiff(db, doctype, []*View{ok, stale, missing}, []*mango.Index{byName, byDate, byDir, bySize})
+	assert.NoError(t, err)
+	assert.False(t, diff.Empty())
+	assert.Equal(t, []*View{missing}, diff.MissingViews)
+	assert.Equal(t, []*View{stale}, diff.StaleViews)
+	assert.Equal(t, []*mango.Index{bySize}, diff.MissingIndexes)
+	assert.Equal(t, []*mango.Index{byDate}, diff.StaleIndexes)
+	assert.Equal(t, []string{"_design/old"}, diff.RedundantIndexes)
+
+	diff, err = SchemaDiff(db, doctype, []*View{ok}, []*mango.Index{byName, byDir})
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"_design/by-date", "_design/old"}, diff.RedundantIndexes)
+
+	_, err = SchemaDiff(db, "io.cozy.other", []*View{ok}, nil)
+	assert.Error(t, err)
+}
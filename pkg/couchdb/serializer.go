@@ -0,0 +1,58 @@
+package couchdb
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+)
+
+// Serializer encodes the bodies of the requests to CouchDB, and decodes the
+// bodies of the responses. It can be replaced by SetSerializer to use a
+// faster JSON library, as long as it respects the json.Marshaler and
+// json.Unmarshaler interfaces, which are used by JSONDoc.
+type Serializer interface {
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+	NewDecoder(r io.Reader) Decoder
+}
+
+// Decoder reads and decodes a JSON value from a stream.
+type Decoder interface {
+	Decode(v interface{}) error
+}
+
+// stdSerializer is the default Serializer, with encoding/json.
+type stdSerializer struct{}
+
+func (stdSerializer) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (stdSerializer) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+func (stdSerializer) NewDecoder(r io.Reader) Decoder {
+	return json.NewDecoder(r)
+}
+
+var serializerMu sync.RWMutex
+var serializer Serializer = stdSerializer{}
+
+// SetSerializer changes the Serializer used for the requests to CouchDB. The
+// default uses encoding/json, and nil restores it. It should be called on
+// startup, before the first request.
+func SetSerializer(s Serializer) {
+	serializerMu.Lock()
+	defer serializerMu.Unlock()
+	if s == nil {
+		s = stdSerializer{}
+	}
+	serializer = s
+}
+
+func getSerializer() Serializer {
+	serializerMu.RLock()
+	defer serializerMu.RUnlock()
+	return serializer
+}
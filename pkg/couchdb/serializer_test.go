@@ -0,0 +1,58 @@
+package couchdb
+
+import (
+	"io"
+	"io/ioutil"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type countingSerializer struct {
+	stdSerializer
+	marshaled int
+	decoded   int
+}
+
+func (s *countingSerializer) Marshal(v interface{}) ([]byte, error) {
+	s.marshaled++
+	return s.stdSerializer.Marshal(v)
+}
+
+func (s *countingSerializer) Unmarshal(data []byte, v interface{}) error {
+	s.decoded++
+	return s.stdSerializer.Unmarshal(data, v)
+}
+
+func (s *countingSerializer) NewDecoder(r io.Reader) Decoder {
+	s.decoded++
+	return s.stdSerializer.NewDecoder(r)
+}
+
+func TestSetSerializer(t *testing.T) {
+	var received string
+	defer withFakeCouch(t, func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		received = string(body)
+		_, _ = w.Write([]byte(`{"_id": "doc1", "_rev": "1-abc", "name": "foo"}`))
+	})()
+
+	codec := &countingSerializer{}
+	SetSerializer(codec)
+	defer SetSerializer(nil)
+
+	db := newDatabase("alice.cozy.tools")
+	in := &JSONDoc{Type: "io.cozy.tests", M: map[string]interface{}{"name": "foo"}}
+	out := &JSONDoc{Type: "io.cozy.tests"}
+	err := makeRequest(db, "io.cozy.tests", http.MethodPut, "doc1", in, out)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, codec.marshaled)
+	assert.Equal(t, 1, codec.decoded)
+	assert.JSONEq(t, `{"name": "foo"}`, received)
+	assert.Equal(t, "doc1", out.ID())
+	assert.Equal(t, "foo", out.Get("name"))
+
+	SetSerializer(nil)
+	assert.Equal(t, stdSerializer{}, getSerializer())
+}
@@ -0,0 +1,147 @@
+package couchdb
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cozy/cozy-stack/pkg/config/config"
+)
+
+// sessionCookieName is the name of the cookie used by CouchDB for the
+// sessions.
+const sessionCookieName = "AuthSession"
+
+var sessionMu sync.Mutex
+var sessionCookie *http.Cookie
+
+func usesSessionAuth() bool {
+	return config.GetConfig().CouchDB.SessionAuth
+}
+
+// authenticateRequest adds the credentials from the configuration to a
+// request for CouchDB: with basic auth by default, with a session cookie if
+// the session_auth option is enabled, or with the headers of the proxy
+// authentication if it is configured.
+func authenticateRequest(req *http.Request) error {
+	if user := config.GetConfig().CouchDB.ProxyAuthUser; user != "" {
+		setProxyAuthHeaders(req, user)
+		return nil
+	}
+	auth := config.GetConfig().CouchDB.Auth
+	if auth == nil {
+		return nil
+	}
+	if !usesSessionAuth() {
+		if p, ok := auth.Password(); ok {
+			req.SetBasicAuth(auth.Username(), p)
+		}
+		return nil
+	}
+	cookie, err := getSessionCookie()
+	if err != nil {
+		return err
+	}
+	req.AddCookie(cookie)
+	return nil
+}
+
+// setProxyAuthHeaders adds the headers for the proxy authentication of
+// CouchDB. The token is the HMAC-SHA1 of the username with the secret shared
+// with CouchDB.
+func setProxyAuthHeaders(req *http.Request, user string) {
+	conf := config.GetConfig().CouchDB
+	req.Header.Set("X-Auth-CouchDB-UserName", user)
+	req.Header.Set("X-Auth-CouchDB-Roles", strings.Join(conf.ProxyAuthRoles, ","))
+	if conf.ProxyAuthSecret != "" {
+		mac := hmac.New(sha1.New, []byte(conf.ProxyAuthSecret))
+		_, _ = mac.Write([]byte(user))
+		req.Header.Set("X-Auth-CouchDB-Token", hex.EncodeToString(mac.Sum(nil)))
+	}
+}
+
+// getSessionCookie returns the current session cookie, or opens a new session
+// if there is none or if it has expired.
+func getSessionCookie() (*http.Cookie, error) {
+	sessionMu.Lock()
+	defer sessionMu.Unlock()
+	if sessionCookie != nil &&
+		(sessionCookie.Expires.IsZero() || time.Now().Before(sessionCookie.Expires)) {
+		return sessionCookie, nil
+	}
+	cookie, err := openSession()
+	if err != nil {
+		return nil, err
+	}
+	sessionCookie = cookie
+	return cookie, nil
+}
+
+// openSession asks CouchDB for a new session with the credentials from the
+// configuration.
+func openSession() (*http.Cookie, error) {
+	auth := config.GetConfig().CouchDB.Auth
+	password, _ := auth.Password()
+	body, err := json.Marshal(map[string]string{
+		"name":     auth.Username(),
+		"password": password,
+	})
+	if err != nil {
+		return nil, err
+	}
+	req, err := http.NewRequest(http.MethodPost, config.CouchURL().String()+"_session", bytes.NewReader(body))
+	if err != nil {
+		return nil, newRequestError(err)
+	}
+	req.Header.Add("Accept", "application/json")
+	req.Header.Add("Content-Type", "application/json")
+	res, err := config.GetConfig().CouchDB.Client.Do(req)
+	if err != nil {
+		return nil, newConnectionError(err)
+	}
+	defer res.Body.Close()
+	if res.StatusCode < 200 || res.StatusCode >= 300 {
+		data, err := ioutil.ReadAll(res.Body)
+		if err != nil {
+			return nil, newIOReadError(err)
+		}
+		return nil, newCouchdbError(res.StatusCode, data)
+	}
+	for _, cookie := range res.Cookies() {
+		if cookie.Name == sessionCookieName && cookie.Value != "" {
+			return cookie, nil
+		}
+	}
+	return nil, errors.New("CouchDB has not sent a session cookie")
+}
+
+// refreshSession keeps the new session cookie that CouchDB sends in a
+// response when the session is close to its expiration.
+func refreshSession(res *http.Response) {
+	if !usesSessionAuth() {
+		return
+	}
+	for _, cookie := range res.Cookies() {
+		if cookie.Name == sessionCookieName && cookie.Value != "" {
+			sessionMu.Lock()
+			sessionCookie = cookie
+			sessionMu.Unlock()
+		}
+	}
+}
+
+// resetSession forgets the session cookie, for example after a 401 response,
+// so that a new session is opened for the next request.
+func resetSession() {
+	sessionMu.Lock()
+	defer sessionMu.Unlock()
+	sessionCookie = nil
+}
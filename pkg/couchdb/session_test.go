@@ -0,0 +1,60 @@
+package couchdb
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/cozy/cozy-stack/pkg/config/config"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSessionAuth(t *testing.T) {
+	sessions := 0
+	valid := ""
+	defer withFakeCouch(t, func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/_session" {
+			sessions++
+			valid = "session" + string(rune('0'+sessions))
+			http.SetCookie(w, &http.Cookie{Name: sessionCookieName, Value: valid})
+			_, _ = w.Write([]byte(`{"ok":true}`))
+			return
+		}
+		cookie, err := r.Cookie(sessionCookieName)
+		if err != nil || cookie.Value != valid {
+			w.WriteHeader(http.StatusUnauthorized)
+			_, _ = w.Write([]byte(`{"error":"unauthorized","reason":"expired"}`))
+			return
+		}
+		_, _ = w.Write([]byte(`{"_id":"foo","_rev":"1-abc"}`))
+	})()
+	defer resetSession()
+	config.GetConfig().CouchDB.Auth = url.UserPassword("admin", "secret")
+	config.GetConfig().CouchDB.SessionAuth = true
+	resetSession()
+
+	doc := &JSONDoc{}
+	assert.NoError(t, GetDoc(TestPrefix, TestDoctype, "foo", doc))
+	assert.Equal(t, "1-abc", doc.Rev())
+	assert.Equal(t, 1, sessions)
+
+	// The session has expired on the CouchDB side
+	valid = "expired"
+	assert.NoError(t, GetDoc(TestPrefix, TestDoctype, "foo", doc))
+	assert.Equal(t, 2, sessions)
+}
+
+func TestProxyAuthHeaders(t *testing.T) {
+	conf := config.GetConfig().CouchDB
+	defer func() { config.GetConfig().CouchDB = conf }()
+	config.GetConfig().CouchDB.ProxyAuthUser = "foo"
+	config.GetConfig().CouchDB.ProxyAuthRoles = []string{"users", "blogger"}
+	config.GetConfig().CouchDB.ProxyAuthSecret = "92de07df7e7a3fe14808cef90a7cc0d91"
+
+	req, _ := http.NewRequest(http.MethodGet, "http://localhost:5984/", nil)
+	assert.NoError(t, authenticateRequest(req))
+	assert.Equal(t, "foo", req.Header.Get("X-Auth-CouchDB-UserName"))
+	assert.Equal(t, "users,blogger", req.Header.Get("X-Auth-CouchDB-Roles"))
+	assert.Len(t, req.Header.Get("X-Auth-CouchDB-Token"), 40)
+	assert.Empty(t, req.Header.Get("Authorization"))
+}
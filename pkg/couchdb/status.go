@@ -1,11 +1,15 @@
 package couchdb
 
 import (
+	"context"
 	"fmt"
 	"net/http"
+	"net/url"
+	"strings"
 	"time"
 
 	"github.com/cozy/cozy-stack/pkg/config/config"
+	"github.com/cozy/cozy-stack/pkg/consts"
 )
 
 // CheckStatus checks that the stack can talk to CouchDB, and returns an error
@@ -17,11 +21,8 @@ func CheckStatus() (time.Duration, error) {
 		return 0, err
 	}
 	req.Header.Add("Accept", "application/json")
-	auth := config.GetConfig().CouchDB.Auth
-	if auth != nil {
-		if p, ok := auth.Password(); ok {
-			req.SetBasicAuth(auth.Username(), p)
-		}
+	if err = authenticateRequest(req); err != nil {
+		return 0, err
 	}
 	before := time.Now()
 	res, err := config.GetConfig().CouchDB.Client.Do(req)
@@ -35,3 +36,221 @@ func CheckStatus() (time.Duration, error) {
 	}
 	return latency, nil
 }
+
+// SelfTest checks that CouchDB can really be used for the given database: a
+// throwaway document is written, read, and deleted. It can detect problems
+// that CheckStatus misses, like a read-only file system or a missing quorum.
+// The requests are made directly, without hooks or realtime events.
+func SelfTest(db Database) error {
+	doctype := consts.Diagnostics
+	written := time.Now().UTC().Format(time.RFC3339Nano)
+	doc := map[string]interface{}{"written_at": written}
+	var res UpdateResponse
+	err := makeRequest(db, doctype, http.MethodPost, "", doc, &res)
+	if IsNoDatabaseError(err) {
+		if err = CreateDB(db, doctype); err != nil && !IsFileExists(err) {
+			return err
+		}
+		err = makeRequest(db, doctype, http.MethodPost, "", doc, &res)
+	}
+	if err != nil {
+		return err
+	}
+
+	var read map[string]interface{}
+	u := url.PathEscape(res.ID)
+	if err = makeRequest(db, doctype, http.MethodGet, u, nil, &read); err != nil {
+		return err
+	}
+	if read["written_at"] != written {
+		return fmt.Errorf("SelfTest: unexpected document %v", read)
+	}
+
+	u += "?rev=" + url.QueryEscape(res.Rev)
+	return makeRequest(db, doctype, http.MethodDelete, u, nil, nil)
+}
+
+// The types of the tasks listed by ActiveTasks
+const (
+	TaskDatabaseCompaction = "database_compaction"
+	TaskViewCompaction     = "view_compaction"
+	TaskIndexer            = "indexer"
+	TaskReplication        = "replication"
+)
+
+// ActiveTask is a task running in CouchDB, as listed by _active_tasks. The
+// fields that are filled depend on the Type of the task.
+type ActiveTask struct {
+	Type      string `json:"type"`
+	Node      string `json:"node,omitempty"`
+	PID       string `json:"pid"`
+	StartedOn int64  `json:"started_on"`
+	UpdatedOn int64  `json:"updated_on"`
+	// Progress is a percentage, for the compactions and the indexers
+	Progress int `json:"progress,omitempty"`
+
+	// For the compactions and the indexers
+	Database       string `json:"database,omitempty"`
+	DesignDocument string `json:"design_document,omitempty"`
+	ChangesDone    int    `json:"changes_done,omitempty"`
+	TotalChanges   int    `json:"total_changes,omitempty"`
+
+	// For the replications
+	ReplicationID         string      `json:"replication_id,omitempty"`
+	Source                string      `json:"source,omitempty"`
+	Target                string      `json:"target,omitempty"`
+	Continuous            bool        `json:"continuous,omitempty"`
+	DocsRead              int         `json:"docs_read,omitempty"`
+	DocsWritten           int         `json:"docs_written,omitempty"`
+	ChangesPending        int         `json:"changes_pending,omitempty"`
+	CheckpointedSourceSeq interface{} `json:"checkpointed_source_seq,omitempty"`
+}
+
+// ActiveTasks returns the tasks running in CouchDB, like the compactions,
+// the indexation of the views, and the replications. It can be used to know
+// why CouchDB is busy.
+func ActiveTasks(db Database) ([]ActiveTask, error) {
+	var tasks []ActiveTask
+	if err := makeRequest(db, "", http.MethodGet, "_active_tasks", nil, &tasks); err != nil {
+		return nil, err
+	}
+	return tasks, nil
+}
+
+// MembershipInfo is the list of the nodes of the CouchDB cluster, as returned
+// by _membership. AllNodes are the nodes that this node knows, and
+// ClusterNodes are the nodes configured as members of the cluster.
+type MembershipInfo struct {
+	AllNodes     []string `json:"all_nodes"`
+	ClusterNodes []string `json:"cluster_nodes"`
+}
+
+// FullyJoined returns true if all the nodes of the cluster are connected, ie
+// the two lists have the same nodes.
+func (m *MembershipInfo) FullyJoined() bool {
+	if len(m.AllNodes) != len(m.ClusterNodes) {
+		return false
+	}
+	known := make(map[string]bool, len(m.AllNodes))
+	for _, node := range m.AllNodes {
+		known[node] = true
+	}
+	for _, node := range m.ClusterNodes {
+		if !known[node] {
+			return false
+		}
+	}
+	return true
+}
+
+// hasHost returns true if one of the nodes of the cluster is on the given
+// host. The nodes are named like "couchdb@couchdb-2".
+func (m *MembershipInfo) hasHost(host string) bool {
+	for _, node := range m.ClusterNodes {
+		if i := strings.LastIndexByte(node, '@'); i >= 0 && node[i+1:] == host {
+			return true
+		}
+	}
+	return false
+}
+
+// Membership returns the nodes of the CouchDB cluster. It can be used to
+// check that the cluster is healthy and that all the nodes have joined it.
+func Membership(db Database) (*MembershipInfo, error) {
+	var info MembershipInfo
+	if err := makeRequest(db, "", http.MethodGet, "_membership", nil, &info); err != nil {
+		return nil, err
+	}
+	return &info, nil
+}
+
+// dbsInfoMaxKeys is the maximal number of databases that can be asked in a
+// single _dbs_info request (max_db_number_for_dbs_info_req in CouchDB).
+const dbsInfoMaxKeys = 100
+
+// SnapshotDocCounts returns the number of documents of each doctype of the
+// instance, by doctype. The counts are read from the _dbs_info endpoint, with
+// a single request for up to 100 databases, which is far cheaper than asking
+// the status of each database. Note that the counts include the design docs,
+// as CouchDB doesn't count them separately.
+func SnapshotDocCounts(db Database) (map[string]int, error) {
+	dbs, err := allDbs(db)
+	if err != nil {
+		return nil, err
+	}
+	counts := make(map[string]int, len(dbs))
+	for start := 0; start < len(dbs); start += dbsInfoMaxKeys {
+		end := start + dbsInfoMaxKeys
+		if end > len(dbs) {
+			end = len(dbs)
+		}
+		body := map[string][]string{"keys": dbs[start:end]}
+		var infos []struct {
+			Key  string            `json:"key"`
+			Info *DBStatusResponse `json:"info"`
+		}
+		if err := makeRequest(db, "", http.MethodPost, "_dbs_info", body, &infos); err != nil {
+			return nil, err
+		}
+		for _, info := range infos {
+			if info.Info == nil {
+				continue
+			}
+			if doctype, ok := DoctypeFromDBName(db, info.Key); ok {
+				counts[doctype] = info.Info.DocCount
+			}
+		}
+	}
+	return counts, nil
+}
+
+// tasksPollInterval is the delay between two requests to _active_tasks in
+// WaitTasksIdle.
+var tasksPollInterval = 1 * time.Second
+
+// WaitTasksIdle waits until CouchDB has no active task (compaction,
+// indexation) on the database of the doctype, or until the context is done.
+// It can be used before a maintenance operation on this database.
+func WaitTasksIdle(ctx context.Context, db Database, doctype string) error {
+	dbname := EscapeCouchdbName(db.DBPrefix() + "/" + doctype)
+	for {
+		tasks, err := ActiveTasks(db)
+		if err != nil {
+			return err
+		}
+		busy := false
+		for _, task := range tasks {
+			if taskDBName(task.Database) == dbname {
+				busy = true
+				break
+			}
+		}
+		if !busy {
+			return nil
+		}
+		select {
+		case <-time.After(tasksPollInterval):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// taskDBName returns the name of the database for the database field of an
+// active task. On a CouchDB cluster, it is the name of a shard, like
+// shards/00000000-1fffffff/prefix/doctype.1600000000, and the shard range and
+// the suffix are removed.
+func taskDBName(database string) string {
+	if !strings.HasPrefix(database, "shards/") {
+		return database
+	}
+	parts := strings.SplitN(database, "/", 3)
+	if len(parts) < 3 {
+		return database
+	}
+	name := parts[2]
+	if i := strings.LastIndex(name, "."); i >= 0 {
+		name = name[:i]
+	}
+	return name
+}
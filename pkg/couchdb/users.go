@@ -0,0 +1,64 @@
+package couchdb
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// couchUserPrefix is the prefix of the IDs of the documents in _users.
+const couchUserPrefix = "org.couchdb.user:"
+
+// CouchUser is a user of CouchDB, from the _users database. The password
+// fields are not included.
+type CouchUser struct {
+	ID    string   `json:"_id"`
+	Rev   string   `json:"_rev"`
+	Name  string   `json:"name"`
+	Type  string   `json:"type"`
+	Roles []string `json:"roles"`
+}
+
+// GetCouchUser returns the CouchDB user with the given name. The _users
+// database is shared by all the instances, and the db parameter is only used
+// for the logs.
+func GetCouchUser(db Database, name string) (*CouchUser, error) {
+	if name == "" {
+		return nil, fmt.Errorf("Missing name for GetCouchUser")
+	}
+	var user CouchUser
+	path := "_users/" + url.PathEscape(couchUserPrefix+name)
+	if err := makeRequest(db, "", http.MethodGet, path, nil, &user); err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// ListCouchUsers returns the users of CouchDB, from the _users database. The
+// db parameter is only used for the logs.
+func ListCouchUsers(db Database) ([]CouchUser, error) {
+	var res struct {
+		Rows []struct {
+			ID  string          `json:"id"`
+			Doc json.RawMessage `json:"doc"`
+		} `json:"rows"`
+	}
+	path := "_users/_all_docs?include_docs=true"
+	if err := makeRequest(db, "", http.MethodGet, path, nil, &res); err != nil {
+		return nil, err
+	}
+	users := make([]CouchUser, 0, len(res.Rows))
+	for _, row := range res.Rows {
+		if !strings.HasPrefix(row.ID, couchUserPrefix) {
+			continue
+		}
+		var user CouchUser
+		if err := json.Unmarshal(row.Doc, &user); err != nil {
+			return nil, err
+		}
+		users = append(users, user)
+	}
+	return users, nil
+}
@@ -18,7 +18,11 @@ func newMemHub() *memHub {
 }
 
 func (h *memHub) Publish(db prefixer.Prefixer, verb string, doc, oldDoc Doc) {
-	e := newEvent(db, verb, doc, oldDoc)
+	h.PublishWithOrigin(db, verb, doc, oldDoc, "")
+}
+
+func (h *memHub) PublishWithOrigin(db prefixer.Prefixer, verb string, doc, oldDoc Doc, origin string) {
+	e := newEvent(db, verb, doc, oldDoc, origin)
 	topic := h.get(e, doc.DocType())
 	if topic != nil {
 		topic.broadcast <- e
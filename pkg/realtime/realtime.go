@@ -1,6 +1,7 @@
 package realtime
 
 import (
+	"context"
 	"errors"
 	"sync"
 	"sync/atomic"
@@ -30,18 +31,37 @@ type Event struct {
 	Verb   string `json:"verb"`
 	Doc    Doc    `json:"doc"`
 	OldDoc Doc    `json:"old,omitempty"`
+	// Origin is the app slug or the user ID that has made the change, if it
+	// is known. The clients can use it to ignore their own changes.
+	Origin string `json:"origin,omitempty"`
 }
 
-func newEvent(db prefixer.Prefixer, verb string, doc Doc, oldDoc Doc) *Event {
+func newEvent(db prefixer.Prefixer, verb string, doc Doc, oldDoc Doc, origin string) *Event {
 	return &Event{
 		Domain: db.DomainName(),
 		Prefix: db.DBPrefix(),
 		Verb:   verb,
 		Doc:    doc,
 		OldDoc: oldDoc,
+		Origin: origin,
 	}
 }
 
+type originKey struct{}
+
+// WithOrigin returns a context with the origin (app slug or user ID) of the
+// changes made with it.
+func WithOrigin(ctx context.Context, origin string) context.Context {
+	return context.WithValue(ctx, originKey{}, origin)
+}
+
+// OriginFromContext returns the origin of the changes set with WithOrigin,
+// or an empty string.
+func OriginFromContext(ctx context.Context) string {
+	origin, _ := ctx.Value(originKey{}).(string)
+	return origin
+}
+
 // DBPrefix implements the prefixer.Prefixer interface.
 func (e *Event) DBPrefix() string {
 	if e.Prefix != "" {
@@ -62,6 +82,9 @@ type Hub interface {
 	// Emit is used by publishers when an event occurs
 	Publish(db prefixer.Prefixer, verb string, doc Doc, oldDoc Doc)
 
+	// PublishWithOrigin is like Publish, with the origin of the change.
+	PublishWithOrigin(db prefixer.Prefixer, verb string, doc Doc, oldDoc Doc, origin string)
+
 	// Subscriber creates a DynamicSubscriber that can subscribe to several
 	// doctypes. Call its Close method to Unsubscribe.
 	Subscriber(prefixer.Prefixer) *DynamicSubscriber
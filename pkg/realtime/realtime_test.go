@@ -1,6 +1,7 @@
 package realtime
 
 import (
+	"context"
 	"sync"
 	"testing"
 	"time"
@@ -121,6 +122,25 @@ func TestMemRealtime(t *testing.T) {
 	wg.Wait()
 }
 
+func TestPublishWithOrigin(t *testing.T) {
+	h := newMemHub()
+	c := h.Subscriber(testingDB)
+	assert.NoError(t, c.Subscribe("io.cozy.testobject"))
+	defer c.Close()
+
+	ctx := WithOrigin(context.Background(), "drive")
+	assert.Equal(t, "drive", OriginFromContext(ctx))
+	assert.Equal(t, "", OriginFromContext(context.Background()))
+
+	time.AfterFunc(10*time.Millisecond, func() {
+		doc := &testDoc{doctype: "io.cozy.testobject", id: "foo"}
+		h.PublishWithOrigin(testingDB, EventUpdate, doc, nil, OriginFromContext(ctx))
+	})
+	e := <-c.Channel
+	assert.Equal(t, "foo", e.Doc.ID())
+	assert.Equal(t, "drive", e.Origin)
+}
+
 func TestWatch(t *testing.T) {
 	h := newMemHub()
 	c1 := h.Subscriber(testingDB)
@@ -70,6 +70,7 @@ type jsonEvent struct {
 	Verb   string
 	Doc    *JSONDoc
 	Old    *JSONDoc
+	Origin string
 }
 
 func (j *jsonEvent) UnmarshalJSON(buf []byte) error {
@@ -80,6 +81,7 @@ func (j *jsonEvent) UnmarshalJSON(buf []byte) error {
 	j.Domain, _ = m["domain"].(string)
 	j.Prefix, _ = m["prefix"].(string)
 	j.Verb, _ = m["verb"].(string)
+	j.Origin, _ = m["origin"].(string)
 	if doc, ok := m["doc"].(map[string]interface{}); ok {
 		j.Doc = toJSONDoc(doc)
 	}
@@ -112,7 +114,7 @@ func (h *redisHub) start() {
 			je.Old.Type = doctype
 		}
 		db := prefixer.NewPrefixer(je.Domain, je.Prefix)
-		h.mem.Publish(db, je.Verb, je.Doc, je.Old)
+		h.mem.PublishWithOrigin(db, je.Verb, je.Doc, je.Old, je.Origin)
 	}
 }
 
@@ -121,7 +123,11 @@ func (h *redisHub) GetTopic(db prefixer.Prefixer, doctype string) *topic {
 }
 
 func (h *redisHub) Publish(db prefixer.Prefixer, verb string, doc, oldDoc Doc) {
-	e := newEvent(db, verb, doc, oldDoc)
+	h.PublishWithOrigin(db, verb, doc, oldDoc, "")
+}
+
+func (h *redisHub) PublishWithOrigin(db prefixer.Prefixer, verb string, doc, oldDoc Doc, origin string) {
+	e := newEvent(db, verb, doc, oldDoc, origin)
 	h.local.broadcast <- e
 	buf, err := json.Marshal(e)
 	if err != nil {
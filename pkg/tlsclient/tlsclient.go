@@ -26,6 +26,9 @@ type HTTPEndpoint struct {
 	Port      int
 	Timeout   time.Duration
 	EnvPrefix string
+	// DialTimeout is the maximal duration for establishing a connection. It
+	// is separate from Timeout, that covers the whole request.
+	DialTimeout time.Duration
 
 	RootCAFile             string
 	ClientCertificateFiles ClientCertificateFilePair
@@ -112,6 +115,13 @@ func NewHTTPClient(opt HTTPEndpoint) (client *http.Client, u *url.URL, err error
 	if opt.DisableCompression {
 		transport.DisableCompression = true
 	}
+	if opt.DialTimeout > 0 {
+		dialer := &net.Dialer{
+			Timeout:   opt.DialTimeout,
+			KeepAlive: 30 * time.Second,
+		}
+		transport.DialContext = dialer.DialContext
+	}
 	client = &http.Client{
 		Timeout:   opt.Timeout,
 		Transport: transport,
@@ -52,9 +52,10 @@ type command struct {
 }
 
 type wsResponsePayload struct {
-	Type string      `json:"type"`
-	ID   string      `json:"id"`
-	Doc  interface{} `json:"doc,omitempty"`
+	Type   string      `json:"type"`
+	ID     string      `json:"id"`
+	Doc    interface{} `json:"doc,omitempty"`
+	Origin string      `json:"origin,omitempty"`
 }
 
 type wsResponse struct {
@@ -290,9 +291,10 @@ func Ws(c echo.Context) error {
 			res := wsResponse{
 				Event: e.Verb,
 				Payload: wsResponsePayload{
-					Type: e.Doc.DocType(),
-					ID:   e.Doc.ID(),
-					Doc:  e.Doc,
+					Type:   e.Doc.DocType(),
+					ID:     e.Doc.ID(),
+					Doc:    e.Doc,
+					Origin: e.Origin,
 				},
 			}
 			if err := ws.WriteJSON(res); err != nil {
@@ -106,6 +106,7 @@ func assertSharingIsCorrectOnSharer(t *testing.T, body io.Reader) {
 
 func assertInvitationMailWasSent(t *testing.T) string {
 	var jobs []job.Job
+	limit := 2
 	couchReq := &couchdb.FindRequest{
 		UseIndex: "by-worker-and-state",
 		Selector: mango.And(
@@ -115,7 +116,7 @@ func assertInvitationMailWasSent(t *testing.T) string {
 		Sort: mango.SortBy{
 			mango.SortByField{Field: "worker", Direction: "desc"},
 		},
-		Limit: 2,
+		Limit: &limit,
 	}
 	err := couchdb.FindDocs(aliceInstance, consts.Jobs, couchReq, &jobs)
 	assert.NoError(t, err)
@@ -98,13 +98,14 @@ func migrateNotesMimeType(domain string) error {
 	log := inst.Logger().WithField("nspace", "migration")
 
 	var docs []*vfs.FileDoc
+	limit := 1000
 	req := &couchdb.FindRequest{
 		UseIndex: "by-mime-updated-at",
 		Selector: mango.And(
 			mango.Equal("mime", "text/markdown"),
 			mango.Exists("updated_at"),
 		),
-		Limit: 1000,
+		Limit: &limit,
 	}
 	_, err = couchdb.FindDocsRaw(inst, consts.Files, req, &docs)
 	if err != nil {
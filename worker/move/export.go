@@ -169,6 +169,7 @@ func GetExport(inst *instance.Instance, mac []byte) (*ExportDoc, error) {
 // GetExports returns the list of exported documents.
 func GetExports(domain string) ([]*ExportDoc, error) {
 	var docs []*ExportDoc
+	limit := 256
 	req := &couchdb.FindRequest{
 		UseIndex: "by-domain",
 		Selector: mango.Equal("domain", domain),
@@ -176,7 +177,7 @@ func GetExports(domain string) ([]*ExportDoc, error) {
 			{Field: "domain", Direction: mango.Desc},
 			{Field: "created_at", Direction: mango.Desc},
 		},
-		Limit: 256,
+		Limit: &limit,
 	}
 	err := couchdb.FindDocs(couchdb.GlobalDB, consts.Exports, req, &docs)
 	if err != nil && !couchdb.IsNoDatabaseError(err) {